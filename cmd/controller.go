@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"context"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/metrics"
 	"github.com/choffmeister/csi-driver-truenas/internal/services"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/spf13/cobra"
 )
@@ -10,27 +14,45 @@ var (
 	controllerCmd = &cobra.Command{
 		Use: "controller",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			listener, err := services.CreateCSIListener()
+			shutdownTracing, err := setupTracing(cmd.Context())
+			if err != nil {
+				return err
+			}
+			defer shutdownTracing(context.Background()) // nolint: errcheck
+
+			listener, err := services.CreateCSIListener(cfg.Endpoint)
 			if err != nil {
 				return err
 			}
 			grpcServer := services.CreateGRPCServer()
+			if cfg.MetricsAddress != "" {
+				if _, err := metrics.Serve(cfg.MetricsAddress, nil); err != nil {
+					return err
+				}
+			}
+			if err := serveLogLevel(); err != nil {
+				return err
+			}
 
-			identityService := services.NewIdentityService()
+			identityService := services.NewIdentityService(cfg)
 			proto.RegisterIdentityServer(grpcServer, identityService)
 
-			controllerService := services.NewControllerService()
+			secrets := map[string]string{}
+			if cfg.SecretsDir != "" {
+				secrets, err = utils.LoadSecretsDir(cfg.SecretsDir)
+				if err != nil {
+					return err
+				}
+			}
+			controllerService := services.NewControllerService(cfg, secrets)
 			proto.RegisterControllerServer(grpcServer, controllerService)
 
 			identityService.SetReady(true)
-			if err := grpcServer.Serve(listener); err != nil {
-				return err
-			}
-
-			return nil
+			return services.Serve(grpcServer, listener, identityService, stopSignals(), cfg.ShutdownTimeout)
 		},
 	}
 )
 
 func init() {
+	cfg.BindControllerFlags(controllerCmd.Flags())
 }
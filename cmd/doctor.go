@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	"github.com/choffmeister/csi-driver-truenas/internal/services"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorSecretsFile string
+	doctorKubeSecret  string
+	doctorBackend     string
+	doctorParents     []string
+	doctorOutput      string
+	doctorCmd         = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the secrets against the TrueNAS system before provisioning volumes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secrets, err := loadCommandSecrets(cmd.Context(), doctorSecretsFile, doctorKubeSecret)
+			if err != nil {
+				return err
+			}
+			names := services.AdminBackendNames(secrets)
+			if doctorBackend != "" {
+				names = []string{doctorBackend}
+			}
+			results := []doctor.Result{}
+			for _, name := range names {
+				for _, result := range services.DiagnoseBackend(cmd.Context(), cfg, secrets, name, doctorParents) {
+					if name != "" {
+						result.Check = fmt.Sprintf("%s: %s", name, result.Check)
+					}
+					results = append(results, result)
+				}
+			}
+			return printDoctorResults(os.Stdout, results)
+		},
+	}
+	doctorNodeCmd = &cobra.Command{
+		Use:   "node",
+		Short: "Check the prerequisites of the node, run it within the node container",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nodeService := services.NewNodeService(cfg)
+			return printDoctorResults(os.Stdout, nodeService.Diagnose(cmd.Context()))
+		},
+	}
+)
+
+// printDoctorResults prints the results and fails if any of the checks failed.
+func printDoctorResults(w io.Writer, results []doctor.Result) error {
+	switch doctorOutput {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return err
+		}
+	case "text":
+		doctor.Print(w, results)
+	default:
+		return fmt.Errorf("unknown output format %s, expected text or json", doctorOutput)
+	}
+	if failed := doctor.Failed(results); failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorSecretsFile, "secrets-file", "", "file with the secrets as KEY=value lines, e.g. truenas-url=https://nas")
+	doctorCmd.Flags().StringVar(&cfg.SecretsDir, "secrets-dir", cfg.SecretsDir, "directory with a mounted secret")
+	doctorCmd.Flags().StringVar(&doctorKubeSecret, "kube-secret", "", "kubernetes secret with the secrets as namespace/name, only works inside the cluster")
+	doctorCmd.Flags().StringVar(&doctorBackend, "backend", "", "name of the backend within the secrets to check, defaults to all")
+	doctorCmd.Flags().StringArrayVar(&doctorParents, "parent-dataset", nil, "truenas-parent-dataset parameter of a storage class to check in addition to the secret, can be repeated")
+	doctorCmd.PersistentFlags().StringVarP(&doctorOutput, "output", "o", "text", "output format, text or json")
+	doctorCmd.AddCommand(doctorNodeCmd)
+}
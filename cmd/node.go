@@ -1,10 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"net/http"
 
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	"github.com/choffmeister/csi-driver-truenas/internal/metrics"
 	"github.com/choffmeister/csi-driver-truenas/internal/services"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/spf13/cobra"
 )
@@ -13,32 +17,82 @@ var (
 	nodeCmd = &cobra.Command{
 		Use: "node",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			listener, err := services.CreateCSIListener()
+			shutdownTracing, err := setupTracing(cmd.Context())
 			if err != nil {
 				return err
 			}
-			grpcServer := services.CreateGRPCServer()
+			defer shutdownTracing(context.Background()) // nolint: errcheck
 
-			identityService := services.NewIdentityService()
-			proto.RegisterIdentityServer(grpcServer, identityService)
+			listener, err := services.CreateCSIListener(cfg.Endpoint)
+			if err != nil {
+				return err
+			}
+			grpcServer := services.CreateGRPCServer()
 
-			nodeId := os.Getenv("KUBE_NODE_NAME")
-			if nodeId == "" {
-				return fmt.Errorf("you need to specify the node nama via the KUBE_NODE_NAME env var")
+			if cfg.NodeId == "" {
+				return fmt.Errorf("you need to specify the node name via the KUBE_NODE_NAME env var or the --node-id flag")
+			}
+			utils.Log = utils.Log.WithValues("nodeId", cfg.NodeId)
+			if cfg.Zone == "" && cfg.TopologyFromNodeLabels {
+				labels, err := utils.GetKubernetesNodeLabels(cmd.Context(), cfg.NodeId)
+				if err != nil {
+					return err
+				}
+				cfg.Zone = labels[cfg.TopologyKey]
+			}
+			if cfg.Zone != "" {
+				utils.Log.Info("Reporting topology", cfg.TopologyKey, cfg.Zone)
+			} else if cfg.TopologyFromNodeLabels {
+				// a node without zone must not advertise accessibility constraints,
+				// as the provisioner rejects nodes without topology then
+				utils.Log.Info("Reporting no topology, the node has no label", "label", cfg.TopologyKey)
+				cfg.TopologyFromNodeLabels = false
 			}
 
-			nodeService := services.NewNodeService(nodeId)
+			identityService := services.NewIdentityService(cfg)
+			proto.RegisterIdentityServer(grpcServer, identityService)
+
+			nodeService := services.NewNodeService(cfg)
 			proto.RegisterNodeServer(grpcServer, nodeService)
 
-			identityService.SetReady(true)
-			if err := grpcServer.Serve(listener); err != nil {
+			if cfg.MetricsAddress != "" {
+				if err := metrics.RegisterISCSISessions(nodeService.CountISCSISessions); err != nil {
+					return err
+				}
+				if _, err := metrics.Serve(cfg.MetricsAddress, map[string]http.Handler{"/readyz": identityService.ReadinessHandler()}); err != nil {
+					return err
+				}
+			}
+			if err := serveLogLevel(); err != nil {
 				return err
 			}
 
-			return nil
+			identityService.SetDiagnosis(diagnoseNode(cmd.Context(), nodeService))
+			identityService.SetReady(true)
+			return services.Serve(grpcServer, listener, identityService, stopSignals(), cfg.ShutdownTimeout)
 		},
 	}
 )
 
+// diagnoseNode runs the node doctor if enabled and logs the missing
+// prerequisites. They are reported by the readiness endpoint, but not by Probe,
+// as a failing Probe makes the liveness probe restart the node, which does not
+// fix the host.
+func diagnoseNode(ctx context.Context, nodeService *services.NodeService) []doctor.Result {
+	if !cfg.NodeDoctor {
+		return nil
+	}
+	results := nodeService.Diagnose(ctx)
+	for _, result := range results {
+		if !result.Passed {
+			utils.Log.Info("Node prerequisite is missing", "check", result.Check, "message", result.Message, "hint", result.Hint)
+		} else if result.Warning {
+			utils.Log.Info("Optional node prerequisite is missing", "check", result.Check, "message", result.Message, "hint", result.Hint)
+		}
+	}
+	return results
+}
+
 func init() {
+	cfg.BindNodeFlags(nodeCmd.Flags())
 }
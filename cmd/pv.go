@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/services"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	pvSecretsFile     string
+	pvKubeSecret      string
+	pvBackend         string
+	pvName            string
+	pvStorageClass    string
+	pvSecretName      string
+	pvSecretNamespace string
+	pvFsType          string
+	pvManifestCmd     = &cobra.Command{
+		Use:   "pv-manifest <zvol>",
+		Short: "Print a persistent volume manifest to statically provision an existing zvol",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dataset := args[0]
+			secrets, err := loadCommandSecrets(cmd.Context(), pvSecretsFile, pvKubeSecret)
+			if err != nil {
+				return err
+			}
+			id, volume, err := services.DescribeExistingVolume(cmd.Context(), cfg, secrets, pvBackend, dataset)
+			if err != nil {
+				return fmt.Errorf("unable to look up zvol %s: %w", dataset, err)
+			}
+			if volume.Condition.Abnormal {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", volume.Condition.Message)
+			}
+
+			name := pvName
+			if name == "" {
+				name = path.Base(dataset)
+			}
+			manifest := pvManifest{
+				ApiVersion: "v1",
+				Kind:       "PersistentVolume",
+			}
+			manifest.Metadata.Name = name
+			manifest.Spec.Capacity = map[string]string{"storage": strconv.FormatInt(volume.CapacityBytes, 10)}
+			manifest.Spec.AccessModes = []string{"ReadWriteOnce"}
+			manifest.Spec.PersistentVolumeReclaimPolicy = "Retain"
+			manifest.Spec.StorageClassName = pvStorageClass
+			manifest.Spec.VolumeMode = "Filesystem"
+			manifest.Spec.CSI.Driver = cfg.DriverName
+			manifest.Spec.CSI.VolumeHandle = id.String()
+			manifest.Spec.CSI.FsType = pvFsType
+			if pvSecretName != "" {
+				manifest.Spec.CSI.NodePublishSecretRef = &pvSecretRef{Name: pvSecretName, Namespace: pvSecretNamespace}
+			}
+
+			encoder := yaml.NewEncoder(os.Stdout)
+			encoder.SetIndent(2)
+			return encoder.Encode(manifest)
+		},
+	}
+)
+
+type pvSecretRef struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+type pvManifest struct {
+	ApiVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Capacity                      map[string]string `yaml:"capacity"`
+		AccessModes                   []string          `yaml:"accessModes"`
+		PersistentVolumeReclaimPolicy string            `yaml:"persistentVolumeReclaimPolicy"`
+		StorageClassName              string            `yaml:"storageClassName,omitempty"`
+		VolumeMode                    string            `yaml:"volumeMode"`
+		CSI                           struct {
+			Driver               string       `yaml:"driver"`
+			VolumeHandle         string       `yaml:"volumeHandle"`
+			FsType               string       `yaml:"fsType"`
+			NodePublishSecretRef *pvSecretRef `yaml:"nodePublishSecretRef,omitempty"`
+		} `yaml:"csi"`
+	} `yaml:"spec"`
+}
+
+// loadCommandSecrets reads the secrets for commands run by operators, either
+// from a dotenv file, a kubernetes secret or from the configured secrets directory.
+func loadCommandSecrets(ctx context.Context, file string, kubeSecret string) (map[string]string, error) {
+	if file != "" {
+		secrets, err := godotenv.Read(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secrets file %s: %w", file, err)
+		}
+		return secrets, nil
+	}
+	if kubeSecret != "" {
+		parts := strings.SplitN(kubeSecret, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed kubernetes secret %s, expected namespace/name", kubeSecret)
+		}
+		return utils.GetKubernetesSecret(ctx, parts[0], parts[1])
+	}
+	if cfg.SecretsDir != "" {
+		return utils.LoadSecretsDir(cfg.SecretsDir)
+	}
+	return nil, fmt.Errorf("you need to specify the secrets via --secrets-file, --kube-secret or --secrets-dir")
+}
+
+func init() {
+	pvManifestCmd.Flags().StringVar(&pvSecretsFile, "secrets-file", "", "file with the secrets as KEY=value lines, e.g. truenas-url=https://nas")
+	pvManifestCmd.Flags().StringVar(&cfg.SecretsDir, "secrets-dir", cfg.SecretsDir, "directory with a mounted secret")
+	pvManifestCmd.Flags().StringVar(&pvKubeSecret, "kube-secret", "", "kubernetes secret with the secrets as namespace/name, only works inside the cluster")
+	pvManifestCmd.Flags().StringVar(&pvBackend, "backend", "", "name of the backend within the secrets holding the zvol")
+	pvManifestCmd.Flags().StringVar(&pvName, "name", "", "name of the persistent volume (defaults to the zvol name)")
+	pvManifestCmd.Flags().StringVar(&pvStorageClass, "storage-class", "", "storage class name of the persistent volume")
+	pvManifestCmd.Flags().StringVar(&pvSecretName, "node-publish-secret-name", "", "name of the secret used to publish the volume on the nodes")
+	pvManifestCmd.Flags().StringVar(&pvSecretNamespace, "node-publish-secret-namespace", "", "namespace of the secret used to publish the volume on the nodes")
+	pvManifestCmd.Flags().StringVar(&pvFsType, "fs-type", "ext4", "file system of the zvol")
+}
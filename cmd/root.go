@@ -1,32 +1,69 @@
 package cmd
 
 import (
-	"io/ioutil"
-	"log"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/tracing"
 	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 	"github.com/spf13/cobra"
 )
 
 var (
-	verbose bool
-	rootCmd = &cobra.Command{
+	verbose    bool
+	configFile string
+	cfg        = config.Default()
+	rootCmd    = &cobra.Command{
 		Use: "csi-driver-truenas",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			if !verbose {
-				utils.Debug = log.New(ioutil.Discard, "", log.LstdFlags)
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := cfg.Load(cmd.Flags(), configFile); err != nil {
+				return err
 			}
+			if verbose && cfg.LogVerbosity < 1 {
+				cfg.LogVerbosity = 1
+			}
+			utils.SetLogVerbosity(cfg.LogVerbosity)
+			utils.CommandTimeout = cfg.CommandTimeout
+			utils.DefaultHttpTimeout = cfg.ApiTimeout
+			return nil
 		},
 	}
 )
 
+// serveLogLevel starts the /loglevel endpoint if enabled.
+func serveLogLevel() error {
+	if cfg.LogLevelAddress == "" {
+		return nil
+	}
+	_, err := utils.ServeLogVerbosity(cfg.LogLevelAddress)
+	return err
+}
+
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	return tracing.Setup(ctx, tracing.Options{Endpoint: cfg.OTLPEndpoint, Insecure: cfg.OTLPInsecure})
+}
+
+func stopSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return signals
+}
+
 func Execute() error {
 	return rootCmd.Execute()
 }
 
 func init() {
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable debug logging, same as --log-verbosity=1")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", os.Getenv("CSI_DRIVER_TRUENAS_CONFIG"), "yaml config file, flags take precedence over environment variables, which take precedence over the config file (env CSI_DRIVER_TRUENAS_CONFIG)")
+	cfg.BindFlags(rootCmd.PersistentFlags())
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(controllerCmd)
 	rootCmd.AddCommand(nodeCmd)
+	rootCmd.AddCommand(pvManifestCmd)
+	rootCmd.AddCommand(volumesCmd)
+	rootCmd.AddCommand(doctorCmd)
 }
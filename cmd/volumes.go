@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/backends/truenas"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/services"
+	"github.com/spf13/cobra"
+)
+
+var (
+	volumesSecretsFile string
+	volumesKubeSecret  string
+	volumesBackend     string
+	volumesOutput      string
+	volumesDeleteYes   bool
+	volumesCmd         = &cobra.Command{
+		Use:   "volumes",
+		Short: "Inspect and manage the volumes of the driver",
+	}
+	volumesListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the volumes the driver has created",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secrets, err := loadCommandSecrets(cmd.Context(), volumesSecretsFile, volumesKubeSecret)
+			if err != nil {
+				return err
+			}
+			names := services.AdminBackendNames(secrets)
+			if volumesBackend != "" {
+				names = []string{volumesBackend}
+			}
+			result := []volumeOutput{}
+			for _, name := range names {
+				backend, err := services.NewAdminBackend(cfg, secrets, name)
+				if err != nil {
+					return err
+				}
+				volumes, err := backend.ListVolumes(cmd.Context())
+				if err != nil {
+					return fmt.Errorf("unable to list volumes of backend %s: %w", name, err)
+				}
+				for _, volume := range volumes {
+					result = append(result, newVolumeOutput(backend, name, volume))
+				}
+			}
+			return printVolumes(os.Stdout, result)
+		},
+	}
+	volumesInspectCmd = &cobra.Command{
+		Use:   "inspect <volume-id>",
+		Short: "Show a volume together with its iscsi target and extent",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secrets, err := loadCommandSecrets(cmd.Context(), volumesSecretsFile, volumesKubeSecret)
+			if err != nil {
+				return err
+			}
+			backend, id, err := services.ResolveAdminVolume(cfg, secrets, args[0], volumesBackend)
+			if err != nil {
+				return err
+			}
+			volume, err := backend.InspectVolume(cmd.Context(), id.Dataset)
+			if err != nil {
+				return err
+			}
+			return printVolumes(os.Stdout, []volumeOutput{newVolumeOutput(backend, id.Backend, *volume)})
+		},
+	}
+	volumesDeleteCmd = &cobra.Command{
+		Use:   "delete <volume-id>",
+		Short: "Delete a volume together with its iscsi target and extent",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secrets, err := loadCommandSecrets(cmd.Context(), volumesSecretsFile, volumesKubeSecret)
+			if err != nil {
+				return err
+			}
+			backend, id, err := services.ResolveAdminVolume(cfg, secrets, args[0], volumesBackend)
+			if err != nil {
+				return err
+			}
+			if _, err := backend.InspectVolume(cmd.Context(), id.Dataset); err != nil {
+				return err
+			}
+			if !volumesDeleteYes {
+				return fmt.Errorf("refusing to delete volume %s without --yes, the data will be lost", id.Dataset)
+			}
+			if err := backend.DeleteVolume(cmd.Context(), id.Dataset); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "deleted volume %s\n", id.Dataset)
+			return nil
+		},
+	}
+	volumesExpandCmd = &cobra.Command{
+		Use:   "expand <volume-id> <size>",
+		Short: "Grow a volume to the given size, e.g. 10Gi",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			size, err := config.ParseSize(args[1])
+			if err != nil {
+				return err
+			}
+			secrets, err := loadCommandSecrets(cmd.Context(), volumesSecretsFile, volumesKubeSecret)
+			if err != nil {
+				return err
+			}
+			backend, id, err := services.ResolveAdminVolume(cfg, secrets, args[0], volumesBackend)
+			if err != nil {
+				return err
+			}
+			volume, err := backend.InspectVolume(cmd.Context(), id.Dataset)
+			if err != nil {
+				return err
+			}
+			if int64(size) < volume.CapacityBytes {
+				return fmt.Errorf("volume %s has %s already, shrinking is not supported", id.Dataset, formatBytes(volume.CapacityBytes))
+			}
+			expanded, err := backend.ExpandVolume(cmd.Context(), id.Dataset, int64(size), 0)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "expanded volume %s to %s, the file system grows once the persistent volume claim has been expanded as well\n", id.Dataset, formatBytes(expanded))
+			return nil
+		},
+	}
+)
+
+type volumeOutput struct {
+	VolumeId string `json:"volumeId"`
+	Backend  string `json:"backend"`
+	truenas.VolumeDetails
+}
+
+func newVolumeOutput(backend *truenas.TruenasBackend, backendName string, volume truenas.VolumeDetails) volumeOutput {
+	id := backends.VolumeId{
+		Backend:  backendName,
+		Identity: backend.Identity(),
+		Protocol: backends.ProtocolISCSI,
+		Dataset:  volume.Dataset,
+	}
+	return volumeOutput{VolumeId: id.String(), Backend: backendName, VolumeDetails: volume}
+}
+
+func printVolumes(w io.Writer, volumes []volumeOutput) error {
+	switch volumesOutput {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(volumes)
+	case "table":
+		break
+	default:
+		return fmt.Errorf("unknown output format %s, expected table or json", volumesOutput)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tDATASET\tSIZE\tUSED\tTARGET\tEXTENT\tCOMMENT\tSTATUS")
+	for _, volume := range volumes {
+		status := "healthy"
+		if len(volume.Problems) > 0 {
+			status = strings.Join(volume.Problems, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			orDash(volume.Backend), volume.Dataset, formatBytes(volume.CapacityBytes), formatBytes(volume.UsedBytes),
+			orDash(volume.Target), orDash(volume.Extent), orDash(volume.Comment), status)
+	}
+	return tw.Flush()
+}
+
+func orDash(str string) string {
+	if str == "" {
+		return "-"
+	}
+	return str
+}
+
+// formatBytes formats the size with the largest binary unit that divides it.
+func formatBytes(size int64) string {
+	units := []string{"Ki", "Mi", "Gi", "Ti"}
+	unit := ""
+	for _, u := range units {
+		if size == 0 || size%1024 != 0 {
+			break
+		}
+		size /= 1024
+		unit = u
+	}
+	return fmt.Sprintf("%d%s", size, unit)
+}
+
+func init() {
+	volumesCmd.PersistentFlags().StringVar(&volumesSecretsFile, "secrets-file", "", "file with the secrets as KEY=value lines, e.g. truenas-url=https://nas")
+	volumesCmd.PersistentFlags().StringVar(&cfg.SecretsDir, "secrets-dir", cfg.SecretsDir, "directory with a mounted secret")
+	volumesCmd.PersistentFlags().StringVar(&volumesKubeSecret, "kube-secret", "", "kubernetes secret with the secrets as namespace/name, only works inside the cluster")
+	volumesCmd.PersistentFlags().StringVar(&volumesBackend, "backend", "", "name of the backend within the secrets, for list it restricts the output to it")
+	volumesCmd.PersistentFlags().StringVarP(&volumesOutput, "output", "o", "table", "output format, table or json")
+	volumesDeleteCmd.Flags().BoolVar(&volumesDeleteYes, "yes", false, "confirm that the volume and its data should be deleted")
+	volumesCmd.AddCommand(volumesListCmd)
+	volumesCmd.AddCommand(volumesInspectCmd)
+	volumesCmd.AddCommand(volumesDeleteCmd)
+	volumesCmd.AddCommand(volumesExpandCmd)
+}
@@ -2,19 +2,61 @@ package backends
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
+// ErrVolumeNotFound is wrapped by the errors of backends when the requested
+// volume does not exist.
+var ErrVolumeNotFound = errors.New("volume not found")
+
+// ErrVolumeAlreadyExists is wrapped by the errors of backends when a volume of
+// the requested name exists already, but is incompatible with the request.
+var ErrVolumeAlreadyExists = errors.New("volume already exists")
+
+// ErrInsufficientCapacity is wrapped by the errors of backends when there is not
+// enough space left to create or expand a volume.
+var ErrInsufficientCapacity = errors.New("insufficient capacity")
+
+// ErrVolumeSizeOutOfRange is wrapped by the errors of backends when the size of
+// a volume cannot satisfy the limit of the request, e.g. as it would shrink.
+var ErrVolumeSizeOutOfRange = errors.New("volume size out of range")
+
 type Backend interface {
 	LoadParameters(parameters map[string]string) error
 	LoadSecrets(secrets map[string]string) error
 	LoadPublishContext(context map[string]string) error
-	CreateVolume(ctx context.Context, name string, size int64) (string, error)
+	// CreateVolume returns the id and the size of the volume, which is rounded
+	// up to the block size of the backend, but must not exceed the limit (0
+	// means no limit).
+	CreateVolume(ctx context.Context, name string, size int64, limit int64) (string, int64, error)
+	// VolumeDataset returns the id CreateVolume would use for the given name.
+	VolumeDataset(name string) string
+	ImportVolume(ctx context.Context, id string) (string, error)
 	DeleteVolume(ctx context.Context, id string) error
-	ExpandVolume(ctx context.Context, id string, size int64) error
+	// ExpandVolume grows the volume like CreateVolume and returns its size.
+	// Volumes that are already large enough are left as they are.
+	ExpandVolume(ctx context.Context, id string, size int64, limit int64) (int64, error)
 	CommentVolume(ctx context.Context, id string, comment string) error
+	GetVolume(ctx context.Context, id string) (*Volume, error)
+	GetAvailableCapacity(ctx context.Context) (int64, error)
 	GetISCSISecrets() *ISCSISecrets
+	// Identity identifies the location of the backend, see BackendIdentity.
+	Identity() string
+}
+
+type Volume struct {
+	Id            string
+	CapacityBytes int64
+	Condition     VolumeCondition
+}
+
+type VolumeCondition struct {
+	Abnormal bool
+	Message  string
 }
 
 type ISCSISecrets struct {
@@ -25,46 +67,49 @@ type ISCSISecrets struct {
 	InitiatorId int
 }
 
+// TargetIQN returns the iqn of the iscsi target with the given name.
+func (s ISCSISecrets) TargetIQN(name string) string {
+	return fmt.Sprintf("%s:%s", s.BaseIQN, name)
+}
+
+var importedTargetNameInvalid = regexp.MustCompile(`[^a-z0-9.-]`)
+
+// ImportedTargetName returns the name of the iscsi target and extent of a zvol
+// that has not been created by the driver. It is derived from the full dataset
+// path, as the last path element alone is not unique within the pool.
+func ImportedTargetName(dataset string) string {
+	return importedTargetNameInvalid.ReplaceAllString(strings.ToLower(dataset), "-")
+}
+
+// ISCSISecretFields are the secrets of the iscsi portal the volumes are
+// exported with.
+var ISCSISecretFields = []Field{
+	{Key: "iscsi-base-iqn", Required: true, Validate: ValidateIQN},
+	{Key: "iscsi-portal-ip", Required: true, Validate: ValidateIP},
+	{Key: "iscsi-portal-port", Default: "3260", Validate: ValidatePort},
+	{Key: "iscsi-portal-id", Required: true, Validate: ValidateId},
+	{Key: "iscsi-initiator-id", Required: true, Validate: ValidateId},
+}
+
 func LoadISCSISecrets(secrets map[string]string) (*ISCSISecrets, error) {
-	baseIQN := secrets["iscsi-base-iqn"]
-	if baseIQN == "" {
-		return nil, fmt.Errorf("missing secret iscsi-base-iqn")
-	}
-	portalIP := secrets["iscsi-portal-ip"]
-	if portalIP == "" {
-		return nil, fmt.Errorf("missing secret iscsi-portal-ip")
-	}
-	portalPortStr := secrets["iscsi-portal-port"]
-	portalPort := 3260
-	if portalPortStr != "" {
-		portalPortParsed, err := strconv.Atoi(portalPortStr)
-		if err != nil {
-			return nil, fmt.Errorf("malformed secret iscsi-portal-port: %w", err)
-		}
-		portalPort = portalPortParsed
-	}
-	portalIdStr := secrets["iscsi-portal-id"]
-	if portalIdStr == "" {
-		return nil, fmt.Errorf("missing secret iscsi-portal-id")
-	}
-	portalId, err := strconv.Atoi(portalIdStr)
-	if err != nil {
-		return nil, fmt.Errorf("malformed secret iscsi-portal-id: %w", err)
-	}
-	initiatorIdStr := secrets["iscsi-initiator-id"]
-	if initiatorIdStr == "" {
-		return nil, fmt.Errorf("missing secret iscsi-initiator-id")
-	}
-	initiatorId, err := strconv.Atoi(initiatorIdStr)
+	values, err := Schema{Kind: "secret", Fields: ISCSISecretFields}.Load(secrets)
 	if err != nil {
-		return nil, fmt.Errorf("malformed secret iscsi-initiator-id: %w", err)
+		return nil, err
 	}
+	return NewISCSISecrets(values), nil
+}
 
+// NewISCSISecrets converts secrets that have been loaded with a schema
+// containing ISCSISecretFields.
+func NewISCSISecrets(values map[string]string) *ISCSISecrets {
+	portalPort, _ := strconv.Atoi(values["iscsi-portal-port"])
+	portalId, _ := strconv.Atoi(values["iscsi-portal-id"])
+	initiatorId, _ := strconv.Atoi(values["iscsi-initiator-id"])
 	return &ISCSISecrets{
-		BaseIQN:     baseIQN,
-		PortalIP:    portalIP,
+		BaseIQN:     values["iscsi-base-iqn"],
+		PortalIP:    values["iscsi-portal-ip"],
 		PortalPort:  portalPort,
 		PortalId:    portalId,
 		InitiatorId: initiatorId,
-	}, nil
+	}
 }
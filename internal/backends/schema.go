@@ -0,0 +1,190 @@
+package backends
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+)
+
+// Field describes a key of the secrets or parameters of a backend.
+type Field struct {
+	Key      string
+	Required bool
+	// Default is used if the value is missing or empty
+	Default string
+	// Validate checks the value, it is skipped for missing values
+	Validate func(value string) error
+}
+
+// Schema describes the secrets or parameters of a backend, so that all missing
+// and malformed keys are reported at once instead of one per attempt.
+type Schema struct {
+	// Kind names the values in errors, e.g. "secret" or "parameter"
+	Kind   string
+	Fields []Field
+}
+
+// SchemaError lists every missing and malformed key.
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return strings.Join(e.Problems, ", ")
+}
+
+// Load validates the values and returns them with the defaults applied. Keys
+// that are not part of the schema are ignored, as the secrets are shared with
+// the node and between backends.
+func (s Schema) Load(values map[string]string) (map[string]string, error) {
+	result := map[string]string{}
+	problems := []string{}
+	for _, field := range s.Fields {
+		value := values[field.Key]
+		if value == "" {
+			value = field.Default
+		}
+		if value == "" {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("missing %s %s", s.Kind, field.Key))
+			}
+			continue
+		}
+		if field.Validate != nil {
+			if err := field.Validate(value); err != nil {
+				problems = append(problems, fmt.Sprintf("malformed %s %s: %v", s.Kind, field.Key, err))
+				continue
+			}
+		}
+		result[field.Key] = value
+	}
+	if len(problems) > 0 {
+		return nil, &SchemaError{Problems: problems}
+	}
+	return result, nil
+}
+
+func ValidateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("expected an http or https url like https://nas.local, got %s", value)
+	}
+	return nil
+}
+
+func ValidateBool(value string) error {
+	if value != "true" && value != "false" {
+		return fmt.Errorf("expected true or false, got %s", value)
+	}
+	return nil
+}
+
+// iqnPattern matches iqns of RFC 3720, e.g. iqn.2005-10.org.freenas.ctl.
+var iqnPattern = regexp.MustCompile(`^iqn\.\d{4}-\d{2}\.[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*(:[a-z0-9.:-]+)?$`)
+
+func ValidateIQN(value string) error {
+	if !iqnPattern.MatchString(value) {
+		return fmt.Errorf("expected an iqn like iqn.2005-10.org.freenas.ctl, got %s", value)
+	}
+	return nil
+}
+
+// ValidateIP makes sure the value is an ip address, as the nodes find the
+// devices of volumes by the ip of the portal, see GenerateDeviceName.
+func ValidateIP(value string) error {
+	if net.ParseIP(value) == nil {
+		return fmt.Errorf("expected an ip address, got %s", value)
+	}
+	return nil
+}
+
+func ValidatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("expected a port between 1 and 65535, got %s", value)
+	}
+	return nil
+}
+
+// ValidateId makes sure the value is the id of a TrueNAS object.
+func ValidateId(value string) error {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 1 {
+		return fmt.Errorf("expected a positive number, got %s", value)
+	}
+	return nil
+}
+
+// ValidateSize makes sure the value is a size like 100Gi.
+func ValidateSize(value string) error {
+	if _, err := config.ParseSize(value); err != nil {
+		return err
+	}
+	return nil
+}
+
+var datasetComponentPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// ValidateDataset makes sure the value is a zfs dataset name like tank/k8s.
+// Template variables like ${pvc.namespace} are accepted, see ExpandTemplates.
+func ValidateDataset(value string) error {
+	name := templatePattern.ReplaceAllString(value, "x")
+	for _, component := range strings.Split(name, "/") {
+		if !datasetComponentPattern.MatchString(component) {
+			return fmt.Errorf("expected a dataset like tank/k8s, got %s", value)
+		}
+	}
+	return nil
+}
+
+// templateVariables maps the variables that can be used in secret and parameter
+// values to the parameters the external-provisioner passes with
+// --extra-create-metadata.
+var templateVariables = map[string]string{
+	"namespace":     "csi.storage.k8s.io/pvc/namespace",
+	"pvc.namespace": "csi.storage.k8s.io/pvc/namespace",
+	"pvc.name":      "csi.storage.k8s.io/pvc/name",
+	"pv.name":       "csi.storage.k8s.io/pv/name",
+}
+
+// templatePattern matches the variables of pvs and pvcs, other values like
+// passwords with a literal ${...} are left alone.
+var templatePattern = regexp.MustCompile(`\$\{(namespace|pvc?\.[^}]*)\}`)
+
+// ExpandTemplates replaces variables like ${pvc.namespace} in the secret or
+// parameter values with the metadata of the volume to create, e.g. to give every
+// namespace its own parent dataset.
+func ExpandTemplates(kind string, values map[string]string, parameters map[string]string) (map[string]string, error) {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := map[string]string{}
+	problems := []string{}
+	for _, key := range keys {
+		result[key] = templatePattern.ReplaceAllStringFunc(values[key], func(match string) string {
+			variable := templatePattern.FindStringSubmatch(match)[1]
+			parameter, ok := templateVariables[variable]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s %s uses unknown variable %s, expected ${pvc.namespace}, ${pvc.name} or ${pv.name}", kind, key, match))
+				return match
+			}
+			if parameters[parameter] == "" {
+				problems = append(problems, fmt.Sprintf("%s %s uses %s, which requires the csi-provisioner to run with --extra-create-metadata", kind, key, match))
+				return match
+			}
+			return parameters[parameter]
+		})
+	}
+	if len(problems) > 0 {
+		return nil, &SchemaError{Problems: problems}
+	}
+	return result, nil
+}
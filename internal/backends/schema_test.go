@@ -0,0 +1,79 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Schema_Load(t *testing.T) {
+	schema := Schema{Kind: "secret", Fields: []Field{
+		{Key: "url", Required: true, Validate: ValidateURL},
+		{Key: "dataset", Required: true, Validate: ValidateDataset},
+		{Key: "port", Default: "3260", Validate: ValidatePort},
+		{Key: "optional"},
+	}}
+
+	values, err := schema.Load(map[string]string{"url": "https://nas", "dataset": "tank/k8s", "other": "ignored"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"url": "https://nas", "dataset": "tank/k8s", "port": "3260"}, values)
+
+	_, err = schema.Load(map[string]string{"url": "nas", "port": "0"})
+	assert.EqualError(t, err, "malformed secret url: expected an http or https url like https://nas.local, got nas, "+
+		"missing secret dataset, malformed secret port: expected a port between 1 and 65535, got 0")
+}
+
+func Test_LoadISCSISecrets(t *testing.T) {
+	iscsi, err := LoadISCSISecrets(map[string]string{
+		"iscsi-base-iqn":     "iqn.2005-10.org.freenas.ctl",
+		"iscsi-portal-ip":    "10.0.0.1",
+		"iscsi-portal-id":    "1",
+		"iscsi-initiator-id": "2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ISCSISecrets{BaseIQN: "iqn.2005-10.org.freenas.ctl", PortalIP: "10.0.0.1", PortalPort: 3260, PortalId: 1, InitiatorId: 2}, *iscsi)
+
+	_, err = LoadISCSISecrets(map[string]string{"iscsi-base-iqn": "iqn.2005-10.org.freenas.ctl:", "iscsi-portal-ip": "nas.local", "iscsi-portal-id": "x"})
+	assert.EqualError(t, err, "malformed secret iscsi-base-iqn: expected an iqn like iqn.2005-10.org.freenas.ctl, got iqn.2005-10.org.freenas.ctl:, "+
+		"malformed secret iscsi-portal-ip: expected an ip address, got nas.local, "+
+		"malformed secret iscsi-portal-id: expected a positive number, got x, "+
+		"missing secret iscsi-initiator-id")
+}
+
+func Test_Validators(t *testing.T) {
+	for _, value := range []string{"iqn.2005-10.org.freenas.ctl", "iqn.2000-01.com.example:storage", "iqn.1993-08.org.debian:01:abc"} {
+		assert.NoError(t, ValidateIQN(value), value)
+	}
+	for _, value := range []string{"", "iqn.2005-10", "eui.02004567A425678D", "iqn.2005-10.org.FreeNAS.ctl", "iqn.2005-10.org.freenas.ctl:"} {
+		assert.Error(t, ValidateIQN(value), value)
+	}
+	for _, value := range []string{"tank", "tank/k8s", "tank/k8s/${pvc.namespace}", "tank/k8s_1.2:a-b"} {
+		assert.NoError(t, ValidateDataset(value), value)
+	}
+	for _, value := range []string{"/tank", "tank/", "tank//k8s", "tank/k8s@snap", "tank/${foo}"} {
+		assert.Error(t, ValidateDataset(value), value)
+	}
+	assert.NoError(t, ValidateURL("http://10.0.0.1:8080"))
+	assert.Error(t, ValidateURL("ftp://nas"))
+	assert.NoError(t, ValidateIP("fd00::1"))
+}
+
+func Test_ExpandTemplates(t *testing.T) {
+	secrets := map[string]string{
+		"truenas-parent-dataset": "tank/${pvc.namespace}",
+		"cifs-password":          "pa${ss}word",
+	}
+	parameters := map[string]string{"csi.storage.k8s.io/pvc/namespace": "team-a"}
+
+	expanded, err := ExpandTemplates("secret", secrets, parameters)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"truenas-parent-dataset": "tank/team-a", "cifs-password": "pa${ss}word"}, expanded)
+
+	_, err = ExpandTemplates("secret", secrets, nil)
+	assert.EqualError(t, err, "secret truenas-parent-dataset uses ${pvc.namespace}, which requires the csi-provisioner to run with --extra-create-metadata")
+	_, err = ExpandTemplates("secret", map[string]string{"truenas-parent-dataset": "tank/${pvc.namesapce}"}, parameters)
+	assert.ErrorContains(t, err, "unknown variable ${pvc.namesapce}")
+	expanded, err = ExpandTemplates("parameter", map[string]string{"parent-dataset": "tank/${namespace}"}, parameters)
+	assert.NoError(t, err)
+	assert.Equal(t, "tank/team-a", expanded["parent-dataset"])
+}
@@ -3,61 +3,220 @@ package truenas
 import (
 	"context"
 	"fmt"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 )
 
 var _ backends.Backend = (*TruenasBackend)(nil)
 
 type TruenasBackend struct {
-	secrets    *TruenasSecrets
-	httpClient *TruenasHttpClient
+	driverName string
+	// poolReservePercent is the share of every pool that is kept free
+	poolReservePercent int
+	parameters         TruenasParameters
+	secrets            *TruenasSecrets
+	httpClient         *TruenasHttpClient
 }
 
-func NewTruenasBackend() TruenasBackend {
-	return TruenasBackend{}
+func NewTruenasBackend(driverName string, poolReservePercent int) TruenasBackend {
+	return TruenasBackend{
+		driverName:         driverName,
+		poolReservePercent: poolReservePercent,
+	}
+}
+
+// volumeUserPropertySuffix is appended to the driver name to form the zfs user
+// property that marks a zvol as owned by a driver instance.
+const volumeUserPropertySuffix = ":volume"
+
+func (b *TruenasBackend) volumeUserProperty() string {
+	return b.driverName + volumeUserPropertySuffix
+}
+
+// checkOwnership makes sure that the dataset has not been created by another
+// driver instance. Datasets without any owner are accepted, as volumes created by
+// older versions have not been marked.
+func (b *TruenasBackend) checkOwnership(dataset *PoolDataset) error {
+	if _, ok := dataset.UserProperties[b.volumeUserProperty()]; ok {
+		return nil
+	}
+	for key := range dataset.UserProperties {
+		if strings.HasSuffix(key, volumeUserPropertySuffix) {
+			return fmt.Errorf("dataset %s is owned by driver %s", dataset.Id, strings.TrimSuffix(key, volumeUserPropertySuffix))
+		}
+	}
+	return nil
 }
 
 type TruenasSecrets struct {
 	Url           string
 	ApiKey        string
-	TLSSkipVerify bool
+	TLS           utils.TLSOptions
 	ParentDataset string
 	ISCSI         backends.ISCSISecrets
 }
 
+type TruenasParameters struct {
+	// ParentDataset overrides the secret truenas-parent-dataset and is created
+	// on demand, e.g. tank/k8s/${namespace} for a dataset per namespace
+	ParentDataset string
+	// ParentDatasetQuota limits the space of all volumes within ParentDataset,
+	// 0 means no quota
+	ParentDatasetQuota int64
+	// Volblocksize is the block size of new zvols like 16K, their sizes are
+	// rounded up to a multiple of it. Empty leaves it to TrueNAS.
+	Volblocksize string
+}
+
+// maxVolblocksize is the largest block size of zvols. Sizes that are a multiple
+// of it fit whatever block size TrueNAS picks for a new zvol by default.
+const maxVolblocksize = "128K"
+
+// volblocksizes are the block sizes TrueNAS accepts for zvols.
+var volblocksizes = map[string]int64{
+	"512": 512, "1K": 1 << 10, "2K": 2 << 10, "4K": 4 << 10, "8K": 8 << 10,
+	"16K": 16 << 10, "32K": 32 << 10, "64K": 64 << 10, "128K": 128 << 10,
+}
+
+func validateVolblocksize(value string) error {
+	if _, ok := volblocksizes[value]; !ok {
+		return fmt.Errorf("expected a power of two between 512 and 128K like 16K, got %s", value)
+	}
+	return nil
+}
+
+// roundUp rounds the size up to a multiple of the block size.
+func roundUp(size int64, blockSize int64) int64 {
+	if blockSize <= 0 {
+		return size
+	}
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// parametersSchema describes the storage class parameters of a TrueNAS system.
+var parametersSchema = backends.Schema{
+	Kind: "parameter",
+	Fields: []backends.Field{
+		{Key: "truenas-parent-dataset", Validate: backends.ValidateDataset},
+		{Key: "truenas-parent-dataset-quota", Validate: backends.ValidateSize},
+		{Key: "truenas-volblocksize", Validate: validateVolblocksize},
+	},
+}
+
 func (b *TruenasBackend) LoadParameters(parameters map[string]string) error {
+	values, err := parametersSchema.Load(parameters)
+	if err != nil {
+		return err
+	}
+	result := TruenasParameters{
+		ParentDataset: values["truenas-parent-dataset"],
+		Volblocksize:  values["truenas-volblocksize"],
+	}
+	if quota, ok := values["truenas-parent-dataset-quota"]; ok {
+		if result.ParentDataset == "" {
+			return fmt.Errorf("parameter truenas-parent-dataset-quota requires the parameter truenas-parent-dataset")
+		}
+		size, err := config.ParseSize(quota)
+		if err != nil {
+			return err
+		}
+		result.ParentDatasetQuota = int64(size)
+	}
+	b.parameters = result
 	return nil
 }
 
-func (b *TruenasBackend) LoadSecrets(secrets map[string]string) error {
-	url := secrets["truenas-url"]
-	if url == "" {
-		return fmt.Errorf("missing secret truenas-url")
+// parentDataset returns the dataset that holds the zvols, the storage class
+// parameter takes precedence over the secret.
+func (b *TruenasBackend) parentDataset() string {
+	if b.parameters.ParentDataset != "" {
+		return b.parameters.ParentDataset
 	}
-	apiKey := secrets["truenas-api-key"]
-	if apiKey == "" {
-		return fmt.Errorf("missing secret truenas-api-key")
+	return b.secrets.ParentDataset
+}
+
+func (b *TruenasBackend) VolumeDataset(name string) string {
+	return fmt.Sprintf("%s/%s", b.parentDataset(), name)
+}
+
+// ensureParentDataset creates the parent dataset if it is missing, e.g. the
+// first one of a namespace with truenas-parent-dataset set to
+// tank/k8s/${pvc.namespace}, and keeps the quota of the storage class parameter
+// up to date.
+func (b *TruenasBackend) ensureParentDataset(ctx context.Context) error {
+	name := b.parentDataset()
+	quota := b.parameters.ParentDatasetQuota
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, name)
+	if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || (err != nil && strings.Contains(err.Error(), "does not exist")) {
+		if _, err := b.httpClient.PoolDatasetPostFilesystem(ctx, name, quota); err != nil && !strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("unable to create parent dataset %s: %v", name, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to get parent dataset %s: %v", name, err)
+	}
+	if dataset.Type != "FILESYSTEM" {
+		return fmt.Errorf("parent dataset %s is a %s and cannot hold zvols", name, strings.ToLower(dataset.Type))
+	}
+	if quota == 0 {
+		return nil
+	}
+	if current, err := dataset.Quota.Int64(); err == nil && current == quota {
+		return nil
 	}
-	tlsSkipVerify := secrets["truenas-tls-skip-verify"] == "true"
-	parentDataset := secrets["truenas-parent-dataset"]
-	if apiKey == "" {
-		return fmt.Errorf("missing secret truenas-parent-dataset")
+	if _, err := b.httpClient.PoolDatasetPutQuota(ctx, name, quota); err != nil {
+		return fmt.Errorf("unable to set quota of parent dataset %s: %v", name, err)
 	}
-	iscsi, err := backends.LoadISCSISecrets(secrets)
+	return nil
+}
+
+// secretsSchema describes the secrets of a TrueNAS system, which are shared
+// with the iscsi portal.
+var secretsSchema = backends.Schema{
+	Kind: "secret",
+	Fields: append([]backends.Field{
+		{Key: "truenas-url", Required: true, Validate: backends.ValidateURL},
+		{Key: "truenas-api-key", Required: true},
+		{Key: "truenas-tls-skip-verify", Default: "false", Validate: backends.ValidateBool},
+		{Key: "truenas-tls-ca"},
+		{Key: "truenas-tls-fingerprint"},
+		{Key: "truenas-tls-client-cert"},
+		{Key: "truenas-tls-client-key"},
+		{Key: "truenas-parent-dataset", Required: true, Validate: backends.ValidateDataset},
+	}, backends.ISCSISecretFields...),
+}
+
+func (b *TruenasBackend) LoadSecrets(secrets map[string]string) error {
+	values, err := secretsSchema.Load(secrets)
+	if err != nil {
+		return err
+	}
+	tls := utils.TLSOptions{
+		SkipVerify:  values["truenas-tls-skip-verify"] == "true",
+		CA:          values["truenas-tls-ca"],
+		Fingerprint: values["truenas-tls-fingerprint"],
+		ClientCert:  values["truenas-tls-client-cert"],
+		ClientKey:   values["truenas-tls-client-key"],
+	}
+
+	httpClient, err := NewTruenasHttpClient(values["truenas-url"], values["truenas-api-key"], tls)
 	if err != nil {
 		return err
 	}
 
 	b.secrets = &TruenasSecrets{
-		Url:           url,
-		ApiKey:        apiKey,
-		TLSSkipVerify: tlsSkipVerify,
-		ParentDataset: parentDataset,
-		ISCSI:         *iscsi,
+		Url:           values["truenas-url"],
+		ApiKey:        values["truenas-api-key"],
+		TLS:           tls,
+		ParentDataset: values["truenas-parent-dataset"],
+		ISCSI:         *backends.NewISCSISecrets(values),
 	}
-	b.httpClient = NewTruenasHttpClient(url, apiKey, tlsSkipVerify)
+	b.httpClient = httpClient
 
 	return nil
 }
@@ -66,88 +225,242 @@ func (b *TruenasBackend) LoadPublishContext(context map[string]string) error {
 	return nil
 }
 
-func (b *TruenasBackend) CreateVolume(ctx context.Context, name string, size int64) (string, error) {
-	datasetName := fmt.Sprintf("%s/%s", b.secrets.ParentDataset, name)
-	if dataset, err := b.httpClient.PoolDatasetPost(ctx, datasetName, size); err != nil && !strings.Contains(err.Error(), "already exists") {
-		return "", fmt.Errorf("unable to create dataset: %v", err)
-	} else if err == nil && dataset.Id != datasetName {
-		return "", fmt.Errorf("expected dataset id to equal name: got %s", dataset.Id)
+func (b *TruenasBackend) CreateVolume(ctx context.Context, name string, size int64, limit int64) (string, int64, error) {
+	// the default block size of TrueNAS is only known once the zvol exists
+	volblocksize := b.parameters.Volblocksize
+	rounding := volblocksize
+	if rounding == "" {
+		rounding = maxVolblocksize
 	}
-
-	targetId := 0
-	existingTargets, err := b.httpClient.ISCSITargetGet(ctx, 1000)
+	size = roundUp(size, volblocksizes[rounding])
+	if limit > 0 && size > limit {
+		return "", 0, fmt.Errorf("size %d rounded up to the volblocksize %s exceeds the limit %d: %w", size, rounding, limit, backends.ErrVolumeSizeOutOfRange)
+	}
+	if err := b.ensureParentDataset(ctx); err != nil {
+		return "", 0, err
+	}
+	datasetName := b.VolumeDataset(name)
+	parent, err := b.httpClient.PoolDatasetIdIdGet(ctx, b.parentDataset())
 	if err != nil {
-		return "", fmt.Errorf("unable to list iscsi targets: %v", err)
+		return "", 0, fmt.Errorf("unable to get parent dataset: %v", err)
 	}
-	for _, existingTarget := range *existingTargets {
-		if existingTarget.Name == name {
-			targetId = existingTarget.Id
-			break
+	if err := b.checkCapacity(ctx, parent, size); err != nil {
+		// a retry of an earlier request needs no additional space
+		if _, getErr := b.httpClient.PoolDatasetIdIdGet(ctx, datasetName); getErr != nil {
+			return "", 0, err
 		}
 	}
-	if targetId == 0 {
-		target, err := b.httpClient.ISCSITargetPost(ctx, name, b.secrets.ISCSI.PortalId, b.secrets.ISCSI.InitiatorId)
+	userProperties := map[string]string{b.volumeUserProperty(): name}
+	if dataset, err := b.httpClient.PoolDatasetPost(ctx, datasetName, size, volblocksize, userProperties); err != nil && isOutOfSpace(err) {
+		return "", 0, fmt.Errorf("unable to create dataset: %v: %w", err, backends.ErrInsufficientCapacity)
+	} else if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return "", 0, fmt.Errorf("unable to create dataset: %v", err)
+	} else if err == nil && dataset.Id != datasetName {
+		return "", 0, fmt.Errorf("expected dataset id to equal name: got %s", dataset.Id)
+	} else if err != nil {
+		// a retry of an earlier request is fine, a request for another size is not
+		existing, err := b.httpClient.PoolDatasetIdIdGet(ctx, datasetName)
 		if err != nil {
-			return "", fmt.Errorf("unable to create iscsi target: %v", err)
+			return "", 0, fmt.Errorf("unable to get dataset: %v", err)
+		}
+		volsize, err := existing.Volsize.Int64()
+		if err != nil {
+			return "", 0, fmt.Errorf("unable to parse volume size: %v", err)
+		}
+		if volsize != size {
+			return "", 0, fmt.Errorf("dataset %s has size %d instead of %d: %w", datasetName, volsize, size, backends.ErrVolumeAlreadyExists)
 		}
-		targetId = target.Id
 	}
 
-	extentId := 0
-	existingExtents, err := b.httpClient.ISCSIExtentGet(ctx, 1000)
-	if err != nil {
-		return "", fmt.Errorf("unable to list iscsi extents: %v", err)
+	if _, err := b.ensureISCSIResources(ctx, name, datasetName); err != nil {
+		return "", 0, err
 	}
-	for _, existingExtent := range *existingExtents {
-		if existingExtent.Name == name {
-			extentId = existingExtent.Id
-			break
+
+	return datasetName, size, nil
+}
+
+// ImportVolume makes an existing zvol available via iscsi by creating the
+// missing target, extent and association. It returns the iqn of the target.
+func (b *TruenasBackend) ImportVolume(ctx context.Context, id string) (string, error) {
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, id)
+	if err != nil {
+		if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || strings.Contains(err.Error(), "does not exist") {
+			return "", fmt.Errorf("zvol %s is missing: %w", id, backends.ErrVolumeNotFound)
 		}
+		return "", fmt.Errorf("unable to get dataset: %v", err)
 	}
-	if extentId == 0 {
-		extent, err := b.httpClient.ISCSIExtentPost(ctx, name, "zvol/"+datasetName)
-		if err != nil {
-			return "", fmt.Errorf("unable to create iscsi extent: %v", err)
-		}
-		extentId = extent.Id
+	if dataset.Type != "VOLUME" {
+		return "", fmt.Errorf("dataset %s is not a zvol", id)
+	}
+	// volumes of other origins are not guaranteed to have a unique zvol name
+	name := backends.ImportedTargetName(id)
+	if _, ok := dataset.UserProperties[b.volumeUserProperty()]; ok {
+		name = path.Base(id)
 	}
+	name, err = b.ensureISCSIResources(ctx, name, id)
+	if err != nil {
+		return "", err
+	}
+	return b.secrets.ISCSI.TargetIQN(name), nil
+}
 
-	targetExtentId := 0
-	existingTargetExtents, err := b.httpClient.ISCSITargetExtendGet(ctx, 1000)
+// ensureISCSIResources creates the iscsi target, extent and their association
+// for the zvol, unless they exist already. It returns the name of the target,
+// which is the name of an existing extent of the zvol or else the given name.
+func (b *TruenasBackend) ensureISCSIResources(ctx context.Context, name string, datasetName string) (string, error) {
+	target, extent, targetExtent, err := b.findISCSIResources(ctx, name, datasetName)
 	if err != nil {
-		return "", fmt.Errorf("unable to list iscsi target extents: %v", err)
+		return "", err
 	}
-	for _, existingTargetExtent := range *existingTargetExtents {
-		if existingTargetExtent.Target == targetId && existingTargetExtent.Extent == extentId {
-			targetExtentId = existingTargetExtent.Id
-			break
+	if extent != nil {
+		name = extent.Name
+	}
+	if target == nil {
+		target, err = b.httpClient.ISCSITargetPost(ctx, name, b.secrets.ISCSI.PortalId, b.secrets.ISCSI.InitiatorId)
+		if err != nil {
+			return "", fmt.Errorf("unable to create iscsi target: %v", err)
 		}
 	}
-	if targetExtentId == 0 {
-		_, err := b.httpClient.ISCSITargetExtendPost(ctx, targetId, extentId)
+	if extent == nil {
+		extent, err = b.httpClient.ISCSIExtentPost(ctx, name, "zvol/"+datasetName)
 		if err != nil {
+			return "", fmt.Errorf("unable to create iscsi extent: %v", err)
+		}
+	}
+	if targetExtent == nil {
+		if _, err := b.httpClient.ISCSITargetExtendPost(ctx, target.Id, extent.Id); err != nil {
 			return "", fmt.Errorf("unable to create iscsi target extent: %v", err)
 		}
 	}
-
-	return datasetName, nil
+	return name, nil
 }
 
 func (b *TruenasBackend) DeleteVolume(ctx context.Context, id string) error {
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, id)
+	if err != nil {
+		if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || strings.Contains(err.Error(), "does not exist") {
+			return nil
+		}
+		return fmt.Errorf("unable to get dataset: %v", err)
+	}
+	if err := b.checkOwnership(dataset); err != nil {
+		return err
+	}
+	// the zvol is busy as long as an extent serves it
+	if err := b.deleteISCSIResources(ctx, path.Base(id), id); err != nil {
+		return err
+	}
 	if err := b.httpClient.PoolDatasetIdIdDelete(ctx, id, false, false); err != nil && !strings.Contains(err.Error(), "does not exist") {
 		return fmt.Errorf("unable to delete dataset: %v", err)
 	}
 	return nil
 }
 
-func (b *TruenasBackend) ExpandVolume(ctx context.Context, id string, size int64) error {
-	if _, err := b.httpClient.PoolDatasetPutVolsize(ctx, id, size); err != nil {
-		return fmt.Errorf("unable to resize dataset: %v", err)
+// deleteISCSIResources removes the association, target and extent of the zvol.
+// A target that serves further extents is kept, e.g. the one of an imported
+// zvol that has been set up by hand with several luns.
+func (b *TruenasBackend) deleteISCSIResources(ctx context.Context, name string, datasetName string) error {
+	targets, err := b.httpClient.ISCSITargetGet(ctx, 1000)
+	if err != nil {
+		return fmt.Errorf("unable to list iscsi targets: %v", err)
+	}
+	extents, err := b.httpClient.ISCSIExtentGet(ctx, 1000)
+	if err != nil {
+		return fmt.Errorf("unable to list iscsi extents: %v", err)
+	}
+	targetExtents, err := b.httpClient.ISCSITargetExtendGet(ctx, 1000)
+	if err != nil {
+		return fmt.Errorf("unable to list iscsi target extents: %v", err)
+	}
+	target, extent, targetExtent, err := matchISCSIResources(name, datasetName, *targets, *extents, *targetExtents)
+	if err != nil {
+		return err
+	}
+	if targetExtent != nil {
+		if err := b.httpClient.ISCSITargetExtendIdIdDelete(ctx, targetExtent.Id); err != nil && !isNotFound(err) {
+			return fmt.Errorf("unable to delete iscsi target extent: %v", err)
+		}
+	}
+	if target != nil {
+		shared := false
+		for _, other := range *targetExtents {
+			if other.Target == target.Id && (targetExtent == nil || other.Id != targetExtent.Id) {
+				shared = true
+			}
+		}
+		if !shared {
+			if err := b.httpClient.ISCSITargetIdIdDelete(ctx, target.Id); err != nil && !isNotFound(err) {
+				return fmt.Errorf("unable to delete iscsi target: %v", err)
+			}
+		}
+	}
+	if extent != nil {
+		if err := b.httpClient.ISCSIExtentIdIdDelete(ctx, extent.Id); err != nil && !isNotFound(err) {
+			return fmt.Errorf("unable to delete iscsi extent: %v", err)
+		}
 	}
-
 	return nil
 }
 
+// isNotFound detects the errors for resources that are gone already, e.g. as
+// another request deleted them in the meantime.
+func isNotFound(err error) bool {
+	return utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || strings.Contains(err.Error(), "does not exist")
+}
+
+func (b *TruenasBackend) ExpandVolume(ctx context.Context, id string, size int64, limit int64) (int64, error) {
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, id)
+	if err != nil {
+		if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || strings.Contains(err.Error(), "does not exist") {
+			return 0, fmt.Errorf("zvol %s is missing: %w", id, backends.ErrVolumeNotFound)
+		}
+		return 0, fmt.Errorf("unable to get dataset: %v", err)
+	}
+	if err := b.checkOwnership(dataset); err != nil {
+		return 0, err
+	}
+	volsize, err := dataset.Volsize.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse volume size: %v", err)
+	}
+	// shrinking a zvol would cut off the file system on it
+	if limit > 0 && volsize > limit {
+		return 0, fmt.Errorf("zvol %s has size %d, shrinking it to the limit %d is not supported: %w", id, volsize, limit, backends.ErrVolumeSizeOutOfRange)
+	}
+	if volblocksize, err := dataset.Volblocksize.Int64(); err == nil {
+		size = roundUp(size, volblocksize)
+	}
+	if size <= volsize {
+		// e.g. a retry of an earlier request
+		return volsize, nil
+	}
+	if limit > 0 && size > limit {
+		return 0, fmt.Errorf("size %d rounded up to the volblocksize %s exceeds the limit %d: %w", size, dataset.Volblocksize.Value, limit, backends.ErrVolumeSizeOutOfRange)
+	}
+	// the zvol needs the space beyond its reservation
+	// sparse zvols have the refreservation "none"
+	reserved, err := dataset.Refreservation.Int64()
+	if err != nil {
+		reserved = 0
+	}
+	if size > reserved {
+		parent, err := b.httpClient.PoolDatasetIdIdGet(ctx, path.Dir(id))
+		if err != nil {
+			return 0, fmt.Errorf("unable to get parent dataset: %v", err)
+		}
+		if err := b.checkCapacity(ctx, parent, size-reserved); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := b.httpClient.PoolDatasetPutVolsize(ctx, id, size); err != nil && isOutOfSpace(err) {
+		return 0, fmt.Errorf("unable to resize dataset: %v: %w", err, backends.ErrInsufficientCapacity)
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to resize dataset: %v", err)
+	}
+
+	return size, nil
+}
+
 func (b *TruenasBackend) CommentVolume(ctx context.Context, id string, comment string) error {
 	if _, err := b.httpClient.PoolDatasetPutComments(ctx, id, comment); err != nil {
 		return fmt.Errorf("unable to set dataset comment: %v", err)
@@ -156,6 +469,295 @@ func (b *TruenasBackend) CommentVolume(ctx context.Context, id string, comment s
 	return nil
 }
 
+// GetAvailableCapacity returns the space that is left in the parent dataset.
+// Parent datasets that are created on demand and do not exist yet get the space
+// of their own parent, limited by their quota.
+func (b *TruenasBackend) GetAvailableCapacity(ctx context.Context) (int64, error) {
+	name := b.parentDataset()
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, name)
+	onDemand := utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || (err != nil && strings.Contains(err.Error(), "does not exist"))
+	if onDemand {
+		dataset, err = b.httpClient.PoolDatasetIdIdGet(ctx, path.Dir(name))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to get parent dataset: %v", err)
+	}
+	available, err := b.usableSpace(ctx, dataset)
+	if err != nil {
+		return 0, err
+	}
+	if onDemand && b.parameters.ParentDatasetQuota > 0 && b.parameters.ParentDatasetQuota < available {
+		available = b.parameters.ParentDatasetQuota
+	}
+	return available, nil
+}
+
+// usableSpace returns the space that volumes can use within the dataset: its
+// available space, but at most the available space of its pool minus the
+// reserve. The pool is measured by its root dataset, as the size and free space
+// of the pool itself include the parity of a raidz.
+func (b *TruenasBackend) usableSpace(ctx context.Context, dataset *PoolDataset) (int64, error) {
+	available, err := dataset.Available.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("malformed available space of dataset %s: %v", dataset.Id, err)
+	}
+	if b.poolReservePercent > 0 {
+		root, err := b.httpClient.PoolDatasetIdIdGet(ctx, dataset.Pool)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get root dataset of pool %s: %v", dataset.Pool, err)
+		}
+		rootAvailable, err := root.Available.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("malformed available space of dataset %s: %v", root.Id, err)
+		}
+		rootUsed, err := root.Used.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("malformed used space of dataset %s: %v", root.Id, err)
+		}
+		if free := rootAvailable - (rootUsed+rootAvailable)*int64(b.poolReservePercent)/100; free < available {
+			available = free
+		}
+	}
+	if available < 0 {
+		return 0, nil
+	}
+	return available, nil
+}
+
+// checkCapacity makes sure that the dataset has room for the required space, so
+// that a full pool is reported with the numbers instead of a zfs error.
+func (b *TruenasBackend) checkCapacity(ctx context.Context, dataset *PoolDataset, required int64) error {
+	usable, err := b.usableSpace(ctx, dataset)
+	if err != nil {
+		return err
+	}
+	if required <= usable {
+		return nil
+	}
+	reserve := ""
+	if b.poolReservePercent > 0 {
+		reserve = fmt.Sprintf(" while keeping %d%% of pool %s free", b.poolReservePercent, dataset.Pool)
+	}
+	return fmt.Errorf("%d bytes are required, but only %d bytes are available in dataset %s%s: %w", required, usable, dataset.Id, reserve, backends.ErrInsufficientCapacity)
+}
+
+// isOutOfSpace detects the errors of zfs for a full pool or dataset, e.g. if
+// another volume took the space after checkCapacity.
+func isOutOfSpace(err error) bool {
+	return strings.Contains(err.Error(), "out of space") || strings.Contains(err.Error(), "greater than available space")
+}
+
+func (b *TruenasBackend) GetVolume(ctx context.Context, id string) (*backends.Volume, error) {
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, id)
+	if err != nil {
+		if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || strings.Contains(err.Error(), "does not exist") {
+			return nil, fmt.Errorf("zvol %s is missing: %w", id, backends.ErrVolumeNotFound)
+		}
+		return nil, fmt.Errorf("unable to get dataset: %v", err)
+	}
+	volume := &backends.Volume{Id: id}
+	if size, err := dataset.Volsize.Int64(); err == nil {
+		volume.CapacityBytes = size
+	}
+
+	problems := []string{}
+	pool, err := b.httpClient.PoolGetByName(ctx, dataset.Pool)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pool: %v", err)
+	}
+	if !pool.Healthy {
+		problems = append(problems, fmt.Sprintf("pool %s is %s", pool.Name, strings.ToLower(pool.Status)))
+	}
+
+	target, extent, targetExtent, err := b.findISCSIResources(ctx, path.Base(id), id)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, iscsiProblems(target, extent, targetExtent)...)
+
+	if len(problems) > 0 {
+		volume.Condition = backends.VolumeCondition{Abnormal: true, Message: strings.Join(problems, ", ")}
+	} else {
+		volume.Condition = backends.VolumeCondition{Message: "volume is healthy"}
+	}
+	return volume, nil
+}
+
+func iscsiProblems(target *ISCSITarget, extent *ISCSIExtent, targetExtent *ISCSITargetExtend) []string {
+	problems := []string{}
+	if target == nil {
+		problems = append(problems, "iscsi target is missing")
+	}
+	if extent == nil {
+		problems = append(problems, "iscsi extent is missing")
+	} else if !extent.Enabled {
+		problems = append(problems, "iscsi extent is disabled")
+	}
+	if target != nil && extent != nil && targetExtent == nil {
+		problems = append(problems, "iscsi target is not associated with the extent")
+	}
+	return problems
+}
+
+// VolumeDetails describes a volume together with its iscsi resources for
+// operators.
+type VolumeDetails struct {
+	Dataset       string `json:"dataset"`
+	Name          string `json:"name"`
+	CapacityBytes int64  `json:"capacityBytes"`
+	UsedBytes     int64  `json:"usedBytes"`
+	Comment       string `json:"comment"`
+	// iqn of the iscsi target, empty if the target is missing
+	Target string `json:"target"`
+	// name of the iscsi extent, empty if the extent is missing
+	Extent string `json:"extent"`
+	// problems of the iscsi resources, empty if the volume is healthy
+	Problems []string `json:"problems"`
+}
+
+func (b *TruenasBackend) volumeDetails(dataset *PoolDataset, target *ISCSITarget, extent *ISCSIExtent, targetExtent *ISCSITargetExtend) VolumeDetails {
+	details := VolumeDetails{
+		Dataset:  dataset.Id,
+		Name:     path.Base(dataset.Id),
+		Comment:  dataset.Comments.Value,
+		Problems: iscsiProblems(target, extent, targetExtent),
+	}
+	if size, err := dataset.Volsize.Int64(); err == nil {
+		details.CapacityBytes = size
+	}
+	if used, err := dataset.Used.Int64(); err == nil {
+		details.UsedBytes = used
+	}
+	if target != nil {
+		details.Target = b.secrets.ISCSI.TargetIQN(target.Name)
+	}
+	if extent != nil {
+		details.Extent = extent.Name
+	}
+	return details
+}
+
+// ListVolumes returns the zvols that have been created by this driver, wherever
+// they are. Besides the parent dataset of the secrets, the storage classes may
+// each point to their own one, which are not known here.
+func (b *TruenasBackend) ListVolumes(ctx context.Context) ([]VolumeDetails, error) {
+	datasets, err := b.httpClient.PoolDatasetGet(ctx, 10000, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list datasets: %v", err)
+	}
+	targets, err := b.httpClient.ISCSITargetGet(ctx, 1000)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list iscsi targets: %v", err)
+	}
+	extents, err := b.httpClient.ISCSIExtentGet(ctx, 1000)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list iscsi extents: %v", err)
+	}
+	targetExtents, err := b.httpClient.ISCSITargetExtendGet(ctx, 1000)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list iscsi target extents: %v", err)
+	}
+
+	result := []VolumeDetails{}
+	for i := range *datasets {
+		dataset := &(*datasets)[i]
+		if dataset.Type != "VOLUME" {
+			continue
+		}
+		if _, ok := dataset.UserProperties[b.volumeUserProperty()]; !ok {
+			continue
+		}
+		// an extent of another zvol with the same name is reported as missing
+		target, extent, targetExtent, _ := matchISCSIResources(path.Base(dataset.Id), dataset.Id, *targets, *extents, *targetExtents)
+		result = append(result, b.volumeDetails(dataset, target, extent, targetExtent))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Dataset < result[j].Dataset })
+	return result, nil
+}
+
+// InspectVolume returns the details of the given zvol, which does not need to
+// have been created by this driver.
+func (b *TruenasBackend) InspectVolume(ctx context.Context, id string) (*VolumeDetails, error) {
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, id)
+	if err != nil {
+		if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || strings.Contains(err.Error(), "does not exist") {
+			return nil, fmt.Errorf("zvol %s is missing: %w", id, backends.ErrVolumeNotFound)
+		}
+		return nil, fmt.Errorf("unable to get dataset: %v", err)
+	}
+	target, extent, targetExtent, err := b.findISCSIResources(ctx, path.Base(id), id)
+	if err != nil {
+		return nil, err
+	}
+	details := b.volumeDetails(dataset, target, extent, targetExtent)
+	return &details, nil
+}
+
+// findISCSIResources looks up the iscsi target, extent and their association
+// that belong to the given zvol. Missing resources are nil.
+func (b *TruenasBackend) findISCSIResources(ctx context.Context, name string, datasetName string) (*ISCSITarget, *ISCSIExtent, *ISCSITargetExtend, error) {
+	targets, err := b.httpClient.ISCSITargetGet(ctx, 1000)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to list iscsi targets: %v", err)
+	}
+	extents, err := b.httpClient.ISCSIExtentGet(ctx, 1000)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to list iscsi extents: %v", err)
+	}
+	targetExtents, err := b.httpClient.ISCSITargetExtendGet(ctx, 1000)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to list iscsi target extents: %v", err)
+	}
+	return matchISCSIResources(name, datasetName, *targets, *extents, *targetExtents)
+}
+
+// matchISCSIResources picks the extent of the zvol by its disk and the target
+// named like that extent. Without an extent the target of the given name is
+// used. An extent of that name which serves another disk is an error, as the
+// target would expose the wrong zvol.
+func matchISCSIResources(name string, datasetName string, targets []ISCSITarget, extents []ISCSIExtent, targetExtents []ISCSITargetExtend) (*ISCSITarget, *ISCSIExtent, *ISCSITargetExtend, error) {
+	disk := "zvol/" + datasetName
+	var extent *ISCSIExtent
+	for i := range extents {
+		if extents[i].Disk == disk {
+			extent = &extents[i]
+			name = extent.Name
+			break
+		}
+	}
+	if extent == nil {
+		for i := range extents {
+			if extents[i].Name == name {
+				return nil, nil, nil, fmt.Errorf("iscsi extent %s belongs to %s instead of %s", name, extents[i].Disk, disk)
+			}
+		}
+	}
+
+	var target *ISCSITarget
+	for i := range targets {
+		if targets[i].Name == name {
+			target = &targets[i]
+			break
+		}
+	}
+
+	var targetExtent *ISCSITargetExtend
+	if target != nil && extent != nil {
+		for i := range targetExtents {
+			if targetExtents[i].Target == target.Id && targetExtents[i].Extent == extent.Id {
+				targetExtent = &targetExtents[i]
+				break
+			}
+		}
+	}
+
+	return target, extent, targetExtent, nil
+}
+
+func (b *TruenasBackend) Identity() string {
+	return backends.BackendIdentity(b.secrets.Url)
+}
+
 func (b *TruenasBackend) GetISCSISecrets() *backends.ISCSISecrets {
 	return &b.secrets.ISCSI
 }
@@ -2,85 +2,434 @@ package truenas
 
 import (
 	"context"
+	"errors"
 	"testing"
 
-	"github.com/choffmeister/csi-driver-truenas/internal/utils"
-	"github.com/choffmeister/csi-driver-truenas/test"
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/backends/truenas/fake"
 	"github.com/stretchr/testify/assert"
 )
 
+const testDriverName = "truenas.csi.choffmeister.de"
+
+func newTestBackend(t *testing.T) (*fake.Server, *TruenasBackend) {
+	server := fake.NewServer("1-api-key")
+	t.Cleanup(server.Close)
+	server.AddPool("tank", 10*1024*1024*1024)
+	server.AddDataset("tank/k8s", 0)
+
+	backend := NewTruenasBackend(testDriverName, 0)
+	assert.NoError(t, backend.LoadParameters(map[string]string{}))
+	assert.NoError(t, backend.LoadSecrets(map[string]string{
+		"truenas-url":            server.URL,
+		"truenas-api-key":        "1-api-key",
+		"truenas-parent-dataset": "tank/k8s",
+		"iscsi-base-iqn":         "iqn.2005-10.org.freenas.ctl",
+		"iscsi-portal-ip":        "127.0.0.1",
+		"iscsi-portal-id":        "1",
+		"iscsi-initiator-id":     "1",
+	}))
+	return server, &backend
+}
+
 func Test_TruenasBackend(t *testing.T) {
-	var err error
 	ctx := context.Background()
+	server, backend := newTestBackend(t)
 
-	backend := NewTruenasBackend()
-	err = backend.LoadParameters(map[string]string{})
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
 	assert.NoError(t, err)
-	err = backend.LoadSecrets(storageClassSecretsFromEnv(test.LoadTestEnv()))
+	assert.Equal(t, "tank/k8s/pvc-1", id)
+	dataset := server.Dataset(id)
+	assert.Equal(t, int64(128*1024*1024), dataset.Volsize)
+	assert.Equal(t, map[string]string{testDriverName + ":volume": "pvc-1"}, dataset.UserProperties)
+	assert.Len(t, server.Targets(), 1)
+	assert.Len(t, server.Extents(), 1)
+	assert.Len(t, server.TargetExtents(), 1)
+	assert.Equal(t, "zvol/tank/k8s/pvc-1", server.Extents()[0].Disk)
+
+	volume, err := backend.GetVolume(ctx, id)
 	assert.NoError(t, err)
+	assert.Equal(t, int64(128*1024*1024), volume.CapacityBytes)
+	assert.False(t, volume.Condition.Abnormal)
 
-	name := "csi-driver-truenas-test-" + utils.RandomString(8)
-	id := ""
-	t.Run("create volume", func(t *testing.T) {
-		id, err = backend.CreateVolume(ctx, name, 128*1024*1024)
-		assert.NoError(t, err)
-	})
+	available, err := backend.GetAvailableCapacity(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10*1024*1024*1024-128*1024*1024), available)
 
-	t.Run("expand volume", func(t *testing.T) {
-		err = backend.ExpandVolume(ctx, id, 2*128*1024*1024)
-		assert.NoError(t, err)
-	})
+	_, err = backend.ExpandVolume(ctx, id, 2*128*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*128*1024*1024), server.Dataset(id).Volsize)
 
-	t.Run("delete volume", func(t *testing.T) {
-		err = backend.DeleteVolume(ctx, id)
-		assert.NoError(t, err)
-	})
+	assert.NoError(t, backend.CommentVolume(ctx, id, "default/pod-1"))
+	assert.Equal(t, "default/pod-1", server.Dataset(id).Comments)
+
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+	assert.Nil(t, server.Dataset(id))
+	_, err = backend.GetVolume(ctx, id)
+	assert.True(t, errors.Is(err, backends.ErrVolumeNotFound))
 }
 
 func Test_TruenasBackend_Idempotency(t *testing.T) {
-	var err error
 	ctx := context.Background()
+	server, backend := newTestBackend(t)
 
-	backend := NewTruenasBackend()
-	err = backend.LoadParameters(map[string]string{})
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
 	assert.NoError(t, err)
-	err = backend.LoadSecrets(storageClassSecretsFromEnv(test.LoadTestEnv()))
+	id, _, err = backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
 	assert.NoError(t, err)
+	assert.Len(t, server.Targets(), 1)
+	assert.Len(t, server.Extents(), 1)
+	assert.Len(t, server.TargetExtents(), 1)
+	_, _, err = backend.CreateVolume(ctx, "pvc-1", 2*128*1024*1024, 0)
+	assert.True(t, errors.Is(err, backends.ErrVolumeAlreadyExists))
 
-	name := "csi-driver-truenas-test-" + utils.RandomString(8)
-	id := ""
-	t.Run("create volume", func(t *testing.T) {
-		id, err = backend.CreateVolume(ctx, name, 128*1024*1024)
-		assert.NoError(t, err)
-		id, err = backend.CreateVolume(ctx, name, 128*1024*1024)
-		assert.NoError(t, err)
-	})
+	_, err = backend.ExpandVolume(ctx, id, 2*128*1024*1024, 0)
+	assert.NoError(t, err)
+	_, err = backend.ExpandVolume(ctx, id, 2*128*1024*1024, 0)
+	assert.NoError(t, err)
+	_, err = backend.ExpandVolume(ctx, "tank/k8s/pvc-missing", 128*1024*1024, 0)
+	assert.True(t, errors.Is(err, backends.ErrVolumeNotFound))
 
-	t.Run("expand volume", func(t *testing.T) {
-		err = backend.ExpandVolume(ctx, id, 2*128*1024*1024)
-		assert.NoError(t, err)
-		err = backend.ExpandVolume(ctx, id, 2*128*1024*1024)
-		assert.NoError(t, err)
-	})
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+}
+
+func Test_TruenasBackend_FaultInjection(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	// a failing step leaves a partially created volume, that a retry completes
+	server.InjectFault(fake.Fault{Method: "POST", Path: "/iscsi/extent", StatusCode: 500, Body: "Internal Server Error", Times: 1})
+	_, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.Error(t, err)
+	assert.NotNil(t, server.Dataset("tank/k8s/pvc-1"))
+	assert.Len(t, server.Extents(), 0)
+	_, _, err = backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.Len(t, server.Targets(), 1)
+	assert.Len(t, server.Extents(), 1)
+	assert.Len(t, server.TargetExtents(), 1)
+
+	server.InjectFault(fake.Fault{Path: "/pool/dataset", StatusCode: 502, Body: "Bad Gateway"})
+	assert.Error(t, backend.DeleteVolume(ctx, "tank/k8s/pvc-1"))
+	server.ClearFaults()
+	assert.NoError(t, backend.DeleteVolume(ctx, "tank/k8s/pvc-1"))
+
+	// space taken by others after the capacity check is reported the same way
+	server.InjectFault(fake.Fault{Method: "POST", Path: "/pool/dataset", StatusCode: 422, Body: "[EFAULT] Failed to create dataset: cannot create 'tank/k8s/pvc-2': out of space", Times: 1})
+	_, _, err = backend.CreateVolume(ctx, "pvc-2", 128*1024*1024, 0)
+	assert.True(t, errors.Is(err, backends.ErrInsufficientCapacity))
+	assert.ErrorContains(t, err, "out of space")
+}
+
+func Test_TruenasBackend_InsufficientCapacity(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	_, _, err := backend.CreateVolume(ctx, "pvc-1", 100*1024*1024*1024, 0)
+	assert.True(t, errors.Is(err, backends.ErrInsufficientCapacity))
+	assert.EqualError(t, err, "107374182400 bytes are required, but only 10737418240 bytes are available in dataset tank/k8s: insufficient capacity")
+	assert.Nil(t, server.Dataset("tank/k8s/pvc-1"))
+
+	// the reserve of the pool is kept free, measured without the parity of a raidz
+	server.SetPoolParity("tank", 5*1024*1024*1024)
+	backend.poolReservePercent = 10
+	available, err := backend.GetAvailableCapacity(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9*1024*1024*1024), available)
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 9*1024*1024*1024, 0)
+	assert.NoError(t, err)
+	_, _, err = backend.CreateVolume(ctx, "pvc-2", 1, 0)
+	assert.ErrorContains(t, err, "while keeping 10% of pool tank free")
+
+	// only the space beyond the reservation of the zvol is required
+	_, err = backend.ExpandVolume(ctx, id, 9*1024*1024*1024, 0)
+	assert.NoError(t, err)
+	_, err = backend.ExpandVolume(ctx, id, 10*1024*1024*1024, 0)
+	assert.True(t, errors.Is(err, backends.ErrInsufficientCapacity))
+	backend.poolReservePercent = 0
+	_, err = backend.ExpandVolume(ctx, id, 10*1024*1024*1024, 0)
+	assert.NoError(t, err)
+
+	// sparse zvols reserve nothing and need the whole size
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+	server.AddDataset("tank/k8s/pvc-sparse", 128*1024*1024).Sparse = true
+	_, err = backend.ExpandVolume(ctx, "tank/k8s/pvc-sparse", 256*1024*1024, 0)
+	assert.NoError(t, err)
+	_, err = backend.ExpandVolume(ctx, "tank/k8s/pvc-sparse", 11*1024*1024*1024, 0)
+	assert.EqualError(t, err, "11811160064 bytes are required, but only 10737418240 bytes are available in dataset tank/k8s: insufficient capacity")
+}
+
+func Test_TruenasBackend_Ownership(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	foreign := server.AddDataset("tank/k8s/pvc-foreign", 128*1024*1024)
+	foreign.UserProperties["other.csi.example.com:volume"] = "pvc-foreign"
+	assert.ErrorContains(t, backend.DeleteVolume(ctx, "tank/k8s/pvc-foreign"), "owned by driver other.csi.example.com")
+	_, err := backend.ExpandVolume(ctx, "tank/k8s/pvc-foreign", 2*128*1024*1024, 0)
+	assert.Error(t, err)
+	assert.NotNil(t, server.Dataset("tank/k8s/pvc-foreign"))
+
+	// volumes of older versions have not been marked
+	server.AddDataset("tank/k8s/pvc-legacy", 128*1024*1024)
+	assert.NoError(t, backend.DeleteVolume(ctx, "tank/k8s/pvc-legacy"))
+}
+
+func Test_TruenasBackend_DeleteVolume(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	// the target, extent and their association are removed with the zvol
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+	assert.Nil(t, server.Dataset(id))
+	assert.Empty(t, server.Targets())
+	assert.Empty(t, server.Extents())
+	assert.Empty(t, server.TargetExtents())
+
+	server.AddDataset("tank/legacy", 0)
+	server.AddDataset("tank/legacy/data", 128*1024*1024)
+	_, err = backend.ImportVolume(ctx, "tank/legacy/data")
+	assert.NoError(t, err)
+	assert.NoError(t, backend.DeleteVolume(ctx, "tank/legacy/data"))
+	assert.Empty(t, server.Targets())
+	assert.Empty(t, server.Extents())
+
+	// a target that serves further luns is kept
+	id, _, err = backend.CreateVolume(ctx, "pvc-2", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	_, _, err = backend.CreateVolume(ctx, "pvc-3", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	server.AddTargetExtent(server.Targets()[0].Id, server.Extents()[1].Id, 1)
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+	assert.Len(t, server.Targets(), 2)
+	assert.Len(t, server.Extents(), 1)
+	assert.Len(t, server.TargetExtents(), 2)
+
+	// deleting again is fine
+	assert.NoError(t, backend.DeleteVolume(ctx, id))
+}
+
+func Test_TruenasBackend_ImportVolume(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+	server.AddDataset("tank/legacy", 0)
+	server.AddDataset("tank/legacy/data", 128*1024*1024)
+
+	iqn, err := backend.ImportVolume(ctx, "tank/legacy/data")
+	assert.NoError(t, err)
+	assert.Equal(t, "iqn.2005-10.org.freenas.ctl:tank-legacy-data", iqn)
+	assert.Len(t, server.TargetExtents(), 1)
+	iqn, err = backend.ImportVolume(ctx, "tank/legacy/data")
+	assert.NoError(t, err)
+	assert.Equal(t, "iqn.2005-10.org.freenas.ctl:tank-legacy-data", iqn)
+	assert.Len(t, server.TargetExtents(), 1)
 
-	t.Run("delete volume", func(t *testing.T) {
-		err = backend.DeleteVolume(ctx, id)
-		assert.NoError(t, err)
-		err = backend.DeleteVolume(ctx, id)
-		assert.NoError(t, err)
+	// zvols of the same name in other datasets get their own target
+	server.AddDataset("tank/other", 0)
+	server.AddDataset("tank/other/data", 128*1024*1024)
+	iqn, err = backend.ImportVolume(ctx, "tank/other/data")
+	assert.NoError(t, err)
+	assert.Equal(t, "iqn.2005-10.org.freenas.ctl:tank-other-data", iqn)
+	assert.Len(t, server.TargetExtents(), 2)
+
+	// an extent of that name serving another zvol is not reused
+	_, _, err = backend.CreateVolume(ctx, "tank-clash-data", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	server.AddDataset("tank/clash", 0)
+	server.AddDataset("tank/clash/data", 128*1024*1024)
+	_, err = backend.ImportVolume(ctx, "tank/clash/data")
+	assert.ErrorContains(t, err, "iscsi extent tank-clash-data belongs to zvol/tank/k8s/tank-clash-data instead of zvol/tank/clash/data")
+	assert.Len(t, server.TargetExtents(), 3)
+
+	// volumes of the driver keep the name of the zvol
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	iqn, err = backend.ImportVolume(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "iqn.2005-10.org.freenas.ctl:pvc-1", iqn)
+	assert.Len(t, server.TargetExtents(), 4)
+
+	_, err = backend.ImportVolume(ctx, "tank/legacy/missing")
+	assert.True(t, errors.Is(err, backends.ErrVolumeNotFound))
+	_, err = backend.ImportVolume(ctx, "tank/legacy")
+	assert.ErrorContains(t, err, "not a zvol")
+}
+
+func Test_TruenasBackend_VolumeCondition(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.NoError(t, err)
+
+	server.SetPoolHealth("tank", false, "DEGRADED")
+	server.SetExtentEnabled("pvc-1", false)
+	volume, err := backend.GetVolume(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, volume.Condition.Abnormal)
+	assert.Contains(t, volume.Condition.Message, "pool tank is degraded")
+	assert.Contains(t, volume.Condition.Message, "disabled")
+}
+
+func Test_TruenasBackend_ListVolumes(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	_, _, err := backend.CreateVolume(ctx, "pvc-2", 256*1024*1024, 0)
+	assert.NoError(t, err)
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, backend.CommentVolume(ctx, id, "default/pod-1"))
+	server.SetExtentEnabled("pvc-1", false)
+	// neither foreign nor unmarked zvols are listed
+	foreign := server.AddDataset("tank/k8s/pvc-foreign", 128*1024*1024)
+	foreign.UserProperties["other.csi.example.com:volume"] = "pvc-foreign"
+	server.AddDataset("tank/k8s/manual", 128*1024*1024)
+
+	volumes, err := backend.ListVolumes(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, volumes, 2)
+	assert.Equal(t, VolumeDetails{
+		Dataset:       "tank/k8s/pvc-1",
+		Name:          "pvc-1",
+		CapacityBytes: 128 * 1024 * 1024,
+		Comment:       "default/pod-1",
+		Target:        "iqn.2005-10.org.freenas.ctl:pvc-1",
+		Extent:        "pvc-1",
+		Problems:      []string{"iscsi extent is disabled"},
+	}, volumes[0])
+	assert.Equal(t, "tank/k8s/pvc-2", volumes[1].Dataset)
+	assert.Empty(t, volumes[1].Problems)
+
+	details, err := backend.InspectVolume(ctx, "tank/k8s/manual")
+	assert.NoError(t, err)
+	assert.Equal(t, "", details.Target)
+	assert.Equal(t, []string{"iscsi target is missing", "iscsi extent is missing"}, details.Problems)
+	_, err = backend.InspectVolume(ctx, "tank/k8s/missing")
+	assert.True(t, errors.Is(err, backends.ErrVolumeNotFound))
+}
+
+func Test_TruenasBackend_LoadSecrets(t *testing.T) {
+	backend := NewTruenasBackend(testDriverName, 0)
+	err := backend.LoadSecrets(map[string]string{
+		"truenas-url":        "nas.local",
+		"truenas-api-key":    "1-api-key",
+		"iscsi-base-iqn":     "iqn.2005-10.org.freenas.ctl",
+		"iscsi-portal-ip":    "127.0.0.1",
+		"iscsi-portal-id":    "1",
+		"iscsi-initiator-id": "1",
 	})
+	assert.EqualError(t, err, "malformed secret truenas-url: expected an http or https url like https://nas.local, got nas.local, missing secret truenas-parent-dataset")
 }
 
-func storageClassSecretsFromEnv(env test.TestEnv) map[string]string {
-	return map[string]string{
-		"truenas-url":             env.TruenasUrl,
-		"truenas-api-key":         env.TruenasApiKey,
-		"truenas-parent-dataset":  env.TruenasParentDataset,
-		"truenas-tls-skip-verify": "true",
-		"iscsi-base-iqn":          env.ISCSIBaseIQN,
-		"iscsi-portal-ip":         env.ISCSIPortalIP,
-		"iscsi-portal-port":       env.ISCSIPortalPort,
-		"iscsi-portal-id":         env.ISCSIPortalID,
-		"iscsi-initiator-id":      env.ISCSIInitiatorID,
-	}
+func Test_TruenasBackend_ParentDatasetParameter(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+	assert.NoError(t, backend.LoadParameters(map[string]string{
+		"truenas-parent-dataset":       "tank/k8s/team-a",
+		"truenas-parent-dataset-quota": "256Mi",
+	}))
+
+	// the quota caps the space until the dataset has been created
+	available, err := backend.GetAvailableCapacity(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(256*1024*1024), available)
+
+	id, _, err := backend.CreateVolume(ctx, "pvc-1", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "tank/k8s/team-a/pvc-1", id)
+	assert.Equal(t, "FILESYSTEM", server.Dataset("tank/k8s/team-a").Type)
+	assert.Equal(t, int64(256*1024*1024), server.Dataset("tank/k8s/team-a").Quota)
+	available, err = backend.GetAvailableCapacity(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(128*1024*1024), available)
+
+	// one team cannot exhaust the space beyond its quota
+	_, _, err = backend.CreateVolume(ctx, "pvc-2", 256*1024*1024, 0)
+	assert.True(t, errors.Is(err, backends.ErrInsufficientCapacity))
+
+	// a changed quota is applied to the existing dataset
+	assert.NoError(t, backend.LoadParameters(map[string]string{
+		"truenas-parent-dataset":       "tank/k8s/team-a",
+		"truenas-parent-dataset-quota": "512Mi",
+	}))
+	_, _, err = backend.CreateVolume(ctx, "pvc-2", 256*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(512*1024*1024), server.Dataset("tank/k8s/team-a").Quota)
+
+	// the quota is applied to datasets that have been created by hand, too
+	server.AddDataset("tank/teams", 0)
+	server.AddDataset("tank/teams/team-b", 0)
+	assert.NoError(t, backend.LoadParameters(map[string]string{
+		"truenas-parent-dataset":       "tank/teams/team-b",
+		"truenas-parent-dataset-quota": "1Gi",
+	}))
+	_, _, err = backend.CreateVolume(ctx, "pvc-3", 128*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024*1024*1024), server.Dataset("tank/teams/team-b").Quota)
+
+	// volumes outside of the parent dataset of the secrets are listed as well
+	volumes, err := backend.ListVolumes(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, volumes, 3)
+	assert.Equal(t, "tank/teams/team-b/pvc-3", volumes[2].Dataset)
+}
+
+func Test_TruenasBackend_LoadParameters(t *testing.T) {
+	backend := NewTruenasBackend(testDriverName, 0)
+	assert.EqualError(t, backend.LoadParameters(map[string]string{"truenas-parent-dataset-quota": "lots"}),
+		"malformed parameter truenas-parent-dataset-quota: invalid size \"lots\"")
+	assert.EqualError(t, backend.LoadParameters(map[string]string{"truenas-parent-dataset-quota": "10Gi"}),
+		"parameter truenas-parent-dataset-quota requires the parameter truenas-parent-dataset")
+	assert.EqualError(t, backend.LoadParameters(map[string]string{"truenas-volblocksize": "16k"}),
+		"malformed parameter truenas-volblocksize: expected a power of two between 512 and 128K like 16K, got 16k")
+	assert.NoError(t, backend.LoadParameters(map[string]string{"truenas-parent-dataset": "tank/k8s/${namespace}"}))
+	assert.Equal(t, "", backend.parameters.Volblocksize)
+	assert.NoError(t, backend.LoadParameters(map[string]string{"truenas-volblocksize": "16K"}))
+	assert.Equal(t, "16K", backend.parameters.Volblocksize)
+}
+
+func Test_TruenasBackend_VolumeSize(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+
+	// without a volblocksize sizes are rounded up to fit any, but must not
+	// exceed the limit
+	_, _, err := backend.CreateVolume(ctx, "pvc-1", 100*1024*1024+1, 100*1024*1024+1)
+	assert.True(t, errors.Is(err, backends.ErrVolumeSizeOutOfRange))
+	id, size, err := backend.CreateVolume(ctx, "pvc-1", 100*1024*1024+1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100*1024*1024+128*1024), size)
+	assert.Equal(t, size, server.Dataset(id).Volsize)
+	assert.Equal(t, int64(16*1024), server.Dataset(id).Volblocksize)
+
+	// expanding is rounded to the volblocksize TrueNAS picked
+	size, err = backend.ExpandVolume(ctx, id, 100*1024*1024+128*1024+1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100*1024*1024+144*1024), size)
+
+	assert.NoError(t, backend.LoadParameters(map[string]string{"truenas-volblocksize": "64K"}))
+	id2, size, err := backend.CreateVolume(ctx, "pvc-2", 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(64*1024), size)
+	assert.Equal(t, int64(64*1024), server.Dataset(id2).Volblocksize)
+
+	// expanding is rounded to the volblocksize of the zvol
+	size, err = backend.ExpandVolume(ctx, id2, 100*1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(128*1024), size)
+
+	// a zvol that is large enough already is left as it is
+	size, err = backend.ExpandVolume(ctx, id, 64*1024*1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100*1024*1024+144*1024), size)
+	assert.Equal(t, size, server.Dataset(id).Volsize)
+
+	// a limit below the size would shrink the zvol
+	_, err = backend.ExpandVolume(ctx, id, 64*1024*1024, 64*1024*1024)
+	assert.True(t, errors.Is(err, backends.ErrVolumeSizeOutOfRange))
+	assert.ErrorContains(t, err, "shrinking")
 }
@@ -0,0 +1,173 @@
+package truenas
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
+)
+
+// Diagnose checks the secrets against the NAS, so that typos show up before
+// the first volume is provisioned. The parent datasets of the storage classes
+// are checked along with the one of the secrets. The remaining checks are
+// skipped if the api is not reachable.
+func (b *TruenasBackend) Diagnose(ctx context.Context, parentDatasets ...string) []doctor.Result {
+	result := b.diagnoseApi(ctx)
+	if !result.Passed {
+		return []doctor.Result{result}
+	}
+	results := []doctor.Result{result}
+	// templated parent datasets depend on the pvc, so check their static prefix
+	checked := map[string]bool{}
+	for _, parentDataset := range append([]string{b.secrets.ParentDataset}, parentDatasets...) {
+		name := staticDatasetPrefix(parentDataset)
+		if !checked[name] {
+			checked[name] = true
+			results = append(results, b.diagnoseParentDataset(ctx, name))
+		}
+	}
+	return append(results,
+		b.diagnosePortal(ctx),
+		b.diagnoseInitiatorGroup(ctx),
+		b.diagnoseService(ctx),
+		b.diagnoseBaseIQN(ctx),
+	)
+}
+
+func (b *TruenasBackend) diagnoseApi(ctx context.Context) doctor.Result {
+	const check = "truenas api"
+	info, err := b.httpClient.SystemInfoGet(ctx)
+	if utils.IsJsonHttpClientErrorWithStatusCode(err, 401) {
+		return doctor.Fail(check, fmt.Sprintf("%s rejected the api key", b.secrets.Url),
+			"create an api key in the TrueNAS UI and put it into truenas-api-key")
+	} else if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to reach %s: %v", b.secrets.Url, err),
+			"check truenas-url and the truenas-tls-* secrets, and that the NAS is reachable from here")
+	}
+	return doctor.Pass(check, fmt.Sprintf("%s runs %s", b.secrets.Url, info.Version))
+}
+
+func (b *TruenasBackend) diagnoseParentDataset(ctx context.Context, name string) doctor.Result {
+	const check = "parent dataset"
+	dataset, err := b.httpClient.PoolDatasetIdIdGet(ctx, name)
+	if utils.IsJsonHttpClientErrorWithStatusCode(err, 404) || (err != nil && strings.Contains(err.Error(), "does not exist")) {
+		return doctor.Fail(check, fmt.Sprintf("dataset %s does not exist", name),
+			"create the dataset on the NAS or fix truenas-parent-dataset")
+	} else if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to get dataset %s: %v", name, err), "")
+	}
+	if dataset.Type != "FILESYSTEM" {
+		return doctor.Fail(check, fmt.Sprintf("dataset %s is a %s and cannot hold zvols", name, strings.ToLower(dataset.Type)),
+			"point truenas-parent-dataset to a filesystem dataset")
+	}
+	if dataset.Readonly.Value == "ON" {
+		return doctor.Fail(check, fmt.Sprintf("dataset %s is read-only", name),
+			"turn off the read-only property of the dataset")
+	}
+	available, err := dataset.Available.Int64()
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to parse available space of dataset %s: %v", name, err), "")
+	}
+	if available <= 0 {
+		return doctor.Fail(check, fmt.Sprintf("dataset %s has no space left", name),
+			"free up space in the pool or move truenas-parent-dataset to another pool")
+	}
+	return doctor.Pass(check, fmt.Sprintf("dataset %s is writable with %d bytes available", name, available))
+}
+
+func (b *TruenasBackend) diagnosePortal(ctx context.Context) doctor.Result {
+	const check = "iscsi portal"
+	id := b.secrets.ISCSI.PortalId
+	portals, err := b.httpClient.ISCSIPortalGet(ctx, 1000)
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to list iscsi portals: %v", err), "")
+	}
+	ids := []string{}
+	for _, portal := range *portals {
+		ids = append(ids, strconv.Itoa(portal.Id))
+		if portal.Id != id {
+			continue
+		}
+		ips := []string{}
+		for _, listen := range portal.Listen {
+			if listen.IP == b.secrets.ISCSI.PortalIP || listen.IP == "0.0.0.0" || listen.IP == "::" {
+				return doctor.Pass(check, fmt.Sprintf("portal %d listens on %s", id, listen.IP))
+			}
+			ips = append(ips, listen.IP)
+		}
+		return doctor.Fail(check, fmt.Sprintf("portal %d listens on %s, but not on %s", id, strings.Join(ips, ", "), b.secrets.ISCSI.PortalIP),
+			"fix iscsi-portal-ip or add the ip to the portal")
+	}
+	return doctor.Fail(check, fmt.Sprintf("portal %d does not exist", id), idsHint("iscsi-portal-id", ids, "create a portal under Sharing > iSCSI > Portals"))
+}
+
+func (b *TruenasBackend) diagnoseInitiatorGroup(ctx context.Context) doctor.Result {
+	const check = "iscsi initiator group"
+	id := b.secrets.ISCSI.InitiatorId
+	initiators, err := b.httpClient.ISCSIInitiatorGet(ctx, 1000)
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to list iscsi initiator groups: %v", err), "")
+	}
+	ids := []string{}
+	for _, initiator := range *initiators {
+		ids = append(ids, strconv.Itoa(initiator.Id))
+		if initiator.Id != id {
+			continue
+		}
+		if len(initiator.Initiators) == 0 {
+			return doctor.Pass(check, fmt.Sprintf("initiator group %d allows all initiators", id))
+		}
+		return doctor.Pass(check, fmt.Sprintf("initiator group %d allows %s", id, strings.Join(initiator.Initiators, ", ")))
+	}
+	return doctor.Fail(check, fmt.Sprintf("initiator group %d does not exist", id), idsHint("iscsi-initiator-id", ids, "create an initiator group under Sharing > iSCSI > Initiators"))
+}
+
+func (b *TruenasBackend) diagnoseService(ctx context.Context) doctor.Result {
+	const check = "iscsi service"
+	service, err := b.httpClient.ServiceGetByName(ctx, "iscsitarget")
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to get iscsi service: %v", err), "")
+	}
+	if service.State != "RUNNING" {
+		return doctor.Fail(check, fmt.Sprintf("iscsi service is %s", strings.ToLower(service.State)),
+			"start the iSCSI service under System Settings > Services and let it start automatically")
+	}
+	if !service.Enable {
+		return doctor.Fail(check, "iscsi service is running, but does not start automatically",
+			"let the iSCSI service start automatically under System Settings > Services")
+	}
+	return doctor.Pass(check, "iscsi service is running")
+}
+
+func (b *TruenasBackend) diagnoseBaseIQN(ctx context.Context) doctor.Result {
+	const check = "iscsi base iqn"
+	global, err := b.httpClient.ISCSIGlobalGet(ctx)
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to get global iscsi config: %v", err), "")
+	}
+	if global.Basename != b.secrets.ISCSI.BaseIQN {
+		return doctor.Fail(check, fmt.Sprintf("iscsi-base-iqn is %s, but the NAS uses %s", b.secrets.ISCSI.BaseIQN, global.Basename),
+			fmt.Sprintf("set iscsi-base-iqn to %s", global.Basename))
+	}
+	return doctor.Pass(check, fmt.Sprintf("base iqn %s matches", global.Basename))
+}
+
+// staticDatasetPrefix strips the components with template variables from the
+// dataset, e.g. tank/k8s/${pvc.namespace} becomes tank/k8s.
+func staticDatasetPrefix(name string) string {
+	if i := strings.Index(name, "${"); i >= 0 {
+		return path.Dir(name[:i] + "x")
+	}
+	return name
+}
+
+func idsHint(secret string, ids []string, fallback string) string {
+	if len(ids) == 0 {
+		return fallback
+	}
+	return fmt.Sprintf("set %s to one of %s", secret, strings.Join(ids, ", "))
+}
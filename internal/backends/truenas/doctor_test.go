@@ -0,0 +1,65 @@
+package truenas
+
+import (
+	"context"
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TruenasBackend_Diagnose(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+	server.AddPortal("0.0.0.0")
+	server.AddInitiatorGroup()
+
+	results := backend.Diagnose(ctx)
+	assert.Len(t, results, 6)
+	assert.Equal(t, 0, doctor.Failed(results), results)
+
+	server.SetServiceState("iscsitarget", "STOPPED")
+	server.Basename = "iqn.2000-01.com.example"
+	results = backend.Diagnose(ctx)
+	assert.Equal(t, 2, doctor.Failed(results))
+	assert.Equal(t, "iscsi service is stopped", results[4].Message)
+	assert.Equal(t, "set iscsi-base-iqn to iqn.2000-01.com.example", results[5].Hint)
+}
+
+func Test_TruenasBackend_DiagnoseMisconfiguration(t *testing.T) {
+	ctx := context.Background()
+	server, backend := newTestBackend(t)
+	server.AddPortal("10.0.0.1")
+	server.AddPortal("10.0.0.2")
+
+	backend.secrets.ParentDataset = "tank/typo"
+	backend.secrets.ISCSI.PortalId = 1
+	backend.secrets.ISCSI.InitiatorId = 3
+	results := backend.Diagnose(ctx)
+	assert.Equal(t, doctor.Fail("parent dataset", "dataset tank/typo does not exist", "create the dataset on the NAS or fix truenas-parent-dataset"), results[1])
+	assert.Equal(t, "portal 1 listens on 10.0.0.1, but not on 127.0.0.1", results[2].Message)
+	assert.Equal(t, "create an initiator group under Sharing > iSCSI > Initiators", results[3].Hint)
+
+	backend.secrets.ISCSI.PortalId = 3
+	assert.Equal(t, "set iscsi-portal-id to one of 1, 2", backend.Diagnose(ctx)[2].Hint)
+
+	backend.secrets.ParentDataset = "tank/k8s/${pvc.namespace}"
+	assert.Contains(t, backend.Diagnose(ctx)[1].Message, "dataset tank/k8s is writable")
+
+	// the parent datasets of the storage classes are checked as well
+	results = backend.Diagnose(ctx, "tank/k8s/${namespace}", "tank/teams/${namespace}")
+	assert.Len(t, results, 7)
+	assert.Contains(t, results[1].Message, "dataset tank/k8s is writable")
+	assert.Equal(t, "dataset tank/teams does not exist", results[2].Message)
+
+	server.AddDataset("tank/zvol", 128*1024*1024)
+	backend.secrets.ParentDataset = "tank/zvol"
+	assert.Equal(t, "dataset tank/zvol is a volume and cannot hold zvols", backend.Diagnose(ctx)[1].Message)
+
+	// the remaining checks are skipped if the api key is rejected
+	server.ApiKey = "2-api-key"
+	results = backend.Diagnose(ctx)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "truenas api", results[0].Check)
+	assert.Contains(t, results[0].Message, "rejected the api key")
+}
@@ -0,0 +1,891 @@
+// Package fake provides an in-process TrueNAS REST API for hermetic tests. It
+// models pools, datasets, zvols, snapshots and iscsi targets, extents and their
+// associations closely enough for the backend, including the error bodies the
+// backend relies on, like "already exists" and "does not exist". Portals,
+// initiator groups, services and the global iscsi config are read-only.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const apiPrefix = "/api/v2.0"
+
+type Pool struct {
+	Id   int
+	Name string
+	Size int64
+	// Parity is the raw space taken by the parity of a raidz, which the size
+	// and free space of the pool include, but the datasets cannot use
+	Parity  int64
+	Healthy bool
+	Status  string
+}
+
+type Dataset struct {
+	Name    string
+	Type    string
+	Volsize int64
+	// Volblocksize is the block size of zvols, 16K unless given on creation
+	Volblocksize int64
+	// Sparse zvols reserve no space and have the refreservation "none"
+	Sparse   bool
+	Used     int64
+	Readonly bool
+	// Quota limits the space of the dataset and its children, 0 means none
+	Quota          int64
+	Comments       string
+	UserProperties map[string]string
+}
+
+type Snapshot struct {
+	Dataset string
+	Name    string
+}
+
+type Target struct {
+	Id     int                      `json:"id"`
+	Name   string                   `json:"name"`
+	Groups []map[string]interface{} `json:"groups"`
+}
+
+type Extent struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Disk        string `json:"disk"`
+	InsecureTPC bool   `json:"insecure_tpc"`
+	Enabled     bool   `json:"enabled"`
+}
+
+type Portal struct {
+	Id     int                      `json:"id"`
+	Listen []map[string]interface{} `json:"listen"`
+}
+
+type InitiatorGroup struct {
+	Id         int      `json:"id"`
+	Initiators []string `json:"initiators"`
+}
+
+type TargetExtent struct {
+	Id     int `json:"id"`
+	Target int `json:"target"`
+	Extent int `json:"extent"`
+	LUNId  int `json:"lunid"`
+}
+
+// Fault makes matching requests fail with the given status code and body.
+type Fault struct {
+	// Method to match, empty matches all methods
+	Method string
+	// Path prefix below /api/v2.0 to match, e.g. "/iscsi/target"
+	Path       string
+	StatusCode int
+	Body       string
+	// Times is the number of requests to fail, 0 fails all matching requests
+	Times int
+}
+
+type Server struct {
+	*httptest.Server
+	ApiKey string
+	// Version is reported by the system info
+	Version string
+	// Basename is the base iqn of the global iscsi config
+	Basename string
+
+	mutex         sync.Mutex
+	nextId        int
+	pools         map[string]*Pool
+	datasets      map[string]*Dataset
+	snapshots     map[string]*Snapshot
+	targets       map[int]*Target
+	extents       map[int]*Extent
+	targetExtents map[int]*TargetExtent
+	portals       []*Portal
+	initiators    []*InitiatorGroup
+	services      map[string]string
+	faults        []*Fault
+	requests      []string
+}
+
+// NewServer starts a fake TrueNAS that accepts the given api key.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		ApiKey:        apiKey,
+		Version:       "TrueNAS-13.0-U6.1",
+		Basename:      "iqn.2005-10.org.freenas.ctl",
+		nextId:        1,
+		pools:         map[string]*Pool{},
+		datasets:      map[string]*Dataset{},
+		snapshots:     map[string]*Snapshot{},
+		targets:       map[int]*Target{},
+		extents:       map[int]*Extent{},
+		targetExtents: map[int]*TargetExtent{},
+		portals:       []*Portal{},
+		initiators:    []*InitiatorGroup{},
+		services:      map[string]string{"iscsitarget": "RUNNING"},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// AddPool creates a healthy pool of the given size together with its root
+// dataset.
+func (s *Server) AddPool(name string, size int64) *Pool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pool := &Pool{Id: s.id(), Name: name, Size: size, Healthy: true, Status: "ONLINE"}
+	s.pools[name] = pool
+	s.datasets[name] = &Dataset{Name: name, Type: "FILESYSTEM", UserProperties: map[string]string{}}
+	return pool
+}
+
+// AddDataset creates a dataset, which can be a zvol if the size is given.
+func (s *Server) AddDataset(name string, volsize int64) *Dataset {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dataset := &Dataset{Name: name, Type: "FILESYSTEM", UserProperties: map[string]string{}}
+	if volsize > 0 {
+		dataset.Type = "VOLUME"
+		dataset.Volsize = volsize
+		dataset.Volblocksize = defaultVolblocksize
+	}
+	s.datasets[name] = dataset
+	return dataset
+}
+
+// AddPortal creates an iscsi portal listening on the given ips on port 3260.
+// Portals are numbered from 1 in the order they have been added.
+func (s *Server) AddPortal(ips ...string) *Portal {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	portal := &Portal{Id: len(s.portals) + 1, Listen: []map[string]interface{}{}}
+	for _, ip := range ips {
+		portal.Listen = append(portal.Listen, map[string]interface{}{"ip": ip, "port": 3260})
+	}
+	s.portals = append(s.portals, portal)
+	return portal
+}
+
+// AddInitiatorGroup creates an iscsi initiator group, which allows all
+// initiators if none are given. Groups are numbered from 1 in the order they
+// have been added.
+func (s *Server) AddInitiatorGroup(initiators ...string) *InitiatorGroup {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	group := &InitiatorGroup{Id: len(s.initiators) + 1, Initiators: append([]string{}, initiators...)}
+	s.initiators = append(s.initiators, group)
+	return group
+}
+
+// AddTargetExtent associates an extent with a target as the given lun, e.g.
+// to serve several zvols by one target like a hand-made setup.
+func (s *Server) AddTargetExtent(target int, extent int, lunId int) *TargetExtent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	targetExtent := &TargetExtent{Id: s.id(), Target: target, Extent: extent, LUNId: lunId}
+	s.targetExtents[targetExtent.Id] = targetExtent
+	return targetExtent
+}
+
+// SetServiceState changes the state of a service, e.g. "iscsitarget" to
+// "STOPPED".
+func (s *Server) SetServiceState(name string, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.services[name] = state
+}
+
+// SetPoolHealth changes the health of a pool, e.g. to "DEGRADED".
+func (s *Server) SetPoolHealth(name string, healthy bool, status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pools[name].Healthy = healthy
+	s.pools[name].Status = status
+}
+
+// SetPoolParity adds the raw space of the parity of a raidz to the pool.
+func (s *Server) SetPoolParity(name string, parity int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pools[name].Parity = parity
+}
+
+func (s *Server) Dataset(name string) *Dataset {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dataset, ok := s.datasets[name]
+	if !ok {
+		return nil
+	}
+	copy := *dataset
+	return &copy
+}
+
+func (s *Server) Targets() []Target {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listTargets()
+}
+
+func (s *Server) listTargets() []Target {
+	result := []Target{}
+	for _, item := range s.targets {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+func (s *Server) Extents() []Extent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listExtents()
+}
+
+func (s *Server) listExtents() []Extent {
+	result := []Extent{}
+	for _, item := range s.extents {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+func (s *Server) TargetExtents() []TargetExtent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listTargetExtents()
+}
+
+func (s *Server) listTargetExtents() []TargetExtent {
+	result := []TargetExtent{}
+	for _, item := range s.targetExtents {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// SetExtentEnabled enables or disables the extent with the given name.
+func (s *Server) SetExtentEnabled(name string, enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, extent := range s.extents {
+		if extent.Name == name {
+			extent.Enabled = enabled
+		}
+	}
+}
+
+func (s *Server) InjectFault(fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f := fault
+	s.faults = append(s.faults, &f)
+}
+
+func (s *Server) ClearFaults() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the handled requests, e.g. "POST /pool/dataset".
+func (s *Server) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) id() int {
+	id := s.nextId
+	s.nextId++
+	return id
+}
+
+type apiError struct {
+	statusCode int
+	body       interface{}
+}
+
+// validationError mimics the 422 responses of the TrueNAS middleware.
+func validationError(attribute string, message string, errno int) *apiError {
+	return &apiError{
+		statusCode: http.StatusUnprocessableEntity,
+		body: map[string]interface{}{
+			attribute: []map[string]interface{}{{"message": message, "errno": errno}},
+		},
+	}
+}
+
+func callError(statusCode int, message string, errno int) *apiError {
+	return &apiError{
+		statusCode: statusCode,
+		body:       map[string]interface{}{"message": message, "errno": errno},
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, r.Method+" "+path)
+	for i, fault := range s.faults {
+		if (fault.Method == "" || fault.Method == r.Method) && strings.HasPrefix(path, fault.Path) {
+			if fault.Times > 0 {
+				fault.Times--
+				if fault.Times == 0 {
+					s.faults = append(s.faults[:i], s.faults[i+1:]...)
+				}
+			}
+			s.mutex.Unlock()
+			w.WriteHeader(fault.StatusCode)
+			_, _ = w.Write([]byte(fault.Body))
+			return
+		}
+	}
+	s.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+s.ApiKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("HTTP/401.1 Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	result, apiErr := s.route(r.Method, path, r, body)
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if apiErr != nil {
+		w.WriteHeader(apiErr.statusCode)
+		_ = json.NewEncoder(w).Encode(apiErr.body)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) route(method string, path string, r *http.Request, body []byte) (interface{}, *apiError) {
+	switch {
+	case method == http.MethodGet && path == "/system/info":
+		return map[string]interface{}{"version": s.Version, "hostname": "truenas.local"}, nil
+	case method == http.MethodGet && path == "/service":
+		return s.getServices(r.URL.Query().Get("service")), nil
+	case method == http.MethodGet && path == "/iscsi/global":
+		return map[string]interface{}{"id": 1, "basename": s.Basename, "isns_servers": []string{}}, nil
+	case method == http.MethodGet && path == "/iscsi/portal":
+		return s.portals, nil
+	case method == http.MethodGet && path == "/iscsi/initiator":
+		return s.initiators, nil
+	case method == http.MethodGet && path == "/pool":
+		return s.getPools(r.URL.Query().Get("name")), nil
+	case method == http.MethodGet && path == "/pool/dataset":
+		return s.getDatasets(), nil
+	case method == http.MethodPost && path == "/pool/dataset":
+		return s.postDataset(body)
+	case strings.HasPrefix(path, "/pool/dataset/id/"):
+		id := strings.TrimPrefix(path, "/pool/dataset/id/")
+		switch method {
+		case http.MethodGet:
+			return s.getDataset(id)
+		case http.MethodPut:
+			return s.putDataset(id, body)
+		case http.MethodDelete:
+			return s.deleteDataset(id, body)
+		}
+	case method == http.MethodGet && path == "/zfs/snapshot":
+		return s.getSnapshots(), nil
+	case method == http.MethodPost && path == "/zfs/snapshot":
+		return s.postSnapshot(body)
+	case method == http.MethodDelete && strings.HasPrefix(path, "/zfs/snapshot/id/"):
+		return s.deleteSnapshot(strings.TrimPrefix(path, "/zfs/snapshot/id/"))
+	case method == http.MethodGet && path == "/iscsi/target":
+		return s.listTargets(), nil
+	case method == http.MethodPost && path == "/iscsi/target":
+		return s.postTarget(body)
+	case method == http.MethodGet && path == "/iscsi/extent":
+		return s.listExtents(), nil
+	case method == http.MethodPost && path == "/iscsi/extent":
+		return s.postExtent(body)
+	case method == http.MethodGet && path == "/iscsi/targetextent":
+		return s.listTargetExtents(), nil
+	case method == http.MethodPost && path == "/iscsi/targetextent":
+		return s.postTargetExtent(body)
+	case method == http.MethodDelete && strings.HasPrefix(path, "/iscsi/target/id/"):
+		return s.deleteTarget(strings.TrimPrefix(path, "/iscsi/target/id/"))
+	case method == http.MethodDelete && strings.HasPrefix(path, "/iscsi/extent/id/"):
+		return s.deleteExtent(strings.TrimPrefix(path, "/iscsi/extent/id/"))
+	case method == http.MethodDelete && strings.HasPrefix(path, "/iscsi/targetextent/id/"):
+		return s.deleteTargetExtent(strings.TrimPrefix(path, "/iscsi/targetextent/id/"))
+	}
+	return nil, callError(http.StatusNotFound, fmt.Sprintf("%s %s is not supported by the fake", method, path), 2)
+}
+
+func (s *Server) getPools(name string) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, pool := range s.pools {
+		if name != "" && pool.Name != name {
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"id":      pool.Id,
+			"name":    pool.Name,
+			"status":  pool.Status,
+			"healthy": pool.Healthy,
+			"size":    pool.Size + pool.Parity,
+			"free":    s.free(pool.Name) + pool.Parity,
+		})
+	}
+	return result
+}
+
+func (s *Server) getServices(name string) []map[string]interface{} {
+	names := []string{}
+	for service := range s.services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	result := []map[string]interface{}{}
+	for i, service := range names {
+		if name != "" && service != name {
+			continue
+		}
+		state := s.services[service]
+		result = append(result, map[string]interface{}{
+			"id":      i + 1,
+			"service": service,
+			"enable":  state == "RUNNING",
+			"state":   state,
+		})
+	}
+	return result
+}
+
+func property(value string) map[string]string {
+	return map[string]string{"value": value, "rawvalue": value, "source": "LOCAL"}
+}
+
+func (s *Server) poolOf(name string) string {
+	return strings.SplitN(name, "/", 2)[0]
+}
+
+// available is the size of the pool minus the space reserved by its zvols,
+// limited by the quotas of the dataset and its ancestors.
+func (s *Server) available(name string) int64 {
+	pool := s.poolOf(name)
+	available := s.pools[pool].Size - s.reserved(pool)
+	for ancestor := name; ancestor != "." && ancestor != "/"; ancestor = path.Dir(ancestor) {
+		if dataset, ok := s.datasets[ancestor]; ok && dataset.Quota > 0 {
+			if left := dataset.Quota - s.reserved(ancestor); left < available {
+				available = left
+			}
+		}
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// free is the size of the pool minus the space reserved by its zvols.
+const defaultVolblocksize = 16 << 10
+
+// volblocksizes are the block sizes the api accepts for zvols.
+var volblocksizes = map[string]int64{
+	"512": 512, "1K": 1 << 10, "2K": 2 << 10, "4K": 4 << 10, "8K": 8 << 10,
+	"16K": 16 << 10, "32K": 32 << 10, "64K": 64 << 10, "128K": 128 << 10,
+}
+
+func formatVolblocksize(size int64) string {
+	for value, bytes := range volblocksizes {
+		if bytes == size {
+			return value
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+func (s *Server) free(pool string) int64 {
+	if free := s.pools[pool].Size - s.reserved(pool); free > 0 {
+		return free
+	}
+	return 0
+}
+
+// reserved is the space reserved by the zvols within the dataset.
+func (s *Server) reserved(name string) int64 {
+	reserved := int64(0)
+	for _, dataset := range s.datasets {
+		if dataset.Name == name || strings.HasPrefix(dataset.Name, name+"/") {
+			reserved += dataset.refreservation()
+		}
+	}
+	return reserved
+}
+
+func (s *Server) datasetJson(dataset *Dataset) map[string]interface{} {
+	userProperties := map[string]interface{}{}
+	for key, value := range dataset.UserProperties {
+		userProperties[key] = property(value)
+	}
+	result := map[string]interface{}{
+		"id":              dataset.Name,
+		"name":            dataset.Name,
+		"type":            dataset.Type,
+		"pool":            s.poolOf(dataset.Name),
+		"comments":        property(dataset.Comments),
+		"available":       property(strconv.FormatInt(s.available(dataset.Name), 10)),
+		"quota":           property(strconv.FormatInt(dataset.Quota, 10)),
+		"used":            property(strconv.FormatInt(dataset.Used+s.reserved(dataset.Name)-dataset.refreservation(), 10)),
+		"readonly":        property(onOff(dataset.Readonly)),
+		"user_properties": userProperties,
+		"children":        []interface{}{},
+	}
+	result["refreservation"] = property(strconv.FormatInt(dataset.Volsize, 10))
+	if dataset.Sparse {
+		result["refreservation"] = property("none")
+	}
+	if dataset.Type == "VOLUME" {
+		result["volsize"] = property(strconv.FormatInt(dataset.Volsize, 10))
+		result["volblocksize"] = map[string]string{"value": formatVolblocksize(dataset.Volblocksize), "rawvalue": strconv.FormatInt(dataset.Volblocksize, 10), "source": "LOCAL"}
+	}
+	return result
+}
+
+func (d *Dataset) refreservation() int64 {
+	if d.Sparse {
+		return 0
+	}
+	return d.Volsize
+}
+
+func onOff(value bool) string {
+	if value {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func (s *Server) getDatasets() []map[string]interface{} {
+	names := []string{}
+	for name := range s.datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []map[string]interface{}{}
+	for _, name := range names {
+		result = append(result, s.datasetJson(s.datasets[name]))
+	}
+	return result
+}
+
+func (s *Server) getDataset(id string) (interface{}, *apiError) {
+	dataset, ok := s.datasets[id]
+	if !ok {
+		return nil, callError(http.StatusNotFound, fmt.Sprintf("[ENOENT] Dataset %s does not exist", id), 2)
+	}
+	return s.datasetJson(dataset), nil
+}
+
+func (s *Server) postDataset(body []byte) (interface{}, *apiError) {
+	req := struct {
+		Type           string `json:"type"`
+		Name           string `json:"name"`
+		Volsize        int64  `json:"volsize"`
+		Volblocksize   string `json:"volblocksize"`
+		Quota          int64  `json:"quota"`
+		UserProperties []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"user_properties"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, callError(http.StatusBadRequest, err.Error(), 22)
+	}
+	if _, ok := s.datasets[req.Name]; ok {
+		return nil, validationError("pool_dataset_create.name", fmt.Sprintf("Path %s already exists", req.Name), 17)
+	}
+	i := strings.LastIndex(req.Name, "/")
+	if i < 0 {
+		return nil, validationError("pool_dataset_create.name", "You need a full name, e.g. pool/newdataset", 22)
+	}
+	if _, ok := s.datasets[req.Name[:i]]; !ok {
+		return nil, validationError("pool_dataset_create.name", fmt.Sprintf("Parent dataset %s does not exist", req.Name[:i]), 2)
+	}
+	dataset := &Dataset{Name: req.Name, Type: "FILESYSTEM", Quota: req.Quota, UserProperties: map[string]string{}}
+	if req.Type == "VOLUME" {
+		if req.Volsize <= 0 {
+			return nil, validationError("pool_dataset_create.volsize", "This field is required", 22)
+		}
+		dataset.Volblocksize = defaultVolblocksize
+		if req.Volblocksize != "" {
+			volblocksize, ok := volblocksizes[req.Volblocksize]
+			if !ok {
+				return nil, validationError("pool_dataset_create.volblocksize", fmt.Sprintf("Invalid choice: %s", req.Volblocksize), 22)
+			}
+			dataset.Volblocksize = volblocksize
+		}
+		if req.Volsize%dataset.Volblocksize != 0 {
+			return nil, validationError("pool_dataset_create.volsize", fmt.Sprintf("Volume size should be a multiple of %s", formatVolblocksize(dataset.Volblocksize)), 22)
+		}
+		if req.Volsize > s.available(req.Name[:i]) {
+			return nil, callError(http.StatusUnprocessableEntity, fmt.Sprintf("[EFAULT] Failed to create dataset: cannot create '%s': out of space", req.Name), 14)
+		}
+		dataset.Type = "VOLUME"
+		dataset.Volsize = req.Volsize
+	}
+	for _, property := range req.UserProperties {
+		dataset.UserProperties[property.Key] = property.Value
+	}
+	s.datasets[req.Name] = dataset
+	return s.datasetJson(dataset), nil
+}
+
+func (s *Server) putDataset(id string, body []byte) (interface{}, *apiError) {
+	dataset, ok := s.datasets[id]
+	if !ok {
+		return nil, callError(http.StatusNotFound, fmt.Sprintf("[ENOENT] Dataset %s does not exist", id), 2)
+	}
+	req := struct {
+		Volsize  *int64  `json:"volsize"`
+		Quota    *int64  `json:"quota"`
+		Comments *string `json:"comments"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, callError(http.StatusBadRequest, err.Error(), 22)
+	}
+	if req.Volsize != nil {
+		if dataset.Type != "VOLUME" {
+			return nil, validationError("pool_dataset_update.volsize", "This field is not valid for FILESYSTEM", 22)
+		}
+		if *req.Volsize < dataset.Volsize {
+			return nil, validationError("pool_dataset_update.volsize", "You cannot shrink a zvol from GUI as this may lead to data loss.", 22)
+		}
+		if *req.Volsize%dataset.Volblocksize != 0 {
+			return nil, validationError("pool_dataset_update.volsize", fmt.Sprintf("Volume size should be a multiple of %s", formatVolblocksize(dataset.Volblocksize)), 22)
+		}
+		if *req.Volsize-dataset.Volsize > s.available(path.Dir(id)) {
+			return nil, callError(http.StatusUnprocessableEntity, fmt.Sprintf("[EFAULT] Failed to update dataset: cannot set property for '%s': size is greater than available space", id), 14)
+		}
+		dataset.Volsize = *req.Volsize
+	}
+	if req.Quota != nil {
+		if dataset.Type != "FILESYSTEM" {
+			return nil, validationError("pool_dataset_update.quota", "This field is not valid for VOLUME", 22)
+		}
+		dataset.Quota = *req.Quota
+	}
+	if req.Comments != nil {
+		dataset.Comments = *req.Comments
+	}
+	return s.datasetJson(dataset), nil
+}
+
+func (s *Server) deleteDataset(id string, body []byte) (interface{}, *apiError) {
+	if _, ok := s.datasets[id]; !ok {
+		return nil, callError(http.StatusUnprocessableEntity, fmt.Sprintf("[ENOENT] Failed to delete dataset: cannot open '%s': dataset does not exist", id), 2)
+	}
+	req := struct {
+		Recursive bool `json:"recursive"`
+	}{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, callError(http.StatusBadRequest, err.Error(), 22)
+		}
+	}
+	children := []string{}
+	for name := range s.datasets {
+		if strings.HasPrefix(name, id+"/") {
+			children = append(children, name)
+		}
+	}
+	for name := range s.snapshots {
+		if strings.HasPrefix(name, id+"@") {
+			children = append(children, name)
+		}
+	}
+	if len(children) > 0 && !req.Recursive {
+		sort.Strings(children)
+		return nil, callError(http.StatusUnprocessableEntity, fmt.Sprintf("[EFAULT] Failed to delete dataset: cannot destroy '%s': dataset has children\nuse '-r' to destroy the following datasets:\n%s", id, strings.Join(children, "\n")), 14)
+	}
+	for _, name := range children {
+		delete(s.datasets, name)
+		delete(s.snapshots, name)
+	}
+	delete(s.datasets, id)
+	return true, nil
+}
+
+func (s *Server) getSnapshots() []map[string]interface{} {
+	ids := []string{}
+	for id := range s.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := []map[string]interface{}{}
+	for _, id := range ids {
+		snapshot := s.snapshots[id]
+		result = append(result, map[string]interface{}{
+			"id":            id,
+			"name":          id,
+			"dataset":       snapshot.Dataset,
+			"snapshot_name": snapshot.Name,
+			"pool":          s.poolOf(snapshot.Dataset),
+		})
+	}
+	return result
+}
+
+func (s *Server) postSnapshot(body []byte) (interface{}, *apiError) {
+	req := struct {
+		Dataset string `json:"dataset"`
+		Name    string `json:"name"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, callError(http.StatusBadRequest, err.Error(), 22)
+	}
+	if _, ok := s.datasets[req.Dataset]; !ok {
+		return nil, validationError("zfs_snapshot_create.dataset", fmt.Sprintf("Dataset %s does not exist", req.Dataset), 2)
+	}
+	id := req.Dataset + "@" + req.Name
+	if _, ok := s.snapshots[id]; ok {
+		return nil, callError(http.StatusUnprocessableEntity, fmt.Sprintf("[EFAULT] Failed to snapshot %s: dataset already exists", id), 14)
+	}
+	s.snapshots[id] = &Snapshot{Dataset: req.Dataset, Name: req.Name}
+	return map[string]interface{}{"id": id, "name": id, "dataset": req.Dataset, "snapshot_name": req.Name}, nil
+}
+
+func (s *Server) deleteSnapshot(id string) (interface{}, *apiError) {
+	if _, ok := s.snapshots[id]; !ok {
+		return nil, callError(http.StatusNotFound, fmt.Sprintf("[ENOENT] Snapshot %s does not exist", id), 2)
+	}
+	delete(s.snapshots, id)
+	return true, nil
+}
+
+func (s *Server) postTarget(body []byte) (interface{}, *apiError) {
+	req := Target{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, callError(http.StatusBadRequest, err.Error(), 22)
+	}
+	for _, target := range s.targets {
+		if target.Name == req.Name {
+			return nil, validationError("iscsi_target_create.name", "Target name already exists", 17)
+		}
+	}
+	req.Id = s.id()
+	s.targets[req.Id] = &req
+	return req, nil
+}
+
+func (s *Server) postExtent(body []byte) (interface{}, *apiError) {
+	req := Extent{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, callError(http.StatusBadRequest, err.Error(), 22)
+	}
+	for _, extent := range s.extents {
+		if extent.Name == req.Name {
+			return nil, validationError("iscsi_extent_create.name", "Extent name must be unique", 17)
+		}
+	}
+	if strings.HasPrefix(req.Disk, "zvol/") {
+		if dataset, ok := s.datasets[strings.TrimPrefix(req.Disk, "zvol/")]; !ok || dataset.Type != "VOLUME" {
+			return nil, validationError("iscsi_extent_create.disk", fmt.Sprintf("Disk %s does not exist", req.Disk), 2)
+		}
+	}
+	req.Id = s.id()
+	req.Enabled = true
+	s.extents[req.Id] = &req
+	return req, nil
+}
+
+func (s *Server) postTargetExtent(body []byte) (interface{}, *apiError) {
+	req := TargetExtent{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, callError(http.StatusBadRequest, err.Error(), 22)
+	}
+	if _, ok := s.targets[req.Target]; !ok {
+		return nil, validationError("iscsi_targetextent_create.target", fmt.Sprintf("Target %d does not exist", req.Target), 2)
+	}
+	if _, ok := s.extents[req.Extent]; !ok {
+		return nil, validationError("iscsi_targetextent_create.extent", fmt.Sprintf("Extent %d does not exist", req.Extent), 2)
+	}
+	for _, targetExtent := range s.targetExtents {
+		if targetExtent.Target == req.Target && targetExtent.Extent == req.Extent {
+			return nil, validationError("iscsi_targetextent_create.extent", "Extent is already in this target.", 17)
+		}
+		if targetExtent.Target == req.Target && targetExtent.LUNId == req.LUNId {
+			return nil, validationError("iscsi_targetextent_create.lunid", "LUN ID is already being used for this target.", 17)
+		}
+	}
+	req.Id = s.id()
+	s.targetExtents[req.Id] = &req
+	return req, nil
+}
+
+// deleteTarget removes the target together with its associations to extents,
+// like TrueNAS does.
+func (s *Server) deleteTarget(id string) (interface{}, *apiError) {
+	target, ok := s.targets[atoi(id)]
+	if !ok {
+		return nil, callError(http.StatusNotFound, fmt.Sprintf("[ENOENT] Target %s does not exist", id), 2)
+	}
+	for key, targetExtent := range s.targetExtents {
+		if targetExtent.Target == target.Id {
+			delete(s.targetExtents, key)
+		}
+	}
+	delete(s.targets, target.Id)
+	return true, nil
+}
+
+// deleteExtent removes the extent together with its associations to targets,
+// like TrueNAS does.
+func (s *Server) deleteExtent(id string) (interface{}, *apiError) {
+	extent, ok := s.extents[atoi(id)]
+	if !ok {
+		return nil, callError(http.StatusNotFound, fmt.Sprintf("[ENOENT] Extent %s does not exist", id), 2)
+	}
+	for key, targetExtent := range s.targetExtents {
+		if targetExtent.Extent == extent.Id {
+			delete(s.targetExtents, key)
+		}
+	}
+	delete(s.extents, extent.Id)
+	return true, nil
+}
+
+func (s *Server) deleteTargetExtent(id string) (interface{}, *apiError) {
+	key := atoi(id)
+	if _, ok := s.targetExtents[key]; !ok {
+		return nil, callError(http.StatusNotFound, fmt.Sprintf("[ENOENT] Target extent %s does not exist", id), 2)
+	}
+	delete(s.targetExtents, key)
+	return true, nil
+}
+
+// atoi parses the id of a path, invalid ids match nothing.
+func atoi(str string) int {
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		return -1
+	}
+	return value
+}
@@ -2,22 +2,27 @@ package truenas
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 )
 
 type TruenasHttpClient struct {
-	http          *utils.JsonHttpClient
-	BaseURL       string
-	ApiKey        string
-	TLSSkipVerify bool
+	http    *utils.JsonHttpClient
+	BaseURL string
+	ApiKey  string
+	TLS     utils.TLSOptions
 }
 
-func NewTruenasHttpClient(baseUrl string, apiKey string, tlsSkipVerify bool) *TruenasHttpClient {
+func NewTruenasHttpClient(baseUrl string, apiKey string, tlsOptions utils.TLSOptions) (*TruenasHttpClient, error) {
+	transport, err := utils.SharedTransport(baseUrl, tlsOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure tls: %w", err)
+	}
+
 	baseUrlOpt := utils.WithRequestTransformer(func(r *http.Request) error {
 		fullUrl, err := url.Parse(fmt.Sprintf("%s/api/v2.0%s", baseUrl, r.URL.String()))
 		if err != nil {
@@ -30,33 +35,74 @@ func NewTruenasHttpClient(baseUrl string, apiKey string, tlsSkipVerify bool) *Tr
 		r.Header.Set("Authorization", "Bearer "+apiKey)
 		return nil
 	})
-	tlsSkipVerifyOpt := utils.WithHttpConfiguration(func(c *http.Client) {
-		c.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: tlsSkipVerify},
-		}
+	transportOpt := utils.WithHttpConfiguration(func(c *http.Client) {
+		c.Transport = transport
 	})
-	client := utils.NewJsonHttpClient(tlsSkipVerifyOpt, baseUrlOpt, apiKeyOpt)
+	client := utils.NewJsonHttpClient(transportOpt, baseUrlOpt, apiKeyOpt)
 
 	return &TruenasHttpClient{
-		http:          client,
-		BaseURL:       baseUrl,
-		ApiKey:        apiKey,
-		TLSSkipVerify: tlsSkipVerify,
-	}
+		http:    client,
+		BaseURL: baseUrl,
+		ApiKey:  apiKey,
+		TLS:     tlsOptions,
+	}, nil
+}
+
+type PoolDatasetProperty struct {
+	Value    string `json:"value"`
+	Rawvalue string `json:"rawvalue"`
+	Source   string `json:"source"`
+}
+
+func (p PoolDatasetProperty) Int64() (int64, error) {
+	return strconv.ParseInt(p.Rawvalue, 10, 64)
 }
 
 type PoolDataset struct {
-	Id       string        `json:"id"`
-	Type     string        `json:"type"`
-	Name     string        `json:"name"`
-	Pool     string        `json:"pool"`
-	Children []PoolDataset `json:"children"`
+	Id      string              `json:"id"`
+	Type    string              `json:"type"`
+	Name    string              `json:"name"`
+	Pool    string              `json:"pool"`
+	Volsize PoolDatasetProperty `json:"volsize"`
+	// Volblocksize is the block size of a zvol, its volsize is a multiple of it
+	Volblocksize PoolDatasetProperty `json:"volblocksize"`
+	Available    PoolDatasetProperty `json:"available"`
+	Used         PoolDatasetProperty `json:"used"`
+	Readonly     PoolDatasetProperty `json:"readonly"`
+	Quota        PoolDatasetProperty `json:"quota"`
+	// Refreservation is the space reserved for a zvol, its volsize unless sparse
+	Refreservation PoolDatasetProperty `json:"refreservation"`
+	Comments       PoolDatasetProperty `json:"comments"`
+	Children       []PoolDataset       `json:"children"`
+	// zfs user properties like "truenas.csi.choffmeister.de:volume"
+	UserProperties map[string]PoolDatasetProperty `json:"user_properties"`
+}
+
+type Pool struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Healthy bool   `json:"healthy"`
+	Size    int64  `json:"size"`
+	Free    int64  `json:"free"`
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-Pool-poolGet
+func (c *TruenasHttpClient) PoolGetByName(ctx context.Context, name string) (*Pool, error) {
+	res := []Pool{}
+	if err := c.http.Get(ctx, "/pool?name="+url.QueryEscape(name), nil, &res); err != nil {
+		return nil, fmt.Errorf("unable to call PoolGet: %w", err)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("pool %s does not exist", name)
+	}
+	return &res[0], nil
 }
 
 // https://www.truenas.com/docs/api/rest.html#api-PoolDataset-poolDatasetGet
 func (c *TruenasHttpClient) PoolDatasetGet(ctx context.Context, limit int, offset int) (*[]PoolDataset, error) {
 	res := []PoolDataset{}
-	if err := c.http.Get(ctx, fmt.Sprintf("/pool/dataset?limit=%d&offest=%d", limit, offset), nil, &res); err != nil {
+	if err := c.http.Get(ctx, fmt.Sprintf("/pool/dataset?limit=%d&offset=%d", limit, offset), nil, &res); err != nil {
 		return nil, fmt.Errorf("unable to call PoolDatasetGet: %w", err)
 	}
 	return &res, nil
@@ -72,15 +118,25 @@ func (c *TruenasHttpClient) PoolDatasetIdIdGet(ctx context.Context, id string) (
 }
 
 // https://www.truenas.com/docs/api/rest.html#api-PoolDataset-poolDatasetPost
-func (c *TruenasHttpClient) PoolDatasetPost(ctx context.Context, name string, volsize int64) (*PoolDataset, error) {
+func (c *TruenasHttpClient) PoolDatasetPost(ctx context.Context, name string, volsize int64, volblocksize string, userProperties map[string]string) (*PoolDataset, error) {
+	type userProperty struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
 	req := struct {
-		Type    string `json:"type"`
-		Name    string `json:"name"`
-		Volsize int64  `json:"volsize"`
+		Type           string         `json:"type"`
+		Name           string         `json:"name"`
+		Volsize        int64          `json:"volsize"`
+		Volblocksize   string         `json:"volblocksize,omitempty"`
+		UserProperties []userProperty `json:"user_properties,omitempty"`
 	}{
-		Type:    "VOLUME",
-		Name:    name,
-		Volsize: volsize,
+		Type:         "VOLUME",
+		Name:         name,
+		Volsize:      volsize,
+		Volblocksize: volblocksize,
+	}
+	for key, value := range userProperties {
+		req.UserProperties = append(req.UserProperties, userProperty{Key: key, Value: value})
 	}
 	res := PoolDataset{}
 	if err := c.http.Post(ctx, "/pool/dataset", &req, &res); err != nil {
@@ -89,6 +145,38 @@ func (c *TruenasHttpClient) PoolDatasetPost(ctx context.Context, name string, vo
 	return &res, nil
 }
 
+// https://www.truenas.com/docs/api/rest.html#api-PoolDataset-poolDatasetPost
+func (c *TruenasHttpClient) PoolDatasetPostFilesystem(ctx context.Context, name string, quota int64) (*PoolDataset, error) {
+	req := struct {
+		Type  string `json:"type"`
+		Name  string `json:"name"`
+		Quota int64  `json:"quota,omitempty"`
+	}{
+		Type:  "FILESYSTEM",
+		Name:  name,
+		Quota: quota,
+	}
+	res := PoolDataset{}
+	if err := c.http.Post(ctx, "/pool/dataset", &req, &res); err != nil {
+		return nil, fmt.Errorf("unable to call PoolDatasetPost: %w", err)
+	}
+	return &res, nil
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-PoolDataset-poolDatasetPut
+func (c *TruenasHttpClient) PoolDatasetPutQuota(ctx context.Context, id string, quota int64) (*PoolDataset, error) {
+	req := struct {
+		Quota int64 `json:"quota"`
+	}{
+		Quota: quota,
+	}
+	res := PoolDataset{}
+	if err := c.http.Put(ctx, "/pool/dataset/id/"+url.QueryEscape(id), &req, &res); err != nil {
+		return nil, fmt.Errorf("unable to call PoolDatasetPut: %w", err)
+	}
+	return &res, nil
+}
+
 // https://www.truenas.com/docs/api/rest.html#api-PoolDataset-poolDatasetPut
 func (c *TruenasHttpClient) PoolDatasetPutVolsize(ctx context.Context, id string, volsize int64) (*PoolDataset, error) {
 	req := struct {
@@ -139,6 +227,7 @@ type ISCSIExtent struct {
 	Type        string `json:"type"`
 	Disk        string `json:"disk"`
 	InsecureTPC bool   `json:"insecure_tpc"`
+	Enabled     bool   `json:"enabled"`
 }
 
 // https://www.truenas.com/docs/api/rest.html#api-IscsiExtent-iscsiExtentGet
@@ -170,6 +259,22 @@ func (c *TruenasHttpClient) ISCSIExtentPost(ctx context.Context, name string, di
 	return &res, nil
 }
 
+// https://www.truenas.com/docs/api/rest.html#api-IscsiExtent-iscsiExtentIdIdDelete
+func (c *TruenasHttpClient) ISCSIExtentIdIdDelete(ctx context.Context, id int) error {
+	opts := struct {
+		Remove bool `json:"remove"`
+		Force  bool `json:"force"`
+	}{
+		Remove: false,
+		Force:  false,
+	}
+	var res interface{}
+	if err := c.http.Delete(ctx, fmt.Sprintf("/iscsi/extent/id/%d", id), &opts, &res); err != nil {
+		return fmt.Errorf("unable to call ISCSIExtentIdIdDelete: %w", err)
+	}
+	return nil
+}
+
 type ISCSITargetGroup struct {
 	PortalId    int `json:"portal"`
 	InitiatorId int `json:"initiator"`
@@ -210,6 +315,15 @@ func (c *TruenasHttpClient) ISCSITargetPost(ctx context.Context, name string, po
 	return &res, nil
 }
 
+// https://www.truenas.com/docs/api/rest.html#api-IscsiTarget-iscsiTargetIdIdDelete
+func (c *TruenasHttpClient) ISCSITargetIdIdDelete(ctx context.Context, id int) error {
+	var res interface{}
+	if err := c.http.Delete(ctx, fmt.Sprintf("/iscsi/target/id/%d", id), false, &res); err != nil {
+		return fmt.Errorf("unable to call ISCSITargetIdIdDelete: %w", err)
+	}
+	return nil
+}
+
 type ISCSITargetExtend struct {
 	Id     int `json:"id"`
 	Target int `json:"target"`
@@ -241,3 +355,93 @@ func (c *TruenasHttpClient) ISCSITargetExtendPost(ctx context.Context, targetId
 	}
 	return &res, nil
 }
+
+// https://www.truenas.com/docs/api/rest.html#api-IscsiTargetextent-iscsiTargetextentIdIdDelete
+func (c *TruenasHttpClient) ISCSITargetExtendIdIdDelete(ctx context.Context, id int) error {
+	var res interface{}
+	if err := c.http.Delete(ctx, fmt.Sprintf("/iscsi/targetextent/id/%d", id), false, &res); err != nil {
+		return fmt.Errorf("unable to call ISCSITargetExtendIdIdDelete: %w", err)
+	}
+	return nil
+}
+
+type SystemInfo struct {
+	Version  string `json:"version"`
+	Hostname string `json:"hostname"`
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-System-systemInfoGet
+func (c *TruenasHttpClient) SystemInfoGet(ctx context.Context) (*SystemInfo, error) {
+	res := SystemInfo{}
+	if err := c.http.Get(ctx, "/system/info", nil, &res); err != nil {
+		return nil, fmt.Errorf("unable to call SystemInfoGet: %w", err)
+	}
+	return &res, nil
+}
+
+type Service struct {
+	Id      int    `json:"id"`
+	Service string `json:"service"`
+	Enable  bool   `json:"enable"`
+	State   string `json:"state"`
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-Service-serviceGet
+func (c *TruenasHttpClient) ServiceGetByName(ctx context.Context, name string) (*Service, error) {
+	res := []Service{}
+	if err := c.http.Get(ctx, "/service?service="+url.QueryEscape(name), nil, &res); err != nil {
+		return nil, fmt.Errorf("unable to call ServiceGet: %w", err)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("service %s does not exist", name)
+	}
+	return &res[0], nil
+}
+
+type ISCSIGlobal struct {
+	Basename string `json:"basename"`
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-IscsiGlobal-iscsiGlobalGet
+func (c *TruenasHttpClient) ISCSIGlobalGet(ctx context.Context) (*ISCSIGlobal, error) {
+	res := ISCSIGlobal{}
+	if err := c.http.Get(ctx, "/iscsi/global", nil, &res); err != nil {
+		return nil, fmt.Errorf("unable to call ISCSIGlobalGet: %w", err)
+	}
+	return &res, nil
+}
+
+type ISCSIPortalListen struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+type ISCSIPortal struct {
+	Id      int                 `json:"id"`
+	Comment string              `json:"comment"`
+	Listen  []ISCSIPortalListen `json:"listen"`
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-IscsiPortal-iscsiPortalGet
+func (c *TruenasHttpClient) ISCSIPortalGet(ctx context.Context, limit int) (*[]ISCSIPortal, error) {
+	res := []ISCSIPortal{}
+	if err := c.http.Get(ctx, fmt.Sprintf("/iscsi/portal?limit=%d", limit), nil, &res); err != nil {
+		return nil, fmt.Errorf("unable to call ISCSIPortalGet: %w", err)
+	}
+	return &res, nil
+}
+
+type ISCSIInitiator struct {
+	Id         int      `json:"id"`
+	Comment    string   `json:"comment"`
+	Initiators []string `json:"initiators"`
+}
+
+// https://www.truenas.com/docs/api/rest.html#api-IscsiInitiator-iscsiInitiatorGet
+func (c *TruenasHttpClient) ISCSIInitiatorGet(ctx context.Context, limit int) (*[]ISCSIInitiator, error) {
+	res := []ISCSIInitiator{}
+	if err := c.http.Get(ctx, fmt.Sprintf("/iscsi/initiator?limit=%d", limit), nil, &res); err != nil {
+		return nil, fmt.Errorf("unable to call ISCSIInitiatorGet: %w", err)
+	}
+	return &res, nil
+}
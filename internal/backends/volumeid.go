@@ -0,0 +1,109 @@
+package backends
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	VolumeIdVersion2 = "v2"
+
+	ProtocolISCSI = "iscsi"
+
+	// neither allowed in secret keys, zfs dataset names nor iqns
+	volumeIdSeparator = ","
+)
+
+// VolumeId describes where a volume lives, so that it can be found without
+// relying on the secrets of the request pointing to the same backend. Encoded
+// it looks like
+//
+//	v2,<backend>,<identity>,iscsi,<dataset>
+//
+// The iqn of the volume is not part of the id, as it can be derived from the
+// base iqn of the backend and would push long ids over the 128 bytes the csi
+// spec allows. Plain volume ids as issued by older versions only carry the
+// dataset.
+type VolumeId struct {
+	// Backend is the name of the backend within the storage class secrets, empty
+	// for the unnamed backend.
+	Backend string
+	// Identity is a short hash of the backend location, see BackendIdentity.
+	Identity string
+	Protocol string
+	Dataset  string
+}
+
+// BackendIdentity derives the identity of a backend from its url.
+func BackendIdentity(url string) string {
+	hash := sha256.Sum256([]byte(strings.TrimRight(strings.ToLower(url), "/")))
+	return hex.EncodeToString(hash[:4])
+}
+
+// IsPlain returns whether the id has been parsed from a plain volume id.
+func (id VolumeId) IsPlain() bool {
+	return id.Identity == ""
+}
+
+// Name returns the name the volume has been created with, which is the last
+// element of its dataset.
+func (id VolumeId) Name() string {
+	return path.Base(id.Dataset)
+}
+
+// TargetIQN derives the iqn of the iscsi target of the volume, which is named
+// like the zvol.
+func (id VolumeId) TargetIQN(iscsi ISCSISecrets) string {
+	return iscsi.TargetIQN(id.Name())
+}
+
+// ImportedTargetIQN derives the iqn of the iscsi target of a pre-existing zvol
+// that has been imported, see ImportedTargetName.
+func (id VolumeId) ImportedTargetIQN(iscsi ISCSISecrets) string {
+	return iscsi.TargetIQN(ImportedTargetName(id.Dataset))
+}
+
+// BelongsTo returns whether the volume lives on the given backend. Plain ids
+// cannot be checked and are always accepted.
+func (id VolumeId) BelongsTo(backend Backend) bool {
+	return id.IsPlain() || id.Identity == backend.Identity()
+}
+
+func (id VolumeId) String() string {
+	if id.IsPlain() {
+		return id.Dataset
+	}
+	return strings.Join([]string{VolumeIdVersion2, id.Backend, id.Identity, id.Protocol, id.Dataset}, volumeIdSeparator)
+}
+
+func ParseVolumeId(str string) (VolumeId, error) {
+	if str == "" {
+		return VolumeId{}, fmt.Errorf("volume id must not be empty")
+	}
+	if !strings.Contains(str, volumeIdSeparator) {
+		return VolumeId{Dataset: str}, nil
+	}
+	parts := strings.Split(str, volumeIdSeparator)
+	if parts[0] != VolumeIdVersion2 {
+		return VolumeId{}, fmt.Errorf("unsupported volume id version %s", parts[0])
+	}
+	if len(parts) != 5 {
+		return VolumeId{}, fmt.Errorf("malformed volume id %s: expected 5 parts, got %d", str, len(parts))
+	}
+	id := VolumeId{
+		Backend:  parts[1],
+		Identity: parts[2],
+		Protocol: parts[3],
+		Dataset:  parts[4],
+	}
+	if id.Identity == "" || id.Dataset == "" {
+		return VolumeId{}, fmt.Errorf("malformed volume id %s: missing identity or dataset", str)
+	}
+	if id.Protocol != ProtocolISCSI {
+		return VolumeId{}, fmt.Errorf("malformed volume id %s: unsupported protocol %s", str, id.Protocol)
+	}
+	return id, nil
+}
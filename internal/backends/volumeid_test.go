@@ -0,0 +1,56 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_VolumeId(t *testing.T) {
+	id := VolumeId{
+		Backend:  "nas-a",
+		Identity: BackendIdentity("https://nas-a.local/"),
+		Protocol: ProtocolISCSI,
+		Dataset:  "tank/k8s/pvc-1",
+	}
+	assert.Equal(t, BackendIdentity("https://NAS-A.local"), id.Identity)
+	assert.NotEqual(t, BackendIdentity("https://nas-b.local"), id.Identity)
+	assert.Equal(t, "v2,nas-a,"+id.Identity+",iscsi,tank/k8s/pvc-1", id.String())
+	assert.Equal(t, "iqn.2005-10.org.freenas.ctl:pvc-1", id.TargetIQN(ISCSISecrets{BaseIQN: "iqn.2005-10.org.freenas.ctl"}))
+	assert.Equal(t, "iqn.2005-10.org.freenas.ctl:tank-k8s-pvc-1", id.ImportedTargetIQN(ISCSISecrets{BaseIQN: "iqn.2005-10.org.freenas.ctl"}))
+	assert.Equal(t, "pvc-1", id.Name())
+	assert.Equal(t, "tank-legacy-my-data-v1.2", ImportedTargetName("tank/Legacy/my_data v1.2"))
+
+	parsed, err := ParseVolumeId(id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, id, parsed)
+	assert.False(t, parsed.IsPlain())
+
+	parsed, err = ParseVolumeId("tank/k8s/pvc-1")
+	assert.NoError(t, err)
+	assert.Equal(t, VolumeId{Dataset: "tank/k8s/pvc-1"}, parsed)
+	assert.True(t, parsed.IsPlain())
+	assert.Equal(t, "tank/k8s/pvc-1", parsed.String())
+
+	_, err = ParseVolumeId("")
+	assert.Error(t, err)
+	_, err = ParseVolumeId("v3,nas-a,abc,iscsi,tank/k8s/pvc-1")
+	assert.Error(t, err)
+	_, err = ParseVolumeId("v2,nas-a,abc,nfs,tank/k8s/pvc-1")
+	assert.Error(t, err)
+	_, err = ParseVolumeId("v2,nas-a,abc,iscsi")
+	assert.Error(t, err)
+	_, err = ParseVolumeId("v1,nas-a,abc,iscsi,tank/k8s/pvc-1")
+	assert.Error(t, err)
+}
+
+func Test_VolumeIdLength(t *testing.T) {
+	// the csi spec limits volume ids to 128 bytes
+	id := VolumeId{
+		Backend:  "nas-a",
+		Identity: BackendIdentity("https://nas-a.local"),
+		Protocol: ProtocolISCSI,
+		Dataset:  "tank/k8s/default/pvc-3f0c9a52-8d5e-4b5f-9a0e-6c1d2b7e4f81",
+	}
+	assert.LessOrEqual(t, len(id.String()), 128)
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the startup settings of the driver. Values are resolved with the
+// following precedence (highest first):
+//
+//  1. command line flags
+//  2. environment variables (CSI_ENDPOINT, KUBE_NODE_NAME)
+//  3. the yaml config file given via --config
+//  4. the defaults from Default()
+type Config struct {
+	Endpoint          string        `yaml:"endpoint"`
+	DriverName        string        `yaml:"driverName"`
+	NodeId            string        `yaml:"nodeId"`
+	DefaultVolumeSize Size          `yaml:"defaultVolumeSize"`
+	MinVolumeSize     Size          `yaml:"minVolumeSize"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"`
+	CommandTimeout    time.Duration `yaml:"commandTimeout"`
+	ApiTimeout        time.Duration `yaml:"apiTimeout"`
+	LogVerbosity      int           `yaml:"logVerbosity"`
+	MetricsAddress    string        `yaml:"metricsAddress"`
+	// LogLevelAddress serves the unauthenticated /loglevel endpoint, it must be
+	// a loopback address.
+	LogLevelAddress string `yaml:"logLevelAddress"`
+	OTLPEndpoint    string `yaml:"otlpEndpoint"`
+	OTLPInsecure    bool   `yaml:"otlpInsecure"`
+	SecretsDir      string `yaml:"secretsDir"`
+	// TopologyKey is the topology segment that volumes are constrained to,
+	// Zone the value of this segment for the node.
+	TopologyKey            string `yaml:"topologyKey"`
+	Zone                   string `yaml:"zone"`
+	TopologyFromNodeLabels bool   `yaml:"topologyFromNodeLabels"`
+	// NodeDoctor checks the prerequisites of the node on startup, see the doctor
+	// command.
+	NodeDoctor bool `yaml:"nodeDoctor"`
+	// PoolReservePercent is the share of every pool that is kept free when
+	// volumes are created or expanded.
+	PoolReservePercent int `yaml:"poolReservePercent"`
+}
+
+const (
+	DefaultDriverName  = "truenas.csi.choffmeister.de"
+	DefaultTopologyKey = "topology.kubernetes.io/zone"
+)
+
+func Default() Config {
+	return Config{
+		DriverName:        DefaultDriverName,
+		DefaultVolumeSize: 1024 * 1024 * 1024, // 1 GB
+		MinVolumeSize:     1024 * 1024,        // 1 MB
+		ShutdownTimeout:   30 * time.Second,
+		CommandTimeout:    10 * time.Second,
+		ApiTimeout:        30 * time.Second,
+		TopologyKey:       DefaultTopologyKey,
+		NodeDoctor:        true,
+	}
+}
+
+// Load resolves the configuration. The flags must have been registered with
+// BindFlags on the same config and already been parsed.
+func (c *Config) Load(flags *pflag.FlagSet, file string) error {
+	changed := map[string]string{}
+	flags.Visit(func(f *pflag.Flag) {
+		changed[f.Name] = f.Value.String()
+	})
+
+	*c = Default()
+	if file != "" {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(bs, c); err != nil {
+			return fmt.Errorf("unable to parse config file %s: %w", file, err)
+		}
+	}
+	if endpoint := os.Getenv("CSI_ENDPOINT"); endpoint != "" {
+		c.Endpoint = endpoint
+	}
+	if nodeId := os.Getenv("KUBE_NODE_NAME"); nodeId != "" {
+		c.NodeId = nodeId
+	}
+	// the flags write into the config, so setting them again restores their
+	// values on top of the file and the environment
+	for name, value := range changed {
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for flag --%s: %w", name, err)
+		}
+	}
+
+	return c.Validate()
+}
+
+func (c *Config) Validate() error {
+	if c.DriverName == "" {
+		return fmt.Errorf("driver name must not be empty")
+	}
+	if c.MinVolumeSize <= 0 {
+		return fmt.Errorf("min volume size must be positive")
+	}
+	if c.DefaultVolumeSize < c.MinVolumeSize {
+		return fmt.Errorf("default volume size must not be smaller than the min volume size")
+	}
+	if c.TopologyKey == "" {
+		return fmt.Errorf("topology key must not be empty")
+	}
+	if c.LogVerbosity < 0 {
+		return fmt.Errorf("log verbosity must not be negative")
+	}
+	if c.LogLevelAddress != "" && !isLoopbackAddress(c.LogLevelAddress) {
+		return fmt.Errorf("log level address must be a loopback address like 127.0.0.1:9190")
+	}
+	if c.PoolReservePercent < 0 || c.PoolReservePercent > 99 {
+		return fmt.Errorf("pool reserve percent must be between 0 and 99")
+	}
+	return nil
+}
+
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// BindFlags registers the settings shared by all commands.
+func (c *Config) BindFlags(flags *pflag.FlagSet) {
+	d := Default()
+	flags.StringVar(&c.Endpoint, "endpoint", d.Endpoint, "csi endpoint to listen on, e.g. unix:///run/csi/socket (env CSI_ENDPOINT)")
+	flags.StringVar(&c.DriverName, "driver-name", d.DriverName, "name of the csi driver, allows to run multiple independent instances")
+	flags.IntVar(&c.LogVerbosity, "log-verbosity", d.LogVerbosity, "log verbosity, can be changed at runtime via the /loglevel endpoint, see --log-level-address")
+	flags.StringVar(&c.LogLevelAddress, "log-level-address", d.LogLevelAddress, "loopback address to serve the unauthenticated /loglevel endpoint on, e.g. 127.0.0.1:9190 (disabled if empty)")
+	flags.StringVar(&c.MetricsAddress, "metrics-address", d.MetricsAddress, "address to expose prometheus metrics on, e.g. :9189 (disabled if empty)")
+	flags.StringVar(&c.OTLPEndpoint, "otlp-endpoint", d.OTLPEndpoint, "otlp grpc endpoint to export traces to, e.g. otel-collector:4317 (disabled if empty)")
+	flags.BoolVar(&c.OTLPInsecure, "otlp-insecure", d.OTLPInsecure, "disable tls for the otlp endpoint")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", d.ShutdownTimeout, "time to wait for in-flight requests on SIGTERM or SIGINT before forcing the shutdown")
+	flags.DurationVar(&c.CommandTimeout, "command-timeout", d.CommandTimeout, "timeout for executed commands like iscsiadm")
+	flags.StringVar(&c.TopologyKey, "topology-key", d.TopologyKey, "topology segment the volumes are constrained to")
+}
+
+// BindControllerFlags registers the settings only used by the controller.
+func (c *Config) BindControllerFlags(flags *pflag.FlagSet) {
+	d := Default()
+	flags.Var(&c.DefaultVolumeSize, "default-volume-size", "size of volumes without requested capacity, e.g. 1Gi")
+	flags.Var(&c.MinVolumeSize, "min-volume-size", "minimal size of created volumes, e.g. 1Mi")
+	flags.DurationVar(&c.ApiTimeout, "api-timeout", d.ApiTimeout, "timeout for requests to the TrueNAS API")
+	flags.StringVar(&c.SecretsDir, "secrets-dir", d.SecretsDir, "directory with a mounted secret used for requests that do not carry secrets, like ControllerGetVolume")
+	flags.IntVar(&c.PoolReservePercent, "pool-reserve-percent", d.PoolReservePercent, "share of every pool in percent that is kept free when creating or expanding volumes, e.g. 10")
+}
+
+// BindNodeFlags registers the settings only used by the node.
+func (c *Config) BindNodeFlags(flags *pflag.FlagSet) {
+	d := Default()
+	flags.StringVar(&c.NodeId, "node-id", d.NodeId, "id of the node (env KUBE_NODE_NAME)")
+	flags.StringVar(&c.Zone, "zone", d.Zone, "value of the topology segment of the node, e.g. zone-a")
+	flags.BoolVar(&c.TopologyFromNodeLabels, "topology-from-node-labels", d.TopologyFromNodeLabels, "read the zone from the label of the kubernetes node named like the topology key, if --zone is not set")
+	flags.BoolVar(&c.NodeDoctor, "node-doctor", d.NodeDoctor, "check iscsiadm, iscsid, sysfs and the file system tools on startup and log the missing ones")
+	// the node comments and imports volumes when publishing them
+	flags.DurationVar(&c.ApiTimeout, "api-timeout", d.ApiTimeout, "timeout for requests to the TrueNAS API")
+}
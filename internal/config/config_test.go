@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Config_Load(t *testing.T) {
+	file := path.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(`
+endpoint: unix:///from/file
+driverName: second.truenas.csi.choffmeister.de
+defaultVolumeSize: 2Gi
+shutdownTimeout: 1m
+metricsAddress: ":9000"
+`), 0o644))
+	t.Setenv("CSI_ENDPOINT", "unix:///from/env")
+	t.Setenv("KUBE_NODE_NAME", "node-1")
+
+	cfg := Default()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	cfg.BindFlags(flags)
+	cfg.BindControllerFlags(flags)
+	assert.NoError(t, flags.Parse([]string{"--metrics-address=:9189", "--min-volume-size=4Mi"}))
+	assert.NoError(t, cfg.Load(flags, file))
+
+	assert.Equal(t, "unix:///from/env", cfg.Endpoint)
+	assert.Equal(t, "node-1", cfg.NodeId)
+	assert.Equal(t, "second.truenas.csi.choffmeister.de", cfg.DriverName)
+	assert.Equal(t, Size(2*1024*1024*1024), cfg.DefaultVolumeSize)
+	assert.Equal(t, Size(4*1024*1024), cfg.MinVolumeSize)
+	assert.Equal(t, time.Minute, cfg.ShutdownTimeout)
+	assert.Equal(t, 10*time.Second, cfg.CommandTimeout)
+	assert.Equal(t, ":9189", cfg.MetricsAddress)
+}
+
+func Test_Config_Validate(t *testing.T) {
+	cfg := Default()
+	cfg.DefaultVolumeSize = 1
+	assert.Error(t, cfg.Validate())
+	cfg = Default()
+	cfg.PoolReservePercent = 100
+	assert.Error(t, cfg.Validate())
+	cfg = Default()
+	cfg.LogLevelAddress = ":9190"
+	assert.Error(t, cfg.Validate())
+	cfg.LogLevelAddress = "127.0.0.1:9190"
+	assert.NoError(t, cfg.Validate())
+	cfg.LogLevelAddress = "localhost:9190"
+	assert.NoError(t, cfg.Validate())
+}
+
+func Test_ParseSize(t *testing.T) {
+	for input, expected := range map[string]Size{
+		"1024": 1024,
+		"1Ki":  1024,
+		"1Gi":  1024 * 1024 * 1024,
+		"1G":   1000 * 1000 * 1000,
+		"5Mi":  5 * 1024 * 1024,
+	} {
+		size, err := ParseSize(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, size, input)
+	}
+	_, err := ParseSize("1Xi")
+	assert.Error(t, err)
+	_, err = ParseSize("-1")
+	assert.Error(t, err)
+}
+
+func Test_Config_CommandFlags(t *testing.T) {
+	cfg := Default()
+	controller := pflag.NewFlagSet("controller", pflag.ContinueOnError)
+	cfg.BindControllerFlags(controller)
+	node := pflag.NewFlagSet("node", pflag.ContinueOnError)
+	cfg.BindNodeFlags(node)
+
+	for _, name := range []string{"default-volume-size", "min-volume-size", "secrets-dir", "pool-reserve-percent"} {
+		assert.NotNil(t, controller.Lookup(name), name)
+		assert.Nil(t, node.Lookup(name), name)
+	}
+	for _, name := range []string{"node-id", "zone", "node-doctor"} {
+		assert.Nil(t, controller.Lookup(name), name)
+		assert.NotNil(t, node.Lookup(name), name)
+	}
+}
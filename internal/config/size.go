@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+var _ pflag.Value = (*Size)(nil)
+var _ yaml.Unmarshaler = (*Size)(nil)
+
+// Size is a number of bytes that can be given either as plain number or with a
+// binary (Ki, Mi, Gi, Ti) or decimal (K, M, G, T) suffix like kubernetes quantities.
+type Size int64
+
+func ParseSize(str string) (Size, error) {
+	str = strings.TrimSpace(str)
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"K", 1000}, {"k", 1000}, {"M", 1000 * 1000}, {"G", 1000 * 1000 * 1000}, {"T", 1000 * 1000 * 1000 * 1000},
+	}
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSuffix(str, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	return Size(value * factor), nil
+}
+
+func (s *Size) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *Size) Set(str string) error {
+	size, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+func (s *Size) Type() string {
+	return "size"
+}
+
+func (s *Size) UnmarshalYAML(node *yaml.Node) error {
+	return s.Set(node.Value)
+}
@@ -0,0 +1,61 @@
+// Package doctor holds the results of the checks the doctor command runs
+// against the setup of the driver and prints them for operators.
+package doctor
+
+import (
+	"fmt"
+	"io"
+)
+
+// Result of a single check.
+type Result struct {
+	// Check names what has been checked, e.g. "iscsi portal"
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	// Warning marks a passed check whose optional feature is unavailable
+	Warning bool   `json:"warning,omitempty"`
+	Message string `json:"message"`
+	// Hint tells the operator how to fix a failed check
+	Hint string `json:"hint,omitempty"`
+}
+
+func Pass(check string, message string) Result {
+	return Result{Check: check, Passed: true, Message: message}
+}
+
+func Fail(check string, message string, hint string) Result {
+	return Result{Check: check, Passed: false, Message: message, Hint: hint}
+}
+
+// Warn reports a missing optional prerequisite, which does not fail the doctor.
+func Warn(check string, message string, hint string) Result {
+	return Result{Check: check, Passed: true, Warning: true, Message: message, Hint: hint}
+}
+
+// Failed returns the number of failed checks.
+func Failed(results []Result) int {
+	failed := 0
+	for _, result := range results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Print writes one line per result, followed by the hint for failed checks and
+// warnings.
+func Print(w io.Writer, results []Result) {
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		} else if result.Warning {
+			status = "WARN"
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, result.Check, result.Message)
+		if (!result.Passed || result.Warning) && result.Hint != "" {
+			fmt.Fprintf(w, "       %s\n", result.Hint)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "csi_driver_truenas"
+
+// nolint: gochecknoglobals
+var (
+	Registry = prometheus.NewRegistry()
+
+	grpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of handled gRPC requests.",
+	}, []string{"method", "code"})
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Duration of handled gRPC requests.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method"})
+
+	truenasRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "truenas_api_requests_total",
+		Help:      "Number of requests sent to the TrueNAS API.",
+	}, []string{"method", "endpoint", "error_class"})
+	truenasRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "truenas_api_request_duration_seconds",
+		Help:      "Duration of requests sent to the TrueNAS API.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "command_executions_total",
+		Help:      "Number of executed commands like iscsiadm.",
+	}, []string{"command", "exit_code"})
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Duration of executed commands like iscsiadm.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		grpcRequestsTotal,
+		grpcRequestDuration,
+		truenasRequestsTotal,
+		truenasRequestDuration,
+		commandsTotal,
+		commandDuration,
+	)
+}
+
+// Error classes of TrueNAS API requests.
+const (
+	ErrorClassNone      = "none"
+	ErrorClassNetwork   = "network"
+	ErrorClassClient    = "client"
+	ErrorClassServer    = "server"
+	ErrorClassUnmarshal = "unmarshal"
+)
+
+func ObserveGRPCRequest(method string, code string, duration time.Duration) {
+	grpcRequestsTotal.WithLabelValues(method, code).Inc()
+	grpcRequestDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+func ObserveTruenasRequest(method string, endpoint string, errorClass string, duration time.Duration) {
+	truenasRequestsTotal.WithLabelValues(method, endpoint, errorClass).Inc()
+	truenasRequestDuration.WithLabelValues(method, endpoint).Observe(duration.Seconds())
+}
+
+func ObserveCommand(command string, exitCode int, duration time.Duration) {
+	commandsTotal.WithLabelValues(command, strconv.Itoa(exitCode)).Inc()
+	commandDuration.WithLabelValues(command).Observe(duration.Seconds())
+}
+
+// RegisterISCSISessions exposes the number of active iSCSI sessions, which is
+// determined by the given function whenever the metrics are scraped.
+func RegisterISCSISessions(count func() (int, error)) error {
+	return Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "iscsi_sessions",
+		Help:      "Number of active iSCSI sessions on the node.",
+	}, func() float64 {
+		n, err := count()
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	}))
+}
+
+// Serve starts the metrics listener in the background. The routes are served
+// next to /metrics, e.g. the readiness of the node.
+func Serve(address string, routes map[string]http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for metrics on %s: %w", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	for path, handler := range routes {
+		mux.Handle(path, handler)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener) // nolint: errcheck
+	return server, nil
+}
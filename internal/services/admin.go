@@ -0,0 +1,69 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/backends/truenas"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+)
+
+// AdminBackendNames returns the names of the backends within the secrets, or a
+// single empty name for plain secrets.
+func AdminBackendNames(secrets map[string]string) []string {
+	names := backendNames(secrets)
+	if len(names) == 0 {
+		return []string{""}
+	}
+	return names
+}
+
+// NewAdminBackend creates the backend with the given name for the commands
+// operators use to inspect and manage volumes.
+func NewAdminBackend(cfg config.Config, secrets map[string]string, backendName string) (*truenas.TruenasBackend, error) {
+	if backendName != "" && !containsString(backendNames(secrets), backendName) {
+		return nil, fmt.Errorf("unknown backend %s", backendName)
+	}
+	backend, err := NewBackendForControllerGetVolume(cfg, secretsForBackend(secrets, backendName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create backend: %v", err)
+	}
+	truenasBackend, ok := backend.(*truenas.TruenasBackend)
+	if !ok {
+		return nil, fmt.Errorf("backend %s is not a truenas backend", backendName)
+	}
+	return truenasBackend, nil
+}
+
+// ResolveAdminVolume parses the volume id and creates its backend. Plain volume
+// ids do not name their backend, so the given backend name is used for them.
+func ResolveAdminVolume(cfg config.Config, secrets map[string]string, volumeId string, backendName string) (*truenas.TruenasBackend, backends.VolumeId, error) {
+	id, err := backends.ParseVolumeId(volumeId)
+	if err != nil {
+		return nil, backends.VolumeId{}, err
+	}
+	if id.IsPlain() {
+		id.Backend = backendName
+	}
+	backend, err := NewAdminBackend(cfg, secrets, id.Backend)
+	if err != nil {
+		return nil, backends.VolumeId{}, err
+	}
+	if !id.BelongsTo(backend) {
+		return nil, backends.VolumeId{}, fmt.Errorf("volume %s belongs to a different backend", volumeId)
+	}
+	return backend, id, nil
+}
+
+// DiagnoseBackend checks the secrets of the backend with the given name and the
+// given parent datasets of storage classes against the NAS. Secrets that cannot
+// be loaded make up a failed check themselves.
+func DiagnoseBackend(ctx context.Context, cfg config.Config, secrets map[string]string, backendName string, parentDatasets []string) []doctor.Result {
+	backend, err := NewAdminBackend(cfg, secrets, backendName)
+	if err != nil {
+		return []doctor.Result{doctor.Fail("secrets", err.Error(), "see the README for the required secrets")}
+	}
+	return append([]doctor.Result{doctor.Pass("secrets", "all required secrets are present")}, backend.Diagnose(ctx, parentDatasets...)...)
+}
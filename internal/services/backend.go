@@ -5,67 +5,92 @@ import (
 
 	"github.com/choffmeister/csi-driver-truenas/internal/backends"
 	"github.com/choffmeister/csi-driver-truenas/internal/backends/truenas"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
 )
 
-func NewBackend() (backends.Backend, error) {
-	backend := truenas.NewTruenasBackend()
+func NewBackend(cfg config.Config) (backends.Backend, error) {
+	backend := truenas.NewTruenasBackend(cfg.DriverName, cfg.PoolReservePercent)
 	return &backend, nil
 }
 
-func NewBackendForCreateVolume(parameters map[string]string, secrets map[string]string) (backends.Backend, error) {
-	backend, err := NewBackend()
-	if err != nil {
-		return nil, err
-	}
-	if err := backend.LoadParameters(parameters); err != nil {
-		return nil, fmt.Errorf("unable load storage class parameters: %v", err)
-	}
-	if err := backend.LoadSecrets(secrets); err != nil {
-		return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
-	}
-	return backend, nil
+func NewBackendForCreateVolume(cfg config.Config, parameters map[string]string, secrets map[string]string) (backends.Backend, error) {
+	return backendCache.GetOrCreate(cfg, parameters, secrets, func() (backends.Backend, error) {
+		backend, err := NewBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.LoadParameters(parameters); err != nil {
+			return nil, fmt.Errorf("unable load storage class parameters: %v", err)
+		}
+		if err := backend.LoadSecrets(secrets); err != nil {
+			return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
+		}
+		return backend, nil
+	})
 }
 
-func NewBackendForDeleteVolume(secrets map[string]string) (backends.Backend, error) {
-	backend, err := NewBackend()
-	if err != nil {
-		return nil, err
-	}
-	if err := backend.LoadSecrets(secrets); err != nil {
-		return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
-	}
-	return backend, nil
+func NewBackendForDeleteVolume(cfg config.Config, secrets map[string]string) (backends.Backend, error) {
+	return backendCache.GetOrCreate(cfg, nil, secrets, func() (backends.Backend, error) {
+		backend, err := NewBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.LoadSecrets(secrets); err != nil {
+			return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
+		}
+		return backend, nil
+	})
 }
 
-func NewBackendForControllerExpandVolume(secrets map[string]string) (backends.Backend, error) {
-	backend, err := NewBackend()
-	if err != nil {
-		return nil, err
-	}
-	if err := backend.LoadSecrets(secrets); err != nil {
-		return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
+func NewBackendForControllerExpandVolume(cfg config.Config, secrets map[string]string) (backends.Backend, error) {
+	return backendCache.GetOrCreate(cfg, nil, secrets, func() (backends.Backend, error) {
+		backend, err := NewBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.LoadSecrets(secrets); err != nil {
+			return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
+		}
+		return backend, nil
+	})
+}
+
+func NewBackendForControllerGetVolume(cfg config.Config, secrets map[string]string) (backends.Backend, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("the controller has not been configured with secrets to access the volumes")
 	}
-	return backend, nil
+	return backendCache.GetOrCreate(cfg, nil, secrets, func() (backends.Backend, error) {
+		backend, err := NewBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.LoadSecrets(secrets); err != nil {
+			return nil, fmt.Errorf("unable load controller secrets: %v", err)
+		}
+		return backend, nil
+	})
 }
 
-func NewBackendForNodeExpandVolume() (backends.Backend, error) {
-	return NewBackend()
+func NewBackendForNodeExpandVolume(cfg config.Config) (backends.Backend, error) {
+	return NewBackend(cfg)
 }
 
-func NewBackendForNodePublish(context map[string]string, secrets map[string]string) (backends.Backend, error) {
-	backend, err := NewBackend()
-	if err != nil {
-		return nil, err
-	}
-	if err := backend.LoadPublishContext(context); err != nil {
-		return nil, fmt.Errorf("unable load publish context: %v", err)
-	}
-	if err := backend.LoadSecrets(secrets); err != nil {
-		return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
-	}
-	return backend, nil
+// NewBackendForNodePublish returns the backend for the given secrets. The
+// publish context is specific to a single volume and therefore not loaded into
+// the shared backend.
+func NewBackendForNodePublish(cfg config.Config, secrets map[string]string) (backends.Backend, error) {
+	return backendCache.GetOrCreate(cfg, nil, secrets, func() (backends.Backend, error) {
+		backend, err := NewBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.LoadSecrets(secrets); err != nil {
+			return nil, fmt.Errorf("unable load storage class provisioner secrets: %v", err)
+		}
+		return backend, nil
+	})
 }
 
-func NewBackendForNodeUnpublish() (backends.Backend, error) {
-	return NewBackend()
+func NewBackendForNodeUnpublish(cfg config.Config) (backends.Backend, error) {
+	return NewBackend(cfg)
 }
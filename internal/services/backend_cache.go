@@ -0,0 +1,142 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+)
+
+const backendCacheSize = 64
+
+// nolint: gochecknoglobals
+var backendCache = NewBackendCache(backendCacheSize)
+
+// BackendCache keeps fully loaded backends around, so that consecutive requests
+// with the same secrets reuse the same http client and its connections.
+// Backends are never mutated after they have been loaded, which makes it safe to
+// hand out the same instance to concurrent requests.
+type BackendCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*backendCacheEntry
+	// maps the identity of a backend (the NAS and the parent dataset) to the hash
+	// of the secrets it was last loaded with
+	identities map[string]string
+	tick       uint64
+}
+
+type backendCacheEntry struct {
+	identity    string
+	secretsHash string
+	backend     backends.Backend
+	lastUsed    uint64
+}
+
+func NewBackendCache(size int) *BackendCache {
+	return &BackendCache{
+		size:       size,
+		entries:    map[string]*backendCacheEntry{},
+		identities: map[string]string{},
+	}
+}
+
+// GetOrCreate returns the cached backend for the given inputs or creates it with
+// the given function. The inputs identify the backend only, so all volumes of a
+// backend share it. When the secrets of a known backend change, the backend
+// created with the old secrets is evicted.
+func (c *BackendCache) GetOrCreate(cfg config.Config, parameters map[string]string, secrets map[string]string, create func() (backends.Backend, error)) (backends.Backend, error) {
+	hash := hashBackendInputs(map[string]string{"driver-name": cfg.DriverName}, withoutVolumeMetadata(parameters), secrets)
+	secretsHash := hashBackendInputs(secrets)
+	identity := cfg.DriverName + "\x00" + secrets["truenas-url"] + "\x00" + secrets["truenas-parent-dataset"]
+
+	c.mutex.Lock()
+	c.tick++
+	if entry, ok := c.entries[hash]; ok {
+		entry.lastUsed = c.tick
+		c.mutex.Unlock()
+		return entry.backend, nil
+	}
+	c.mutex.Unlock()
+
+	backend, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if entry, ok := c.entries[hash]; ok {
+		// a concurrent request was faster
+		return entry.backend, nil
+	}
+	if previousSecretsHash, ok := c.identities[identity]; ok && previousSecretsHash != secretsHash {
+		for h, entry := range c.entries {
+			if entry.identity == identity && entry.secretsHash == previousSecretsHash {
+				delete(c.entries, h)
+			}
+		}
+	}
+	if len(c.entries) >= c.size {
+		c.evictLeastRecentlyUsed()
+	}
+	c.entries[hash] = &backendCacheEntry{identity: identity, secretsHash: secretsHash, backend: backend, lastUsed: c.tick}
+	c.identities[identity] = secretsHash
+	return backend, nil
+}
+
+// Len returns the number of cached backends.
+func (c *BackendCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+func (c *BackendCache) evictLeastRecentlyUsed() {
+	oldestHash := ""
+	var oldest *backendCacheEntry
+	for hash, entry := range c.entries {
+		if oldest == nil || entry.lastUsed < oldest.lastUsed {
+			oldestHash = hash
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		delete(c.entries, oldestHash)
+	}
+}
+
+// withoutVolumeMetadata drops the pvc and pv names the csi-provisioner adds to
+// the parameters, so that the volumes of a storage class share their backend.
+func withoutVolumeMetadata(parameters map[string]string) map[string]string {
+	result := map[string]string{}
+	for key, value := range parameters {
+		if !strings.HasPrefix(key, "csi.storage.k8s.io/") {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func hashBackendInputs(inputs ...map[string]string) string {
+	h := sha256.New()
+	for _, m := range inputs {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write([]byte(m[k]))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/backends/truenas"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BackendCache(t *testing.T) {
+	cfg := config.Default()
+	cache := NewBackendCache(2)
+	created := 0
+	create := func() (backends.Backend, error) {
+		created++
+		backend := truenas.NewTruenasBackend(cfg.DriverName, cfg.PoolReservePercent)
+		return &backend, nil
+	}
+	secrets := map[string]string{"truenas-url": "https://nas", "truenas-api-key": "1"}
+
+	b1, err := cache.GetOrCreate(cfg, nil, secrets, create)
+	assert.NoError(t, err)
+	b2, err := cache.GetOrCreate(cfg, nil, map[string]string{"truenas-api-key": "1", "truenas-url": "https://nas"}, create)
+	assert.NoError(t, err)
+	assert.Same(t, b1, b2)
+	assert.Equal(t, 1, created)
+
+	// same secrets with parameters are cached separately
+	_, err = cache.GetOrCreate(cfg, map[string]string{"a": "b"}, secrets, create)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, created)
+	assert.Equal(t, 2, cache.Len())
+	// the pvc metadata of the csi-provisioner is not part of the key
+	_, err = cache.GetOrCreate(cfg, map[string]string{"a": "b", "csi.storage.k8s.io/pvc/name": "data-1"}, secrets, create)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, created)
+
+	// rotating the api key evicts all backends loaded with the old one
+	b3, err := cache.GetOrCreate(cfg, nil, map[string]string{"truenas-url": "https://nas", "truenas-api-key": "2"}, create)
+	assert.NoError(t, err)
+	assert.NotSame(t, b1, b3)
+	assert.Equal(t, 1, cache.Len())
+
+	// the cache is bounded
+	_, err = cache.GetOrCreate(cfg, nil, map[string]string{"truenas-url": "https://nas2"}, create)
+	assert.NoError(t, err)
+	_, err = cache.GetOrCreate(cfg, nil, map[string]string{"truenas-url": "https://nas3"}, create)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func Test_NewBackendForNodePublish(t *testing.T) {
+	cfg := config.Default()
+	secrets := map[string]string{
+		"truenas-url":            "https://nas-publish",
+		"truenas-api-key":        "1",
+		"truenas-parent-dataset": "tank/k8s",
+		"iscsi-portal-ip":        "10.0.0.1",
+		"iscsi-base-iqn":         "iqn.2005-10.org.freenas.ctl",
+		"iscsi-portal-id":        "1",
+		"iscsi-initiator-id":     "1",
+	}
+
+	// volumes of the same backend share it
+	b1, err := NewBackendForNodePublish(cfg, secrets)
+	assert.NoError(t, err)
+	b2, err := NewBackendForNodePublish(cfg, secrets)
+	assert.NoError(t, err)
+	assert.Same(t, b1, b2)
+}
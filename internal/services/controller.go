@@ -2,8 +2,12 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
 	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -12,10 +16,21 @@ import (
 
 var _ proto.ControllerServer = (*ControllerService)(nil)
 
-type ControllerService struct{}
+type ControllerService struct {
+	cfg       config.Config
+	inFlight  *InFlight
+	placement *Placement
+	// secrets for requests that do not carry any, like ControllerGetVolume
+	secrets map[string]string
+}
 
-func NewControllerService() *ControllerService {
-	return &ControllerService{}
+func NewControllerService(cfg config.Config, secrets map[string]string) *ControllerService {
+	return &ControllerService{
+		cfg:       cfg,
+		inFlight:  NewInFlight(),
+		placement: NewPlacement(),
+		secrets:   secrets,
+	}
 }
 
 func (s *ControllerService) CreateVolume(ctx context.Context, req *proto.CreateVolumeRequest) (*proto.CreateVolumeResponse, error) {
@@ -25,53 +40,148 @@ func (s *ControllerService) CreateVolume(ctx context.Context, req *proto.CreateV
 	if len(req.VolumeCapabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "missing volume capabilities")
 	}
-	size, _, ok := volumeSizeFromCapacityRange(req.GetCapacityRange())
+	size, limit, ok := volumeSizeFromCapacityRange(req.GetCapacityRange(), s.cfg)
 	if !ok {
 		return nil, status.Error(codes.OutOfRange, "invalid capacity range")
 	}
 	for i, cap := range req.VolumeCapabilities {
-		if !isCapabilitySupported(cap) {
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("capability at index %d is not supported", i))
+		if err := checkCapability(cap); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("capability at index %d is not supported: %v", i, err))
 		}
 	}
-
-	backend, err := NewBackendForCreateVolume(req.Parameters, req.Secrets)
+	secrets, err := backends.ExpandTemplates("secret", req.Secrets, req.Parameters)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to create backend: %v", err))
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to expand secrets: %v", err))
+	}
+	parameters, err := backends.ExpandTemplates("parameter", req.Parameters, req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to expand parameters: %v", err))
+	}
+	// the lock is taken before the placement, as concurrent requests for the
+	// same name could end up on different backends otherwise
+	release, err := s.inFlight.Acquire(req.Name, "CreateVolume")
+	if err != nil {
+		return nil, err
 	}
-	id, err := backend.CreateVolume(ctx, req.Name, size)
+	defer release()
+	selected, err := s.findCreatedVolume(ctx, req.Name, parameters, secrets)
 	if err != nil {
+		return nil, err
+	}
+	if selected == nil {
+		selected, err = s.placement.Select(ctx, parameters, secrets, req.AccessibilityRequirements, s.cfg.TopologyKey, func(b placementBackend) (int64, error) {
+			backend, err := NewBackendForCreateVolume(s.cfg, parameters, b.Secrets)
+			if err != nil {
+				return 0, err
+			}
+			return backend.GetAvailableCapacity(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	backend, err := NewBackendForCreateVolume(s.cfg, parameters, selected.Secrets)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to create backend: %v", err))
+	}
+	dataset, size, err := backend.CreateVolume(ctx, req.Name, size, limit)
+	if errors.Is(err, backends.ErrVolumeAlreadyExists) {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	} else if errors.Is(err, backends.ErrInsufficientCapacity) {
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("unable to create volume: %v", err))
+	} else if errors.Is(err, backends.ErrVolumeSizeOutOfRange) {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("unable to create volume: %v", err))
+	} else if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to create volume: %v", err))
 	}
+	id := backends.VolumeId{
+		Backend:  selected.Name,
+		Identity: backend.Identity(),
+		Protocol: backends.ProtocolISCSI,
+		Dataset:  dataset,
+	}
+	// TODO allow to customize format
+	iqn := id.TargetIQN(*backend.GetISCSISecrets())
 
-	utils.Info.Printf("Created volume %s\n", id)
+	utils.LoggerFromContext(ctx).Info("Created volume", "volumeId", id.String(), "backend", selected.Name, "zone", selected.Zone)
 	resp := &proto.CreateVolumeResponse{
 		Volume: &proto.Volume{
-			VolumeId:      id,
+			VolumeId:      id.String(),
 			CapacityBytes: size,
 			VolumeContext: map[string]string{
-				// TODO allow to customize format
-				"iscsi-iqn": fmt.Sprintf("%s:%s", backend.GetISCSISecrets().BaseIQN, req.Name),
+				"iscsi-iqn": iqn,
 			},
 		},
 	}
+	if selected.Zone != "" {
+		resp.Volume.AccessibleTopology = []*proto.Topology{
+			{Segments: map[string]string{s.cfg.TopologyKey: selected.Zone}},
+		}
+	}
 	return resp, nil
 }
 
+// findCreatedVolume returns the backend that already has a volume of the given
+// name, e.g. from an earlier attempt of a retried request, which the placement
+// could put on another backend otherwise. It returns nil if there is none.
+func (s *ControllerService) findCreatedVolume(ctx context.Context, name string, parameters map[string]string, secrets map[string]string) (*placementBackend, error) {
+	all, err := placementBackends(secrets)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// a single backend handles retries itself
+	if len(all) == 1 {
+		return nil, nil
+	}
+	for i, b := range all {
+		backend, err := NewBackendForCreateVolume(s.cfg, parameters, b.Secrets)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to create backend %s: %v", b.Name, err))
+		}
+		_, err = backend.GetVolume(ctx, backend.VolumeDataset(name))
+		if errors.Is(err, backends.ErrVolumeNotFound) {
+			continue
+		} else if err != nil {
+			return nil, status.Error(codes.Unavailable, fmt.Sprintf("unable to look for volume %s on backend %s: %v", name, b.Name, err))
+		}
+		return &all[i], nil
+	}
+	return nil, nil
+}
+
 func (s *ControllerService) DeleteVolume(ctx context.Context, req *proto.DeleteVolumeRequest) (*proto.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing volume id")
 	}
+	id, err := backends.ParseVolumeId(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	release, err := s.inFlight.Acquire(id.Name(), "DeleteVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	backend, err := NewBackendForDeleteVolume(req.Secrets)
+	secrets, err := s.findVolumeBackend(ctx, &id, req.Secrets)
+	if errors.Is(err, backends.ErrVolumeNotFound) {
+		utils.LoggerFromContext(ctx).Info("Volume already deleted")
+		return &proto.DeleteVolumeResponse{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to find backend of volume: %v", err))
+	}
+	backend, err := NewBackendForDeleteVolume(s.cfg, secrets)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to create backend: %v", err))
 	}
-	if err := backend.DeleteVolume(ctx, req.VolumeId); err != nil {
+	if !id.BelongsTo(backend) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s belongs to a different backend", req.VolumeId))
+	}
+	if err := backend.DeleteVolume(ctx, id.Dataset); err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unable to delete volume: %v", err))
 	}
 
-	utils.Info.Printf("Deleted volume %s\n", req.VolumeId)
+	utils.LoggerFromContext(ctx).Info("Deleted volume")
 	resp := &proto.DeleteVolumeResponse{}
 	return resp, nil
 }
@@ -85,20 +195,51 @@ func (s *ControllerService) ControllerUnpublishVolume(ctx context.Context, req *
 }
 
 func (s *ControllerService) ControllerExpandVolume(ctx context.Context, req *proto.ControllerExpandVolumeRequest) (*proto.ControllerExpandVolumeResponse, error) {
-	size, _, ok := volumeSizeFromCapacityRange(req.GetCapacityRange())
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing capacity range")
+	}
+	size, limit, ok := volumeSizeFromCapacityRange(req.GetCapacityRange(), s.cfg)
 	if !ok {
 		return nil, status.Error(codes.OutOfRange, "invalid capacity range")
 	}
+	id, err := backends.ParseVolumeId(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	release, err := s.inFlight.Acquire(id.Name(), "ControllerExpandVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	backend, err := NewBackendForControllerExpandVolume(req.Secrets)
+	secrets, err := s.findVolumeBackend(ctx, &id, req.Secrets)
+	if errors.Is(err, backends.ErrVolumeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to find backend of volume: %v", err))
+	}
+	backend, err := NewBackendForControllerExpandVolume(s.cfg, secrets)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create backend: %v", err))
 	}
-	if err := backend.ExpandVolume(ctx, req.VolumeId, size); err != nil {
+	if !id.BelongsTo(backend) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s belongs to a different backend", req.VolumeId))
+	}
+	size, err = backend.ExpandVolume(ctx, id.Dataset, size, limit)
+	if errors.Is(err, backends.ErrVolumeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if errors.Is(err, backends.ErrInsufficientCapacity) {
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("unable to resize device: %v", err))
+	} else if errors.Is(err, backends.ErrVolumeSizeOutOfRange) {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("unable to resize device: %v", err))
+	} else if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to resize device: %v", err))
 	}
 
-	utils.Info.Printf("Expanded volume %s\n", req.VolumeId)
+	utils.LoggerFromContext(ctx).Info("Expanded volume", "size", size)
 	resp := &proto.ControllerExpandVolumeResponse{
 		CapacityBytes:         size,
 		NodeExpansionRequired: true,
@@ -107,7 +248,66 @@ func (s *ControllerService) ControllerExpandVolume(ctx context.Context, req *pro
 }
 
 func (s *ControllerService) ValidateVolumeCapabilities(ctx context.Context, req *proto.ValidateVolumeCapabilitiesRequest) (*proto.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not supported: ValidateVolumeCapabilities")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing volume capabilities")
+	}
+	id, err := backends.ParseVolumeId(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	allSecrets := req.Secrets
+	if len(allSecrets) == 0 {
+		allSecrets = s.secrets
+	}
+	secrets, err := s.findVolumeBackend(ctx, &id, allSecrets)
+	if errors.Is(err, backends.ErrVolumeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to find backend of volume: %v", err))
+	}
+	backend, err := NewBackendForControllerGetVolume(s.cfg, secrets)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("unable to create backend: %v", err))
+	}
+	if !id.BelongsTo(backend) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s belongs to a different backend", req.VolumeId))
+	}
+	if _, err := backend.GetVolume(ctx, id.Dataset); errors.Is(err, backends.ErrVolumeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to get volume: %v", err))
+	}
+
+	for i, cap := range req.VolumeCapabilities {
+		if err := checkCapability(cap); err != nil {
+			resp := &proto.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("capability at index %d is not supported: %v", i, err),
+			}
+			return resp, nil
+		}
+	}
+	if err := checkVolumeContext(id.TargetIQN(*backend.GetISCSISecrets()), req.VolumeContext); err != nil {
+		return &proto.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	labels, err := parseLabels(secrets[backendLabelsSecret])
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("malformed secret %s of backend %s: %v", backendLabelsSecret, id.Backend, err))
+	}
+	if err := checkVolumeParameters(labels, req.Parameters); err != nil {
+		return &proto.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	resp := &proto.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &proto.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}
+	return resp, nil
 }
 
 func (s *ControllerService) ListVolumes(ctx context.Context, req *proto.ListVolumesRequest) (*proto.ListVolumesResponse, error) {
@@ -135,13 +335,61 @@ func (s *ControllerService) ControllerGetCapabilities(ctx context.Context, req *
 					},
 				},
 			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_GET_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &proto.ControllerServiceCapability_Rpc{
+					Rpc: &proto.ControllerServiceCapability_RPC{
+						Type: proto.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}
 	return resp, nil
 }
 
 func (s *ControllerService) ControllerGetVolume(ctx context.Context, req *proto.ControllerGetVolumeRequest) (*proto.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not supported: ControllerGetVolume")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+
+	id, err := backends.ParseVolumeId(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	backend, err := NewBackendForControllerGetVolume(s.cfg, secretsForBackend(s.secrets, id.Backend))
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("unable to create backend: %v", err))
+	}
+	if !id.BelongsTo(backend) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s belongs to a different backend", req.VolumeId))
+	}
+	volume, err := backend.GetVolume(ctx, id.Dataset)
+	if errors.Is(err, backends.ErrVolumeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to get volume: %v", err))
+	}
+
+	resp := &proto.ControllerGetVolumeResponse{
+		Volume: &proto.Volume{
+			VolumeId:      req.VolumeId,
+			CapacityBytes: volume.CapacityBytes,
+		},
+		Status: &proto.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: &proto.VolumeCondition{
+				Abnormal: volume.Condition.Abnormal,
+				Message:  volume.Condition.Message,
+			},
+		},
+	}
+	return resp, nil
 }
 
 func (s *ControllerService) CreateSnapshot(ctx context.Context, req *proto.CreateSnapshotRequest) (*proto.CreateSnapshotResponse, error) {
@@ -156,21 +404,68 @@ func (s *ControllerService) ListSnapshots(ctx context.Context, req *proto.ListSn
 	return nil, status.Error(codes.Unimplemented, "not supported: ListSnapshots")
 }
 
-func volumeSizeFromCapacityRange(cr *proto.CapacityRange) (int64, int64, bool) {
+// findVolumeBackend resolves the secrets of the backend that holds the volume.
+// For plain volume ids, which do not name their backend, the plain secrets are
+// searched first and then all named backends. The backend name is filled in.
+func (s *ControllerService) findVolumeBackend(ctx context.Context, id *backends.VolumeId, secrets map[string]string) (map[string]string, error) {
+	names := backendNames(secrets)
+	if !id.IsPlain() {
+		if id.Backend != "" && !containsString(names, id.Backend) {
+			return nil, fmt.Errorf("unknown backend %s", id.Backend)
+		}
+		return secretsForBackend(secrets, id.Backend), nil
+	}
+	if len(names) == 0 {
+		return secrets, nil
+	}
+	for _, name := range append([]string{""}, names...) {
+		backendSecrets := secretsForBackend(secrets, name)
+		backend, err := NewBackendForDeleteVolume(s.cfg, backendSecrets)
+		if err != nil {
+			if name == "" {
+				// the plain secrets are not required to be complete
+				continue
+			}
+			return nil, fmt.Errorf("unable to create backend %s: %v", name, err)
+		}
+		_, err = backend.GetVolume(ctx, id.Dataset)
+		if errors.Is(err, backends.ErrVolumeNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to get volume from backend %s: %v", name, err)
+		}
+		id.Backend = name
+		return backendSecrets, nil
+	}
+	return nil, fmt.Errorf("volume %s not found in backends %s: %w", id.Dataset, strings.Join(names, ", "), backends.ErrVolumeNotFound)
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func volumeSizeFromCapacityRange(cr *proto.CapacityRange, cfg config.Config) (int64, int64, bool) {
+	defaultVolumeSize := int64(cfg.DefaultVolumeSize)
+	minVolumeSize := int64(cfg.MinVolumeSize)
 	if cr == nil {
-		return DefaultVolumeSize, 0, true
+		return defaultVolumeSize, 0, true
 	}
 
 	var minSize int64
 	switch {
 	case cr.RequiredBytes == 0:
-		minSize = DefaultVolumeSize
+		minSize = defaultVolumeSize
 	case cr.RequiredBytes < 0:
 		return 0, 0, false
 	default:
 		minSize = cr.RequiredBytes
-		if minSize < MinVolumeSize {
-			minSize = MinVolumeSize
+		if minSize < minVolumeSize {
+			minSize = minVolumeSize
 		}
 	}
 
@@ -191,15 +486,53 @@ func volumeSizeFromCapacityRange(cr *proto.CapacityRange) (int64, int64, bool) {
 	return minSize, maxSize, true
 }
 
-func isCapabilitySupported(cap *proto.VolumeCapability) bool {
+// supportedFsTypes are the file systems the node formats volumes with.
+var supportedFsTypes = []string{"ext4"}
+
+func checkCapability(cap *proto.VolumeCapability) error {
 	if cap.AccessMode == nil {
-		return false
+		return fmt.Errorf("missing access mode")
 	}
 	if cap.AccessMode.Mode != proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-		return false
+		return fmt.Errorf("access mode %s is not supported", cap.AccessMode.Mode)
 	}
 	if cap.GetBlock() != nil {
-		return false
+		return fmt.Errorf("block access type is not supported")
+	}
+	mount := cap.GetMount()
+	if mount == nil {
+		return fmt.Errorf("missing access type")
+	}
+	if mount.FsType != "" && !containsString(supportedFsTypes, mount.FsType) {
+		return fmt.Errorf("fs type %s is not supported, use one of %s", mount.FsType, strings.Join(supportedFsTypes, ", "))
+	}
+	return nil
+}
+
+// checkVolumeContext makes sure that the volume context, if given, refers to
+// the iscsi target of the volume.
+func checkVolumeContext(targetIQN string, context map[string]string) error {
+	iqn := context["iscsi-iqn"]
+	if iqn != "" && iqn != targetIQN {
+		return fmt.Errorf("volume context iscsi-iqn %s does not match the iqn %s of the volume", iqn, targetIQN)
+	}
+	return nil
+}
+
+// checkVolumeParameters makes sure that the storage class parameters would have
+// allowed to place the volume on its backend.
+func checkVolumeParameters(labels map[string]string, parameters map[string]string) error {
+	switch policy := parameters[placementPolicyParameter]; policy {
+	case "", PlacementPolicyMostFreeSpace, PlacementPolicyRoundRobin, PlacementPolicyLabel:
+	default:
+		return fmt.Errorf("unknown placement policy %s", policy)
+	}
+	selector, err := parseLabels(parameters[backendSelectorParameter])
+	if err != nil {
+		return fmt.Errorf("malformed parameter %s: %v", backendSelectorParameter, err)
+	}
+	if !matchesLabels(labels, selector) {
+		return fmt.Errorf("backend of the volume does not match the parameter %s", backendSelectorParameter)
 	}
-	return true
+	return nil
 }
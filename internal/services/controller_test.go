@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_CheckCapability(t *testing.T) {
+	capability := func(mode proto.VolumeCapability_AccessMode_Mode, fsType string) *proto.VolumeCapability {
+		return &proto.VolumeCapability{
+			AccessType: &proto.VolumeCapability_Mount{Mount: &proto.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: &proto.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	assert.NoError(t, checkCapability(capability(proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "")))
+	assert.NoError(t, checkCapability(capability(proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ext4")))
+	assert.EqualError(t, checkCapability(capability(proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "xfs")), "fs type xfs is not supported, use one of ext4")
+	assert.EqualError(t, checkCapability(capability(proto.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "")), "access mode MULTI_NODE_MULTI_WRITER is not supported")
+	assert.Error(t, checkCapability(&proto.VolumeCapability{
+		AccessType: &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}},
+		AccessMode: &proto.VolumeCapability_AccessMode{Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}))
+	assert.Error(t, checkCapability(&proto.VolumeCapability{}))
+}
+
+func Test_CheckVolumeContextAndParameters(t *testing.T) {
+	iqn := backends.VolumeId{Dataset: "tank/pvc-1"}.TargetIQN(backends.ISCSISecrets{BaseIQN: "iqn.test"})
+	assert.NoError(t, checkVolumeContext(iqn, nil))
+	assert.NoError(t, checkVolumeContext(iqn, map[string]string{"iscsi-iqn": "iqn.test:pvc-1"}))
+	assert.Error(t, checkVolumeContext(iqn, map[string]string{"iscsi-iqn": "iqn.test:pvc-2"}))
+
+	labels := map[string]string{"tier": "fast"}
+	assert.NoError(t, checkVolumeParameters(labels, nil))
+	assert.NoError(t, checkVolumeParameters(labels, map[string]string{"placement-policy": "label", "backend-selector": "tier=fast"}))
+	assert.Error(t, checkVolumeParameters(labels, map[string]string{"backend-selector": "tier=slow"}))
+	assert.Error(t, checkVolumeParameters(labels, map[string]string{"placement-policy": "random"}))
+}
+
+func Test_ControllerInFlight(t *testing.T) {
+	ctx := context.Background()
+	s := NewControllerService(config.Default(), nil)
+	secrets := map[string]string{
+		"truenas-url":            "https://nas-inflight",
+		"truenas-api-key":        "1",
+		"truenas-parent-dataset": "tank/k8s",
+		"iscsi-base-iqn":         "iqn.2005-10.org.freenas.ctl",
+		"iscsi-portal-ip":        "10.0.0.1",
+		"iscsi-portal-id":        "1",
+		"iscsi-initiator-id":     "1",
+	}
+	id := backends.VolumeId{Identity: "abc", Protocol: backends.ProtocolISCSI, Dataset: "tank/k8s/pvc-1"}
+
+	// create, delete and expand of a volume exclude each other
+	release, err := s.inFlight.Acquire("pvc-1", "Test")
+	assert.NoError(t, err)
+	defer release()
+	_, err = s.CreateVolume(ctx, &proto.CreateVolumeRequest{
+		Name:    "pvc-1",
+		Secrets: secrets,
+		VolumeCapabilities: []*proto.VolumeCapability{{
+			AccessType: &proto.VolumeCapability_Mount{Mount: &proto.VolumeCapability_MountVolume{}},
+			AccessMode: &proto.VolumeCapability_AccessMode{Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = s.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: id.String(), Secrets: secrets})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = s.ControllerExpandVolume(ctx, &proto.ControllerExpandVolumeRequest{
+		VolumeId:      id.String(),
+		Secrets:       secrets,
+		CapacityRange: &proto.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// the lock is held by the name, wherever the placement would put the volume
+	multi := map[string]string{
+		"truenas-url.nas-a":            "https://nas-inflight-a",
+		"truenas-url.nas-b":            "https://nas-inflight-b",
+		"truenas-parent-dataset.nas-a": "tank/a",
+		"truenas-parent-dataset.nas-b": "tank/b",
+	}
+	for key, value := range secrets {
+		if key != "truenas-url" && key != "truenas-parent-dataset" {
+			multi[key] = value
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err = s.CreateVolume(ctx, &proto.CreateVolumeRequest{
+			Name:       "pvc-1",
+			Parameters: map[string]string{"placement-policy": "round-robin"},
+			Secrets:    multi,
+			VolumeCapabilities: []*proto.VolumeCapability{{
+				AccessType: &proto.VolumeCapability_Mount{Mount: &proto.VolumeCapability_MountVolume{}},
+				AccessMode: &proto.VolumeCapability_AccessMode{Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	}
+}
@@ -2,25 +2,35 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/choffmeister/csi-driver-truenas/internal/metrics"
+	"github.com/choffmeister/csi-driver-truenas/internal/tracing"
 	"github.com/choffmeister/csi-driver-truenas/internal/utils"
+	"github.com/go-logr/logr"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
-func CreateCSIListener() (net.Listener, error) {
-	endpoint := os.Getenv("CSI_ENDPOINT")
+func CreateCSIListener(endpoint string) (net.Listener, error) {
 	if endpoint == "" {
-		return nil, fmt.Errorf("you need to specify an endpoint via the CSI_ENDPOINT env var")
+		return nil, fmt.Errorf("you need to specify an endpoint via the CSI_ENDPOINT env var or the --endpoint flag")
 	}
 	if !strings.HasPrefix(endpoint, "unix://") {
 		return nil, fmt.Errorf("endpoint must start with unix://")
 	}
-	utils.Debug.Printf("Listening on %s\n", endpoint)
+	utils.Log.V(1).Info("Listening", "endpoint", endpoint)
 	socketFile := strings.TrimPrefix(endpoint, "unix://")
 
 	if err := os.Remove(socketFile); err != nil && !os.IsNotExist(err) {
@@ -30,24 +40,142 @@ func CreateCSIListener() (net.Listener, error) {
 	return net.Listen("unix", socketFile)
 }
 
+// Serve handles requests until a signal is received on the stop channel. The
+// identity service is then marked as not ready and in-flight requests get until
+// the timeout to finish, so that for example iscsi logins are not interrupted
+// midway. A second signal or the timeout forces the server to stop.
+func Serve(server *grpc.Server, listener net.Listener, identityService *IdentityService, stop <-chan os.Signal, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		utils.Log.Info("Received signal, draining in-flight requests", "signal", sig.String(), "timeout", timeout.String())
+	}
+
+	identityService.SetReady(false)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		utils.Log.Info("Stopped gracefully")
+	case sig := <-stop:
+		utils.Log.Info("Received second signal, forcing stop", "signal", sig.String())
+		server.Stop()
+	case <-time.After(timeout):
+		utils.Log.Info("Timed out waiting for in-flight requests, forcing stop")
+		server.Stop()
+	}
+
+	if listener.Addr().Network() == "unix" {
+		if err := os.Remove(listener.Addr().String()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove socket file at %s: %w", listener.Addr().String(), err)
+		}
+	}
+	return nil
+}
+
 func CreateGRPCServer() *grpc.Server {
 	requestLogger := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		isProbe := info.FullMethod == "/csi.v1.Identity/Probe"
 
+		log := utils.Log.WithValues(requestLogValues(info.FullMethod, req)...)
+		ctx = logr.NewContext(ctx, log)
+
 		resp, err := handler(ctx, req)
 		if err != nil {
-			utils.Error.Printf("Handling request %v %v failed: %v\n", info.FullMethod, req, err)
+			log.Error(err, "Handling request failed", "request", req)
 		} else if !isProbe {
-			utils.Debug.Printf("Handled request %v %v", info.FullMethod, req)
+			log.V(1).Info("Handled request", "request", req)
 		}
 		return resp, err
 	}
 
+	requestTracing := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+		}
+		ctx, span := tracing.Start(ctx, info.FullMethod,
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", info.FullMethod),
+		)
+		defer func() {
+			span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+			tracing.End(span, err)
+		}()
+		return handler(ctx, req)
+	}
+
+	requestMetrics := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		metrics.ObserveGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start))
+		return resp, err
+	}
+
 	return grpc.NewServer(
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
+				requestTracing,
+				requestMetrics,
 				requestLogger,
 			),
 		),
 	)
 }
+
+// requestLogValues collects the fields that every log line of a request should
+// carry, so that all lines of a single request can be correlated.
+func requestLogValues(method string, req interface{}) []interface{} {
+	values := []interface{}{"method", method, "requestId", newRequestId()}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		values = append(values, "volumeId", r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		values = append(values, "volumeName", r.GetName())
+	}
+	if r, ok := req.(interface{ GetNodeId() string }); ok && r.GetNodeId() != "" {
+		values = append(values, "nodeId", r.GetNodeId())
+	}
+	return values
+}
+
+func newRequestId() string {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(bs)
+}
+
+var _ propagation.TextMapCarrier = (metadataCarrier)(nil)
+
+// metadataCarrier allows to extract trace context propagated via grpc metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func Test_Serve(t *testing.T) {
+	socketFile := path.Join(t.TempDir(), "csi.sock")
+	listener, err := net.Listen("unix", socketFile)
+	assert.NoError(t, err)
+	// leave removing the socket file to Serve
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	server := CreateGRPCServer()
+	identityService := NewIdentityService(config.Default())
+	proto.RegisterIdentityServer(server, identityService)
+	controllerService := &blockingControllerService{started: make(chan struct{}), release: make(chan struct{})}
+	proto.RegisterControllerServer(server, controllerService)
+	identityService.SetReady(true)
+
+	stop := make(chan os.Signal, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Serve(server, listener, identityService, stop, 5*time.Second)
+	}()
+
+	conn, err := grpc.Dial("unix://"+socketFile, grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	resp, err := proto.NewIdentityClient(conn).Probe(context.Background(), &proto.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Ready.Value)
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := proto.NewControllerClient(conn).ListVolumes(context.Background(), &proto.ListVolumesRequest{})
+		inFlight <- err
+	}()
+	<-controllerService.started
+
+	stop <- syscall.SIGTERM
+	select {
+	case <-errs:
+		t.Fatal("server stopped before the in-flight request completed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.False(t, identityService.isReady())
+	_, err = os.Stat(socketFile)
+	assert.NoError(t, err)
+
+	close(controllerService.release)
+	select {
+	case err := <-inFlight:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("in-flight request did not complete")
+	}
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	_, err = os.Stat(socketFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+type blockingControllerService struct {
+	proto.UnimplementedControllerServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingControllerService) ListVolumes(ctx context.Context, req *proto.ListVolumesRequest) (*proto.ListVolumesResponse, error) {
+	close(s.started)
+	<-s.release
+	return &proto.ListVolumesResponse{}, nil
+}
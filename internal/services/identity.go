@@ -1,20 +1,33 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"net/http"
 	"sync"
 
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
 )
 
 type IdentityService struct {
-	readyMu sync.RWMutex
-	ready   bool
+	name string
+	// topology advertises accessibility constraints, which requires every node
+	// to report its zone
+	topology bool
+	readyMu  sync.RWMutex
+	ready    bool
+	// failed are the checks of the node doctor that did not pass
+	failed []doctor.Result
 }
 
-func NewIdentityService() *IdentityService {
-	return &IdentityService{}
+func NewIdentityService(cfg config.Config) *IdentityService {
+	return &IdentityService{
+		name:     cfg.DriverName,
+		topology: cfg.Zone != "" || cfg.TopologyFromNodeLabels,
+	}
 }
 
 func (s *IdentityService) SetReady(ready bool) {
@@ -23,6 +36,46 @@ func (s *IdentityService) SetReady(ready bool) {
 	s.readyMu.Unlock()
 }
 
+// SetDiagnosis records the failed checks of the node doctor as the reasons why
+// the node is not ready. Only the readiness endpoint reports them, Probe does
+// not, as the liveness probe would restart the node, which does not fix the
+// host.
+func (s *IdentityService) SetDiagnosis(results []doctor.Result) {
+	failed := []doctor.Result{}
+	for _, result := range results {
+		if !result.Passed {
+			failed = append(failed, result)
+		}
+	}
+	s.readyMu.Lock()
+	s.failed = failed
+	s.readyMu.Unlock()
+}
+
+// ReadinessHandler serves 200 once the driver is ready and all checks of the
+// node doctor passed, 503 with the failed checks and their hints otherwise.
+func (s *IdentityService) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.readyMu.RLock()
+		ready := s.ready
+		failed := s.failed
+		s.readyMu.RUnlock()
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready: starting\n"))
+			return
+		}
+		if len(failed) > 0 {
+			buf := &bytes.Buffer{}
+			doctor.Print(buf, failed)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(buf.Bytes())
+			return
+		}
+		_, _ = w.Write([]byte("ready\n"))
+	})
+}
+
 func (s *IdentityService) isReady() bool {
 	s.readyMu.RLock()
 	ready := s.ready
@@ -32,7 +85,7 @@ func (s *IdentityService) isReady() bool {
 
 func (s *IdentityService) GetPluginInfo(ctx context.Context, req *proto.GetPluginInfoRequest) (*proto.GetPluginInfoResponse, error) {
 	resp := &proto.GetPluginInfoResponse{
-		Name:          PluginName,
+		Name:          s.name,
 		VendorVersion: PluginVersion,
 	}
 	return resp, nil
@@ -57,6 +110,15 @@ func (s *IdentityService) GetPluginCapabilities(ctx context.Context, req *proto.
 			},
 		},
 	}
+	if s.topology {
+		resp.Capabilities = append(resp.Capabilities, &proto.PluginCapability{
+			Type: &proto.PluginCapability_Service_{
+				Service: &proto.PluginCapability_Service{
+					Type: proto.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
 	return resp, nil
 }
 
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IdentityService_Probe(t *testing.T) {
+	ctx := context.Background()
+	identityService := NewIdentityService(config.Default())
+
+	resp, err := identityService.Probe(ctx, &proto.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.False(t, resp.Ready.Value)
+
+	identityService.SetReady(true)
+	resp, err = identityService.Probe(ctx, &proto.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Ready.Value)
+}
+
+func Test_IdentityService_Readiness(t *testing.T) {
+	ctx := context.Background()
+	identityService := NewIdentityService(config.Default())
+	readiness := func() (int, string) {
+		rec := httptest.NewRecorder()
+		identityService.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := readiness()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready: starting\n", body)
+
+	// failed checks are reported as the reason, but do not fail Probe
+	identityService.SetDiagnosis([]doctor.Result{
+		doctor.Pass("iscsiadm", "iscsiadm version 2.1.8"),
+		doctor.Fail("iscsid", "iscsid is not reachable", "start iscsid on the host"),
+		doctor.Warn("cifs", "mount.cifs is missing", "install cifs-utils"),
+	})
+	identityService.SetReady(true)
+	code, body = readiness()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "[FAIL] iscsid: iscsid is not reachable\n       start iscsid on the host\n", body)
+	resp, err := identityService.Probe(ctx, &proto.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Ready.Value)
+
+	identityService.SetDiagnosis(nil)
+	code, body = readiness()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready\n", body)
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+)
+
+// DescribeExistingVolume looks up a zvol that has not been created by the
+// driver and returns the volume id to reference it from a static persistent
+// volume. The iscsi resources are created once a node publishes the volume.
+func DescribeExistingVolume(ctx context.Context, cfg config.Config, secrets map[string]string, backendName string, dataset string) (backends.VolumeId, *backends.Volume, error) {
+	if backendName != "" && !containsString(backendNames(secrets), backendName) {
+		return backends.VolumeId{}, nil, fmt.Errorf("unknown backend %s", backendName)
+	}
+	backend, err := NewBackendForControllerGetVolume(cfg, secretsForBackend(secrets, backendName))
+	if err != nil {
+		return backends.VolumeId{}, nil, fmt.Errorf("unable to create backend: %v", err)
+	}
+	volume, err := backend.GetVolume(ctx, dataset)
+	if err != nil {
+		return backends.VolumeId{}, nil, err
+	}
+	id := backends.VolumeId{
+		Backend:  backendName,
+		Identity: backend.Identity(),
+		Protocol: backends.ProtocolISCSI,
+		Dataset:  dataset,
+	}
+	return id, volume, nil
+}
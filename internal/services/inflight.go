@@ -0,0 +1,41 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// InFlight tracks the volumes that currently have an operation running, so that
+// overlapping retries of the sidecars are rejected instead of racing each other.
+type InFlight struct {
+	mutex   sync.Mutex
+	volumes map[string]string
+}
+
+func NewInFlight() *InFlight {
+	return &InFlight{
+		volumes: map[string]string{},
+	}
+}
+
+func (f *InFlight) Release(volume string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.volumes, volume)
+}
+
+// Acquire marks the volume as busy with the given operation and returns a
+// function that releases it again. If another operation for the same volume is
+// still running, the Aborted status error recommended by the CSI spec is returned.
+func (f *InFlight) Acquire(volume string, operation string) (func(), error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if running, ok := f.volumes[volume]; ok {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("operation %s for volume %s is already in progress", running, volume))
+	}
+	f.volumes[volume] = operation
+	return func() { f.Release(volume) }, nil
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_InFlight(t *testing.T) {
+	inFlight := NewInFlight()
+
+	release, err := inFlight.Acquire("vol-1", "CreateVolume")
+	assert.NoError(t, err)
+
+	_, err = inFlight.Acquire("vol-1", "DeleteVolume")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	release2, err := inFlight.Acquire("vol-2", "DeleteVolume")
+	assert.NoError(t, err)
+	release2()
+
+	release()
+	release, err = inFlight.Acquire("vol-1", "DeleteVolume")
+	assert.NoError(t, err)
+	release()
+}
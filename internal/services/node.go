@@ -2,12 +2,17 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
 	"github.com/choffmeister/csi-driver-truenas/internal/utils"
 	proto "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -18,16 +23,67 @@ var _ proto.NodeServer = (*NodeService)(nil)
 
 type NodeService struct {
 	NodeId     string
-	mountUtils *utils.MountUtils
+	cfg        config.Config
+	mountUtils utils.Mounter
 	iscsiUtils *utils.ISCSIUtils
+	inFlight   *InFlight
+	// lookPath finds the programs the node needs, like exec.LookPath
+	lookPath func(file string) (string, error)
 }
 
-func NewNodeService(nodeId string) *NodeService {
+func NewNodeService(cfg config.Config) *NodeService {
+	return NewNodeServiceWithUtils(cfg, utils.NewMountUtils(), utils.NewISCSIUtils())
+}
+
+// NewNodeServiceWithUtils mounts and attaches volumes with the given utils, which
+// allows to run the node against fakes.
+func NewNodeServiceWithUtils(cfg config.Config, mountUtils utils.Mounter, iscsiUtils *utils.ISCSIUtils) *NodeService {
 	return &NodeService{
-		NodeId:     nodeId,
-		mountUtils: utils.NewMountUtils(),
-		iscsiUtils: utils.NewISCSIUtils(),
+		NodeId:     cfg.NodeId,
+		cfg:        cfg,
+		mountUtils: mountUtils,
+		iscsiUtils: iscsiUtils,
+		inFlight:   NewInFlight(),
+		lookPath:   exec.LookPath,
+	}
+}
+
+// fsTools are the programs needed to format and grow the supported file systems.
+var fsTools = map[string][]string{
+	"ext4": {"mkfs.ext4", "resize2fs"},
+}
+
+// Diagnose checks the prerequisites of the node for attaching iscsi volumes,
+// formatting and growing their file systems and mounting cifs shares.
+func (s *NodeService) Diagnose(ctx context.Context) []doctor.Result {
+	results := s.iscsiUtils.Diagnose(ctx)
+	// blkid detects existing file systems before formatting
+	tools := []string{"blkid"}
+	for _, fsType := range supportedFsTypes {
+		tools = append(tools, fsTools[fsType]...)
+	}
+	for _, tool := range tools {
+		results = append(results, s.diagnoseTool("file system tools", tool, "run the node with the image of the driver, which ships e2fsprogs"))
+	}
+	// only needed for ephemeral cifs volumes
+	cifs := s.diagnoseTool("cifs", "mount.cifs", "run the node with the image of the driver, which ships cifs-utils")
+	if !cifs.Passed {
+		cifs = doctor.Warn(cifs.Check, cifs.Message, cifs.Hint)
+	}
+	return append(results, cifs)
+}
+
+func (s *NodeService) diagnoseTool(check string, tool string, hint string) doctor.Result {
+	path, err := s.lookPath(tool)
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("%s is missing", tool), hint)
 	}
+	return doctor.Pass(check, fmt.Sprintf("%s is installed at %s", tool, path))
+}
+
+// CountISCSISessions returns the number of active iSCSI sessions on this node.
+func (s *NodeService) CountISCSISessions() (int, error) {
+	return s.iscsiUtils.CountSessions()
 }
 
 func (s *NodeService) NodeStageVolume(ctx context.Context, req *proto.NodeStageVolumeRequest) (*proto.NodeStageVolumeResponse, error) {
@@ -39,6 +95,21 @@ func (s *NodeService) NodeUnstageVolume(ctx context.Context, req *proto.NodeUnst
 }
 
 func (s *NodeService) NodePublishVolume(ctx context.Context, req *proto.NodePublishVolumeRequest) (*proto.NodePublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing volume capability")
+	}
+	release, err := s.inFlight.Acquire(req.VolumeId, "NodePublishVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	if ephemeral := req.VolumeContext["csi.storage.k8s.io/ephemeral"]; ephemeral == "true" {
 		cifsIP := req.Secrets["cifs-ip"]
 		if cifsIP == "" {
@@ -71,41 +142,58 @@ func (s *NodeService) NodePublishVolume(ctx context.Context, req *proto.NodePubl
 			options = append(options, "gid="+cifsGID)
 		}
 
-		utils.Info.Printf("Mounting cifs %s to %s\n", cifs, req.TargetPath)
+		utils.LoggerFromContext(ctx).Info("Mounting cifs", "share", cifs, "target", req.TargetPath)
 		if err := os.MkdirAll(req.TargetPath, 0o775); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create mount target path: %v", err))
 		}
-		_, _, err := utils.Command("mount", "-t", "cifs", "-o", strings.Join(options, ","), cifs, req.TargetPath)
+		_, _, err := utils.CommandContext(ctx, "mount", "-t", "cifs", "-o", strings.Join(options, ","), cifs, req.TargetPath)
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("unable to cifs mount: %v", err))
 		}
 		return &proto.NodePublishVolumeResponse{}, nil
 	}
 
-	iscsiTarget := req.VolumeContext["iscsi-iqn"]
-	if iscsiTarget == "" {
-		return nil, status.Error(codes.InvalidArgument, "secret value iscsi-iqn is missing")
+	id, err := backends.ParseVolumeId(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-
-	backend, err := NewBackendForNodePublish(req.PublishContext, req.Secrets)
+	backend, err := NewBackendForNodePublish(s.cfg, secretsForBackend(req.Secrets, id.Backend))
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create backend: %v", err))
 	}
-	iscsi, err := backends.LoadISCSISecrets(req.Secrets)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to load iscsi secrets: %v", err))
+	if !id.BelongsTo(backend) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s belongs to a different backend", req.VolumeId))
+	}
+
+	iscsi := backend.GetISCSISecrets()
+	iscsiTarget := req.VolumeContext["iscsi-iqn"]
+	// the volume has not been created by CreateVolume, but is a pre-existing
+	// zvol referenced by a static persistent volume, which is imported once
+	static := iscsiTarget == ""
+	if static {
+		iscsiTarget = id.ImportedTargetIQN(*iscsi)
 	}
 
 	podNamespace := req.VolumeContext["csi.storage.k8s.io/pod.namespace"]
 	podName := req.VolumeContext["csi.storage.k8s.io/pod.name"]
 	if podNamespace != "" && podName != "" {
-		err := backend.CommentVolume(ctx, req.VolumeId, fmt.Sprintf("%s/%s", podNamespace, podName))
+		err := backend.CommentVolume(ctx, id.Dataset, fmt.Sprintf("%s/%s", podNamespace, podName))
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("unable to set volume comment: %v", err))
 		}
 	}
 
-	err = s.iscsiUtils.Login(iscsi.PortalIP, iscsi.PortalPort, iscsiTarget)
+	err = s.iscsiUtils.Login(ctx, iscsi.PortalIP, iscsi.PortalPort, iscsiTarget)
+	if static && errors.Is(err, utils.ErrISCSITargetNotFound) {
+		iscsiTarget, err = backend.ImportVolume(ctx, id.Dataset)
+		if errors.Is(err, backends.ErrVolumeNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("unable to import volume: %v", err))
+		}
+		utils.LoggerFromContext(ctx).Info("Imported volume", "iqn", iscsiTarget)
+		err = s.iscsiUtils.Login(ctx, iscsi.PortalIP, iscsi.PortalPort, iscsiTarget)
+	}
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to log into iscsi session: %v", err))
 	}
@@ -117,17 +205,41 @@ func (s *NodeService) NodePublishVolume(ctx context.Context, req *proto.NodePubl
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to generate iscsi device path: %v", err))
 	}
 
+	mountPoint, err := s.mountUtils.GetMountPoint(req.TargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to list mounts: %v", err))
+	}
+	if mountPoint != nil {
+		if !sameDevice(mountPoint.Device, devicePath) {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("target path is already mounted from %s", mountPoint.Device))
+		}
+		utils.LoggerFromContext(ctx).Info("Volume already published")
+		return &proto.NodePublishVolumeResponse{}, nil
+	}
+
 	// TODO get desired file system from request
-	if err := s.mountUtils.FormatAndMountDevice(devicePath, req.TargetPath, "ext4"); err != nil {
+	if err := s.mountUtils.FormatAndMountDevice(ctx, devicePath, req.TargetPath, "ext4"); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to mount device: %v", err))
 	}
 
-	utils.Info.Printf("Published volume %s\n", req.VolumeId)
+	utils.LoggerFromContext(ctx).Info("Published volume")
 	return &proto.NodePublishVolumeResponse{}, nil
 }
 
 func (s *NodeService) NodeUnpublishVolume(ctx context.Context, req *proto.NodeUnpublishVolumeRequest) (*proto.NodeUnpublishVolumeResponse, error) {
-	_, err := NewBackendForNodeUnpublish()
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
+	}
+	release, err := s.inFlight.Acquire(req.VolumeId, "NodeUnpublishVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	_, err = NewBackendForNodeUnpublish(s.cfg)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create backend: %v", err))
 	}
@@ -135,9 +247,19 @@ func (s *NodeService) NodeUnpublishVolume(ctx context.Context, req *proto.NodeUn
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to detect device path from mountpoint: %v", err))
 	}
+	if devicePath == "" {
+		if err := removeTargetPath(req.TargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		utils.LoggerFromContext(ctx).Info("Volume already unpublished")
+		return &proto.NodeUnpublishVolumeResponse{}, nil
+	}
 	if err := s.mountUtils.UnmountDevice(req.TargetPath); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to unmount device: %v", err))
 	}
+	if err := removeTargetPath(req.TargetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	if strings.HasPrefix(devicePath, "//") {
 		// looks like cifs
@@ -149,18 +271,33 @@ func (s *NodeService) NodeUnpublishVolume(ctx context.Context, req *proto.NodeUn
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to detect iscsi information from device path: %v", err))
 	}
 
-	if err := s.iscsiUtils.Logout(portalIP, portalPort, iscsiTarget); err != nil {
+	if err := s.iscsiUtils.Logout(ctx, portalIP, portalPort, iscsiTarget); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to log out of iscsi session: %v", err))
 	}
 
-	utils.Info.Printf("Unpublished volume %s\n", req.VolumeId)
+	utils.LoggerFromContext(ctx).Info("Unpublished volume")
 	return &proto.NodeUnpublishVolumeResponse{}, nil
 }
 
+// removeTargetPath deletes the mount point created by NodePublishVolume, as
+// demanded by the spec.
+func removeTargetPath(targetPath string) error {
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove target path: %v", err)
+	}
+	return nil
+}
+
 func (s *NodeService) NodeGetVolumeStats(ctx context.Context, req *proto.NodeGetVolumeStatsRequest) (*proto.NodeGetVolumeStatsResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
 	if req.VolumePath == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing volume path")
 	}
+	if _, err := os.Stat(req.VolumePath); os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume path %s does not exist", req.VolumePath))
+	}
 
 	totalBytes, usedBytes, availableBytes, err := s.mountUtils.ByteFilesystemStats(req.VolumePath)
 	if err != nil {
@@ -173,6 +310,7 @@ func (s *NodeService) NodeGetVolumeStats(ctx context.Context, req *proto.NodeGet
 	}
 
 	resp := &proto.NodeGetVolumeStatsResponse{
+		VolumeCondition: s.volumeCondition(req.VolumePath),
 		Usage: []*proto.VolumeUsage{
 			{
 				Unit:      proto.VolumeUsage_BYTES,
@@ -208,6 +346,13 @@ func (s *NodeService) NodeGetCapabilities(ctx context.Context, req *proto.NodeGe
 					},
 				},
 			},
+			{
+				Type: &proto.NodeServiceCapability_Rpc{
+					Rpc: &proto.NodeServiceCapability_RPC{
+						Type: proto.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}
 	return resp, nil
@@ -217,16 +362,34 @@ func (s *NodeService) NodeGetInfo(ctx context.Context, req *proto.NodeGetInfoReq
 	resp := &proto.NodeGetInfoResponse{
 		NodeId: s.NodeId,
 	}
+	if s.cfg.Zone != "" {
+		resp.AccessibleTopology = &proto.Topology{
+			Segments: map[string]string{s.cfg.TopologyKey: s.cfg.Zone},
+		}
+	}
 	return resp, nil
 }
 
 func (s *NodeService) NodeExpandVolume(ctx context.Context, req *proto.NodeExpandVolumeRequest) (*proto.NodeExpandVolumeResponse, error) {
-	size, _, ok := volumeSizeFromCapacityRange(req.GetCapacityRange())
-	if !ok {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume path")
+	}
+	// the volume has already been expanded by the controller, the node only
+	// grows the file system to the size of the device
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if limit := req.GetCapacityRange().GetLimitBytes(); size < 0 || limit < 0 || (limit > 0 && size > limit) {
 		return nil, status.Error(codes.OutOfRange, "invalid capacity range")
 	}
+	release, err := s.inFlight.Acquire(req.VolumeId, "NodeExpandVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	_, err := NewBackendForNodeExpandVolume()
+	_, err = NewBackendForNodeExpandVolume(s.cfg)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create backend: %v", err))
 	}
@@ -235,17 +398,73 @@ func (s *NodeService) NodeExpandVolume(ctx context.Context, req *proto.NodeExpan
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to detect device path from mountpoint: %v", err))
 	}
+	if devicePath == "" {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume is not published at %s", req.VolumePath))
+	}
 	_, _, iscsiTarget, err := s.iscsiUtils.ParseDeviceName(devicePath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to detect iscsi information from device path: %v", err))
 	}
-	if err := s.iscsiUtils.Rescan(iscsiTarget); err != nil {
+	if err := s.iscsiUtils.Rescan(ctx, iscsiTarget); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to rescan iscsi target: %v", err))
 	}
-	if err := s.mountUtils.ResizeDevice(devicePath, req.VolumePath); err != nil {
+	if err := s.mountUtils.ResizeDevice(ctx, devicePath, req.VolumePath); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to resize device file system: %v", err))
 	}
 
-	utils.Info.Printf("Expanded volume %s\n", req.VolumeId)
+	utils.LoggerFromContext(ctx).Info("Expanded volume", "size", size)
 	return &proto.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
+
+// volumeCondition checks the health of a published volume from the perspective
+// of this node: the mount, the block device, the iscsi session and whether the
+// file system has been remounted read-only after errors.
+func (s *NodeService) volumeCondition(volumePath string) *proto.VolumeCondition {
+	abnormal := func(message string) *proto.VolumeCondition {
+		return &proto.VolumeCondition{Abnormal: true, Message: message}
+	}
+
+	mountPoint, err := s.mountUtils.GetMountPoint(volumePath)
+	if err != nil {
+		return abnormal(fmt.Sprintf("unable to list mounts: %v", err))
+	}
+	if mountPoint == nil {
+		return abnormal("volume path is not mounted")
+	}
+	for _, opt := range mountPoint.Opts {
+		if opt == "ro" {
+			return abnormal("file system is mounted read-only, probably because of errors")
+		}
+	}
+	if strings.HasPrefix(mountPoint.Device, "//") {
+		// looks like cifs
+		return &proto.VolumeCondition{Message: "volume is healthy"}
+	}
+
+	if _, err := os.Stat(mountPoint.Device); err != nil {
+		return abnormal(fmt.Sprintf("device %s has gone away: %v", mountPoint.Device, err))
+	}
+	portalIP, portalPort, iscsiTarget, err := s.iscsiUtils.ParseDeviceName(mountPoint.Device)
+	if err != nil {
+		return abnormal(fmt.Sprintf("unable to detect iscsi information from device path: %v", err))
+	}
+	portalHostMap, err := s.iscsiUtils.GetISCSIPortalHostMapForTarget(iscsiTarget)
+	if err != nil {
+		return abnormal(fmt.Sprintf("unable to list iscsi sessions: %v", err))
+	}
+	if _, ok := portalHostMap[fmt.Sprintf("%s:%d", portalIP, portalPort)]; !ok {
+		return abnormal(fmt.Sprintf("iscsi session for %s is not logged in", iscsiTarget))
+	}
+
+	return &proto.VolumeCondition{Message: "volume is healthy"}
+}
+
+// sameDevice compares device paths, which the mount table lists resolved.
+func sameDevice(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	resolvedA, errA := filepath.EvalSymlinks(a)
+	resolvedB, errB := filepath.EvalSymlinks(b)
+	return errA == nil && errB == nil && resolvedA == resolvedB
+}
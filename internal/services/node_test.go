@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils/fake"
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NodeService_Diagnose(t *testing.T) {
+	ctx := context.Background()
+	iscsiadm := fake.NewISCSIAdm(t.TempDir())
+	assert.NoError(t, iscsiadm.PrepareHost("iqn.1993-08.org.debian:01:node-1"))
+	iscsiUtils := utils.NewISCSIUtilsWithExecutor(iscsiadm, iscsiadm.SysfsRoot, iscsiadm.HostSysfsRoot, iscsiadm.ProcRoot)
+	nodeService := NewNodeServiceWithUtils(config.Default(), fake.NewMounter(), iscsiUtils)
+	installed := map[string]bool{"blkid": true, "mkfs.ext4": true, "resize2fs": true, "mount.cifs": true}
+	nodeService.lookPath = func(file string) (string, error) {
+		if !installed[file] {
+			return "", fmt.Errorf("exec: %q: executable file not found in $PATH", file)
+		}
+		return "/sbin/" + file, nil
+	}
+
+	results := nodeService.Diagnose(ctx)
+	assert.Equal(t, 0, doctor.Failed(results), results)
+	assert.Equal(t, doctor.Pass("file system tools", "mkfs.ext4 is installed at /sbin/mkfs.ext4"), results[5])
+
+	delete(installed, "resize2fs")
+	delete(installed, "mount.cifs")
+	results = nodeService.Diagnose(ctx)
+	assert.Equal(t, 1, doctor.Failed(results))
+	assert.Equal(t, "resize2fs is missing", results[6].Message)
+	// cifs is only needed for ephemeral volumes
+	assert.Equal(t, doctor.Warn("cifs", "mount.cifs is missing", "run the node with the image of the driver, which ships cifs-utils"), results[7])
+}
+
+func Test_NodeService_NodeGetInfo(t *testing.T) {
+	ctx := context.Background()
+	hasTopology := func(identityService *IdentityService) bool {
+		resp, err := identityService.GetPluginCapabilities(ctx, &proto.GetPluginCapabilitiesRequest{})
+		assert.NoError(t, err)
+		for _, capability := range resp.Capabilities {
+			if capability.GetService().GetType() == proto.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
+				return true
+			}
+		}
+		return false
+	}
+
+	// a node without zone neither advertises nor reports a topology
+	cfg := config.Default()
+	cfg.NodeId = "node-1"
+	assert.False(t, hasTopology(NewIdentityService(cfg)))
+	resp, err := NewNodeService(cfg).NodeGetInfo(ctx, &proto.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", resp.NodeId)
+	assert.Nil(t, resp.AccessibleTopology)
+
+	cfg.Zone = "zone-a"
+	assert.True(t, hasTopology(NewIdentityService(cfg)))
+	resp, err = NewNodeService(cfg).NodeGetInfo(ctx, &proto.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"topology.kubernetes.io/zone": "zone-a"}, resp.AccessibleTopology.Segments)
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A storage class can spread its volumes over several backends. Backends are
+// named by suffixing secret keys with their name, e.g. "truenas-url.nas-a" or
+// "truenas-parent-dataset.ssd". Keys without suffix apply to all backends.
+const backendSecretSeparator = "."
+
+const (
+	// secret with the zone a backend is accessible from
+	backendZoneSecret = "topology-zone"
+	// secret with the labels of a backend, e.g. "tier=fast,disk=ssd"
+	backendLabelsSecret = "backend-labels"
+
+	placementPolicyParameter = "placement-policy"
+	backendSelectorParameter = "backend-selector"
+)
+
+const (
+	PlacementPolicyMostFreeSpace = "most-free-space"
+	PlacementPolicyRoundRobin    = "round-robin"
+	PlacementPolicyLabel         = "label"
+)
+
+type placementBackend struct {
+	Name    string
+	Zone    string
+	Labels  map[string]string
+	Secrets map[string]string
+}
+
+// backendNames returns the names of the backends that have secrets assigned.
+func backendNames(secrets map[string]string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for key := range secrets {
+		if i := strings.Index(key, backendSecretSeparator); i > 0 {
+			name := key[i+1:]
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secretsForBackend returns the secrets without suffix, overridden by the ones
+// of the given backend.
+func secretsForBackend(secrets map[string]string, name string) map[string]string {
+	result := map[string]string{}
+	for key, value := range secrets {
+		if !strings.Contains(key, backendSecretSeparator) {
+			result[key] = value
+		}
+	}
+	if name == "" {
+		return result
+	}
+	suffix := backendSecretSeparator + name
+	for key, value := range secrets {
+		if strings.HasSuffix(key, suffix) {
+			result[strings.TrimSuffix(key, suffix)] = value
+		}
+	}
+	return result
+}
+
+// placementBackends returns the named backends or, if there are none, a single
+// unnamed backend for the plain secrets.
+func placementBackends(secrets map[string]string) ([]placementBackend, error) {
+	names := backendNames(secrets)
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	result := []placementBackend{}
+	for _, name := range names {
+		backendSecrets := secretsForBackend(secrets, name)
+		labels, err := parseLabels(backendSecrets[backendLabelsSecret])
+		if err != nil {
+			return nil, fmt.Errorf("malformed secret %s of backend %s: %v", backendLabelsSecret, name, err)
+		}
+		result = append(result, placementBackend{
+			Name:    name,
+			Zone:    backendSecrets[backendZoneSecret],
+			Labels:  labels,
+			Secrets: backendSecrets,
+		})
+	}
+	return result, nil
+}
+
+func parseLabels(str string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %s", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// Placement selects the backend for new volumes.
+type Placement struct {
+	mutex sync.Mutex
+	next  map[string]int
+}
+
+func NewPlacement() *Placement {
+	return &Placement{
+		next: map[string]int{},
+	}
+}
+
+// Select picks a backend that satisfies the accessibility requirements and the
+// backend selector of the storage class, favoring the preferred zones. Among the
+// remaining backends the placement policy decides. The capacity function is only
+// called for the most-free-space policy.
+func (p *Placement) Select(ctx context.Context, parameters map[string]string, secrets map[string]string, requirement *proto.TopologyRequirement, topologyKey string, capacity func(placementBackend) (int64, error)) (*placementBackend, error) {
+	policy := parameters[placementPolicyParameter]
+	if policy == "" {
+		policy = PlacementPolicyMostFreeSpace
+	}
+	if policy != PlacementPolicyMostFreeSpace && policy != PlacementPolicyRoundRobin && policy != PlacementPolicyLabel {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown placement policy %s", policy))
+	}
+	selector, err := parseLabels(parameters[backendSelectorParameter])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("malformed parameter %s: %v", backendSelectorParameter, err))
+	}
+	if policy == PlacementPolicyLabel && len(selector) == 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("placement policy %s requires the parameter %s", policy, backendSelectorParameter))
+	}
+	all, err := placementBackends(secrets)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	requisite := map[string]bool{}
+	for _, topology := range requirement.GetRequisite() {
+		requisite[topology.Segments[topologyKey]] = true
+	}
+	candidates := []placementBackend{}
+	for _, backend := range all {
+		if !matchesLabels(backend.Labels, selector) {
+			continue
+		}
+		if backend.Zone != "" && len(requisite) > 0 && !requisite[backend.Zone] {
+			continue
+		}
+		candidates = append(candidates, backend)
+	}
+	if len(candidates) == 0 {
+		return nil, status.Error(codes.ResourceExhausted, "no backend satisfies the accessibility requirements and the backend selector")
+	}
+	for _, topology := range requirement.GetPreferred() {
+		preferred := []placementBackend{}
+		for _, backend := range candidates {
+			if backend.Zone != "" && backend.Zone == topology.Segments[topologyKey] {
+				preferred = append(preferred, backend)
+			}
+		}
+		if len(preferred) > 0 {
+			candidates = preferred
+			break
+		}
+	}
+	if len(candidates) == 1 {
+		return &candidates[0], nil
+	}
+
+	switch policy {
+	case PlacementPolicyRoundRobin:
+		names := make([]string, len(candidates))
+		for i, backend := range candidates {
+			names[i] = backend.Name
+		}
+		key := strings.Join(names, ",")
+		p.mutex.Lock()
+		i := p.next[key] % len(candidates)
+		p.next[key] = i + 1
+		p.mutex.Unlock()
+		return &candidates[i], nil
+	case PlacementPolicyMostFreeSpace:
+		var selected *placementBackend
+		var selectedCapacity int64
+		for i, backend := range candidates {
+			available, err := capacity(backend)
+			if err != nil {
+				utils.LoggerFromContext(ctx).Error(err, "Unable to determine available capacity", "backend", backend.Name)
+				continue
+			}
+			if selected == nil || available > selectedCapacity {
+				selected = &candidates[i]
+				selectedCapacity = available
+			}
+		}
+		if selected == nil {
+			return nil, status.Error(codes.Unavailable, "unable to determine the available capacity of any backend")
+		}
+		return selected, nil
+	default:
+		return &candidates[0], nil
+	}
+}
+
+func matchesLabels(labels map[string]string, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_SecretsForBackend(t *testing.T) {
+	secrets := map[string]string{
+		"truenas-api-key":        "1",
+		"truenas-url":            "https://nas",
+		"truenas-url.nas-a":      "https://nas-a",
+		"truenas-url.nas-b":      "https://nas-b",
+		"iscsi-portal-ip.nas-b":  "10.0.0.2",
+		"topology-zone.nas-b":    "zone-b",
+		"backend-labels.nas-b":   "tier=fast, disk=ssd",
+		"truenas-parent-dataset": "tank/k8s",
+	}
+	assert.Equal(t, []string{"nas-a", "nas-b"}, backendNames(secrets))
+	assert.Equal(t, map[string]string{
+		"truenas-api-key":        "1",
+		"truenas-url":            "https://nas-a",
+		"truenas-parent-dataset": "tank/k8s",
+	}, secretsForBackend(secrets, "nas-a"))
+	assert.Equal(t, map[string]string{
+		"truenas-api-key":        "1",
+		"truenas-url":            "https://nas-b",
+		"iscsi-portal-ip":        "10.0.0.2",
+		"topology-zone":          "zone-b",
+		"backend-labels":         "tier=fast, disk=ssd",
+		"truenas-parent-dataset": "tank/k8s",
+	}, secretsForBackend(secrets, "nas-b"))
+	assert.Empty(t, backendNames(map[string]string{"truenas-url": "https://nas"}))
+
+	all, err := placementBackends(secrets)
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, "zone-b", all[1].Zone)
+	assert.Equal(t, map[string]string{"tier": "fast", "disk": "ssd"}, all[1].Labels)
+}
+
+func Test_PlacementSelect(t *testing.T) {
+	ctx := context.Background()
+	key := "topology.kubernetes.io/zone"
+	topology := func(zone string) *proto.Topology {
+		return &proto.Topology{Segments: map[string]string{key: zone}}
+	}
+	secrets := map[string]string{
+		"truenas-parent-dataset.a": "tank/a",
+		"truenas-parent-dataset.b": "tank/b",
+		"truenas-parent-dataset.c": "tank/c",
+		"topology-zone.a":          "zone-a",
+		"topology-zone.b":          "zone-b",
+		"backend-labels.a":         "tier=fast",
+		"backend-labels.c":         "tier=fast",
+	}
+	available := map[string]int64{"a": 10, "b": 30, "c": 20}
+	capacity := func(b placementBackend) (int64, error) {
+		if b.Name == "c" {
+			return 0, fmt.Errorf("unreachable")
+		}
+		return available[b.Name], nil
+	}
+	p := NewPlacement()
+
+	// most free space is the default
+	selected, err := p.Select(ctx, nil, secrets, nil, key, capacity)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", selected.Name)
+	assert.Equal(t, "tank/b", selected.Secrets["truenas-parent-dataset"])
+
+	// round robin cycles through the backends
+	names := []string{}
+	for i := 0; i < 4; i++ {
+		selected, err := p.Select(ctx, map[string]string{"placement-policy": "round-robin"}, secrets, nil, key, capacity)
+		assert.NoError(t, err)
+		names = append(names, selected.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a"}, names)
+
+	// label matches the backend selector
+	selected, err = p.Select(ctx, map[string]string{"placement-policy": "label", "backend-selector": "tier=fast"}, secrets, nil, key, capacity)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", selected.Name)
+	_, err = p.Select(ctx, map[string]string{"placement-policy": "label"}, secrets, nil, key, capacity)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// backends without zone are accessible from all zones, preferred zones win
+	selected, err = p.Select(ctx, nil, secrets, &proto.TopologyRequirement{
+		Requisite: []*proto.Topology{topology("zone-a")},
+	}, key, capacity)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", selected.Name)
+	selected, err = p.Select(ctx, map[string]string{"placement-policy": "round-robin"}, secrets, &proto.TopologyRequirement{
+		Requisite: []*proto.Topology{topology("zone-a"), topology("zone-b")},
+		Preferred: []*proto.Topology{topology("zone-c"), topology("zone-b")},
+	}, key, capacity)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", selected.Name)
+	_, err = p.Select(ctx, map[string]string{"backend-selector": "tier=fast"}, secrets, &proto.TopologyRequirement{
+		Requisite: []*proto.Topology{topology("zone-b")},
+	}, key, capacity)
+	assert.NoError(t, err)
+	_, err = p.Select(ctx, map[string]string{"backend-selector": "tier=slow"}, secrets, nil, key, capacity)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// plain secrets form a single unnamed backend
+	selected, err = p.Select(ctx, nil, map[string]string{"truenas-parent-dataset": "tank"}, nil, key, capacity)
+	assert.NoError(t, err)
+	assert.Equal(t, "", selected.Name)
+}
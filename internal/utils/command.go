@@ -5,23 +5,71 @@ import (
 	"fmt"
 	"os/exec"
 	"time"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/metrics"
+	"github.com/choffmeister/csi-driver-truenas/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// nolint: gochecknoglobals
+var CommandTimeout = 10 * time.Second
+
+// Executor runs commands. It returns the combined output and, if the command ran
+// but failed, its exit code together with an error. An error with exit code 0
+// means the command could not be run at all.
+type Executor interface {
+	Execute(ctx context.Context, name string, args ...string) (output string, exitCode int, err error)
+}
+
+// OSExecutor runs commands as child processes.
+type OSExecutor struct{}
+
+func (OSExecutor) Execute(ctx context.Context, name string, args ...string) (string, int, error) {
+	outputBytes, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return string(outputBytes), exitError.ExitCode(), exitError
+	}
+	return string(outputBytes), 0, err
+}
+
+// DefaultExecutor is used by Command and CommandContext and can be replaced in tests.
+// nolint: gochecknoglobals
+var DefaultExecutor Executor = OSExecutor{}
+
 func Command(name string, args ...string) (string, int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	return CommandContext(context.Background(), name, args...)
+}
+
+// CommandContext runs the command with the default executor.
+func CommandContext(ctx context.Context, name string, args ...string) (string, int, error) {
+	return ExecuteContext(ctx, DefaultExecutor, name, args...)
+}
+
+// ExecuteContext runs the command within a child span of the given context. The
+// context is only used for tracing, cancellation of it does not kill the command,
+// as that could leave for example iscsi sessions half attached.
+func ExecuteContext(ctx context.Context, executor Executor, name string, args ...string) (output string, exitCode int, err error) {
+	_, span := tracing.Start(ctx, "exec "+name, attribute.StringSlice("args", RedactCommandArgs(args)))
+	defer func() {
+		span.SetAttributes(attribute.Int("exit_code", exitCode))
+		tracing.End(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
 	defer cancel()
 
-	Debug.Printf("Executing command %s %v\n", name, args)
-	cmd := exec.CommandContext(ctx, name, args...)
-	outputBytes, err := cmd.CombinedOutput()
-	output := string(outputBytes)
-	Debug.Printf("Executed command %s %v: %s", name, args, output)
+	Log.V(1).Info("Executing command", "command", name, "args", RedactCommandArgs(args))
+	start := time.Now()
+	output, exitCode, err = executor.Execute(ctx, name, args...)
+	Log.V(1).Info("Executed command", "command", name, "args", RedactCommandArgs(args), "output", output)
 	if err != nil {
-		exitError, ok := err.(*exec.ExitError)
-		if !ok {
+		if exitCode == 0 {
+			metrics.ObserveCommand(name, -1, time.Since(start))
 			return output, 0, err
 		}
-		return output, exitError.ExitCode(), fmt.Errorf("%w\n%s", exitError, output)
+		metrics.ObserveCommand(name, exitCode, time.Since(start))
+		return output, exitCode, fmt.Errorf("%w\n%s", err, output)
 	}
+	metrics.ObserveCommand(name, 0, time.Since(start))
 	return output, 0, nil
 }
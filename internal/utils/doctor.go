@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+)
+
+// Exit codes of iscsiadm, see include/iscsi_err.h in open-iscsi.
+const (
+	iscsiadmExitNoObjectsFound = 21
+	// the shell of the wrapper or nsenter exit with 127 for missing commands
+	exitCommandNotFound = 127
+)
+
+// Diagnose checks the prerequisites of iscsi on the node: iscsiadm, which the
+// node image wraps to run it on the host, the iscsid of the host, its initiator
+// name and the mounted sysfs.
+func (u *ISCSIUtils) Diagnose(ctx context.Context) []doctor.Result {
+	return []doctor.Result{
+		u.diagnoseISCSIAdm(ctx),
+		u.diagnoseISCSId(ctx),
+		u.diagnoseInitiatorName(),
+		u.diagnoseSysfs(),
+	}
+}
+
+func (u *ISCSIUtils) diagnoseISCSIAdm(ctx context.Context) doctor.Result {
+	const check = "iscsiadm"
+	output, exitCode, err := u.iscsiadm(ctx, "--version")
+	if err != nil && exitCode == 0 {
+		return doctor.Fail(check, fmt.Sprintf("unable to run iscsiadm: %v", err),
+			"run the node with the image of the driver, which wraps iscsiadm to run it on the host")
+	}
+	if exitCode == exitCommandNotFound {
+		return doctor.Fail(check, "iscsiadm is missing on the host",
+			"install open-iscsi on the host, e.g. apt install open-iscsi")
+	}
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("iscsiadm failed with exit code %d: %s", exitCode, firstLine(output, err)),
+			"the node image runs iscsiadm in the namespaces of iscsid on the host, which requires iscsid to run, hostPID and a privileged container")
+	}
+	return doctor.Pass(check, strings.TrimSpace(output))
+}
+
+func (u *ISCSIUtils) diagnoseISCSId(ctx context.Context) doctor.Result {
+	const check = "iscsid"
+	output, exitCode, err := u.iscsiadm(ctx, "-m", "session")
+	if err != nil && exitCode != iscsiadmExitNoObjectsFound {
+		return doctor.Fail(check, fmt.Sprintf("iscsid is not reachable: %s", firstLine(output, err)),
+			"start iscsid on the host, e.g. systemctl enable --now iscsid, and run the node with hostPID")
+	}
+	return doctor.Pass(check, "iscsid is reachable")
+}
+
+// diagnoseInitiatorName reads the initiator name through the root of the
+// iscsid process, like the iscsiadm wrapper enters its mount namespace, as
+// iscsid may run in a container of the host with its own /etc/iscsi.
+func (u *ISCSIUtils) diagnoseInitiatorName() doctor.Result {
+	const check = "initiator name"
+	pid, err := findProcess(u.procRoot, "iscsid")
+	if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to find iscsid: %v", err),
+			"start iscsid on the host, e.g. systemctl enable --now iscsid, and run the node with hostPID")
+	}
+	initiatorNameFile := filepath.Join(u.procRoot, pid, "root/etc/iscsi/initiatorname.iscsi")
+	file, err := os.Open(initiatorNameFile)
+	if os.IsNotExist(err) {
+		return doctor.Fail(check, "/etc/iscsi/initiatorname.iscsi of iscsid is missing",
+			"install open-iscsi on the host, which generates the initiator name")
+	} else if err != nil {
+		return doctor.Fail(check, fmt.Sprintf("unable to read %s: %v", initiatorNameFile, err), "")
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if name := strings.TrimPrefix(line, "InitiatorName="); name != line && name != "" {
+			return doctor.Pass(check, fmt.Sprintf("initiator name is %s", name))
+		}
+	}
+	return doctor.Fail(check, "/etc/iscsi/initiatorname.iscsi of iscsid has no InitiatorName",
+		"generate one on the host, e.g. echo InitiatorName=$(iscsi-iname) > /etc/iscsi/initiatorname.iscsi")
+}
+
+// findProcess returns the pid of the first process with the given command name.
+func findProcess(procRoot string, name string) (string, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == name {
+			return entry.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no process %s in %s", name, procRoot)
+}
+
+func (u *ISCSIUtils) diagnoseSysfs() doctor.Result {
+	const check = "sysfs"
+	iscsiHosts := filepath.Join(u.sysfsRoot, "class/iscsi_host")
+	if _, err := os.Stat(iscsiHosts); err != nil {
+		return doctor.Fail(check, fmt.Sprintf("%s is missing", iscsiHosts),
+			"load the iscsi_tcp kernel module on the host, e.g. modprobe iscsi_tcp")
+	}
+	scsiHosts := filepath.Join(u.hostSysfsRoot, "class/scsi_host")
+	if _, err := os.Stat(scsiHosts); err != nil {
+		return doctor.Fail(check, fmt.Sprintf("%s is missing", scsiHosts),
+			"mount the root of the host at /host, the sysfs of the container is read-only")
+	}
+	return doctor.Pass(check, fmt.Sprintf("sysfs is available at %s and %s", u.sysfsRoot, u.hostSysfsRoot))
+}
+
+func firstLine(output string, err error) string {
+	if line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0]); line != "" {
+		return line
+	}
+	return err.Error()
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/doctor"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ISCSIUtils_Diagnose(t *testing.T) {
+	ctx := context.Background()
+	iscsiadm, iscsiUtils := newTestISCSIUtils(t)
+	assert.NoError(t, iscsiadm.PrepareHost("iqn.1993-08.org.debian:01:node-1"))
+
+	results := iscsiUtils.Diagnose(ctx)
+	assert.Equal(t, 0, doctor.Failed(results), results)
+	assert.Equal(t, "iscsiadm version 2.1.8", results[0].Message)
+	assert.Equal(t, "initiator name is iqn.1993-08.org.debian:01:node-1", results[2].Message)
+
+	// the wrapper of the node image fails if iscsid is not running on the host
+	iscsiadm.InjectFault(fake.Fault{ExitCode: 1, Output: "Unable to find process id of iscsid on host"})
+	results = iscsiUtils.Diagnose(ctx)
+	assert.Equal(t, "iscsiadm failed with exit code 1: Unable to find process id of iscsid on host", results[0].Message)
+	assert.False(t, results[0].Passed)
+	assert.Equal(t, doctor.Fail("iscsid", "iscsid is not reachable: Unable to find process id of iscsid on host",
+		"start iscsid on the host, e.g. systemctl enable --now iscsid, and run the node with hostPID"), results[1])
+	iscsiadm.ClearFaults()
+
+	iscsiadm.InjectFault(fake.Fault{ExitCode: 127, Output: "nsenter: failed to execute iscsiadm: No such file or directory"})
+	assert.Equal(t, "iscsiadm is missing on the host", iscsiUtils.Diagnose(ctx)[0].Message)
+	iscsiadm.ClearFaults()
+
+	assert.NoError(t, os.WriteFile(iscsiadm.InitiatorNameFile, []byte("## DO NOT EDIT\n"), 0644))
+	assert.Equal(t, "/etc/iscsi/initiatorname.iscsi of iscsid has no InitiatorName", iscsiUtils.Diagnose(ctx)[2].Message)
+	assert.NoError(t, os.RemoveAll(filepath.Join(iscsiadm.ProcRoot, fake.IscsidPid)))
+	assert.Contains(t, iscsiUtils.Diagnose(ctx)[2].Message, "no process iscsid")
+	assert.NoError(t, os.RemoveAll(iscsiadm.HostSysfsRoot))
+	assert.Contains(t, iscsiUtils.Diagnose(ctx)[3].Message, "class/scsi_host is missing")
+}
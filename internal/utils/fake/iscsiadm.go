@@ -0,0 +1,403 @@
+// Package fake provides an in-process iscsiadm and mounter for hermetic tests of
+// the node. The iscsiadm keeps track of discovered targets and sessions, answers
+// with the exit codes of open-iscsi and synthesizes the sysfs tree the kernel
+// would expose for the sessions.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Exit codes of iscsiadm, see include/iscsi_err.h in open-iscsi.
+const (
+	ExitInvalid          = 7
+	ExitTransport        = 4
+	ExitSessionExists    = 15
+	ExitISCSIdNotConn    = 20
+	ExitNoObjectsFound   = 21
+	ExitLoginAuthFailure = 24
+)
+
+// Invocation is a recorded call of the executor.
+type Invocation struct {
+	Name string
+	Args []string
+}
+
+func (i Invocation) String() string {
+	return strings.Join(append([]string{i.Name}, i.Args...), " ")
+}
+
+// Fault makes matching iscsiadm invocations fail with the given exit code.
+type Fault struct {
+	// Args that all need to be part of the invocation, e.g. "--login"
+	Args     []string
+	ExitCode int
+	Output   string
+	// Times is the number of invocations to fail, 0 fails all matching invocations
+	Times int
+}
+
+type session struct {
+	id     int
+	host   int
+	target string
+	portal string
+}
+
+type ISCSIAdm struct {
+	// SysfsRoot is the synthesized sysfs of the node
+	SysfsRoot string
+	// HostSysfsRoot is the synthesized writable sysfs of the host
+	HostSysfsRoot string
+	// ProcRoot is the synthesized procfs of the host, with iscsid as process
+	// IscsidPid
+	ProcRoot string
+	// InitiatorNameFile is the initiator name file within the root of iscsid
+	InitiatorNameFile string
+	// Discover returns the targets of a portal and whether it is reachable, it
+	// replaces the targets added with AddTarget if set
+	Discover func(portal string) ([]string, bool)
+
+	mutex       sync.Mutex
+	nextId      int
+	portals     map[string][]string
+	discovered  map[string]bool
+	sessions    map[string]*session
+	faults      []*Fault
+	invocations []Invocation
+	hideSysfs   bool
+	rescans     map[string]int
+}
+
+// NewISCSIAdm creates a fake iscsiadm that synthesizes the sysfs below the
+// given directory.
+func NewISCSIAdm(dir string) *ISCSIAdm {
+	return &ISCSIAdm{
+		SysfsRoot:         filepath.Join(dir, "sys"),
+		HostSysfsRoot:     filepath.Join(dir, "host", "sys"),
+		ProcRoot:          filepath.Join(dir, "proc"),
+		InitiatorNameFile: filepath.Join(dir, "proc", IscsidPid, "root", "etc", "iscsi", "initiatorname.iscsi"),
+		nextId:            1,
+		portals:           map[string][]string{},
+		discovered:        map[string]bool{},
+		sessions:          map[string]*session{},
+		rescans:           map[string]int{},
+	}
+}
+
+// IscsidPid is the process id of iscsid within ProcRoot.
+const IscsidPid = "812"
+
+// PrepareHost writes the initiator name file, the iscsid process and the sysfs
+// classes that exist on a host with open-iscsi installed and the iscsi kernel
+// modules loaded.
+func (a *ISCSIAdm) PrepareHost(initiatorName string) error {
+	dirs := []string{
+		filepath.Join(a.SysfsRoot, "class", "iscsi_host"),
+		filepath.Join(a.SysfsRoot, "class", "iscsi_session"),
+		filepath.Join(a.HostSysfsRoot, "class", "scsi_host"),
+		filepath.Join(a.ProcRoot, "1"),
+		filepath.Dir(a.InitiatorNameFile),
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	comms := map[string]string{"1": "systemd", IscsidPid: "iscsid"}
+	for pid, comm := range comms {
+		if err := ioutil.WriteFile(filepath.Join(a.ProcRoot, pid, "comm"), []byte(comm+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(a.InitiatorNameFile, []byte("InitiatorName="+initiatorName+"\n"), 0644)
+}
+
+// AddTarget makes the target discoverable on the portal, e.g. "10.0.0.1:3260".
+func (a *ISCSIAdm) AddTarget(portal string, target string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.portals[portal] = append(a.portals[portal], target)
+}
+
+// SetSysfsHidden keeps new sessions out of the sysfs, as if the kernel had not
+// yet registered them.
+func (a *ISCSIAdm) SetSysfsHidden(hidden bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.hideSysfs = hidden
+}
+
+func (a *ISCSIAdm) InjectFault(fault Fault) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	f := fault
+	a.faults = append(a.faults, &f)
+}
+
+func (a *ISCSIAdm) ClearFaults() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.faults = nil
+}
+
+// Invocations returns the recorded invocations, e.g.
+// "iscsiadm -m node -T iqn.2005-10.org.freenas.ctl:pvc-1 -p 10.0.0.1:3260 --login".
+func (a *ISCSIAdm) Invocations() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result := []string{}
+	for _, invocation := range a.invocations {
+		result = append(result, invocation.String())
+	}
+	return result
+}
+
+// Sessions returns the targets with an active session as "target,portal".
+func (a *ISCSIAdm) Sessions() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result := []string{}
+	for key := range a.sessions {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Rescans returns how often the sessions of the target have been rescanned.
+func (a *ISCSIAdm) Rescans(target string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.rescans[target]
+}
+
+// ScanFile returns the path of the file the scsi host is scanned through.
+func (a *ISCSIAdm) ScanFile(host int) string {
+	return filepath.Join(a.HostSysfsRoot, "class", "scsi_host", fmt.Sprintf("host%d", host), "scan")
+}
+
+// Execute implements the executor of the utils package.
+func (a *ISCSIAdm) Execute(ctx context.Context, name string, args ...string) (string, int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.invocations = append(a.invocations, Invocation{Name: name, Args: args})
+
+	if name != "iscsiadm" {
+		return "", 0, fmt.Errorf("exec: %q: executable file not found in $PATH", name)
+	}
+	for i, fault := range a.faults {
+		if matchesArgs(args, fault.Args) {
+			if fault.Times > 0 {
+				fault.Times--
+				if fault.Times == 0 {
+					a.faults = append(a.faults[:i], a.faults[i+1:]...)
+				}
+			}
+			return fault.Output, fault.ExitCode, exitError(fault.ExitCode)
+		}
+	}
+
+	flags, options := parseArgs(args)
+	portal := flags["-p"]
+	target := flags["-T"]
+	if target == "" {
+		target = flags["--targetname"]
+	}
+	switch {
+	case options["--version"]:
+		return "iscsiadm version 2.1.8", 0, nil
+	case flags["-m"] == "session":
+		if len(a.sessions) == 0 {
+			return a.fail(ExitNoObjectsFound, "iscsiadm: No active sessions.")
+		}
+		lines := []string{}
+		for _, s := range a.sessions {
+			lines = append(lines, fmt.Sprintf("tcp: [%d] %s,1 %s (non-flash)", s.id, s.portal, s.target))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n"), 0, nil
+	case flags["-m"] == "discovery" && flags["-o"] == "delete":
+		delete(a.discovered, portal)
+		return "", 0, nil
+	case flags["-m"] == "discovery":
+		targets, ok := a.targets(portal)
+		if !ok {
+			return a.fail(ExitTransport, "iscsiadm: cannot make connection to %s: Connection refused", portal)
+		}
+		a.discovered[portal] = true
+		lines := []string{}
+		for _, target := range targets {
+			lines = append(lines, fmt.Sprintf("%s,1 %s", portal, target))
+		}
+		return strings.Join(lines, "\n"), 0, nil
+	case flags["-m"] == "node" && flags["-o"] == "delete":
+		if !a.known(portal, target) {
+			return a.fail(ExitNoObjectsFound, "iscsiadm: No records found")
+		}
+		return "", 0, nil
+	case flags["-m"] == "node" && options["--login"]:
+		if !a.known(portal, target) {
+			return a.fail(ExitNoObjectsFound, "iscsiadm: No records found")
+		}
+		key := target + "," + portal
+		if _, ok := a.sessions[key]; ok {
+			return a.fail(ExitSessionExists, "iscsiadm: default: 1 session requested, but 1 already present.")
+		}
+		s := &session{id: a.nextId, host: a.nextId + 1, target: target, portal: portal}
+		a.nextId++
+		a.sessions[key] = s
+		if !a.hideSysfs {
+			if err := a.writeSysfs(s); err != nil {
+				return "", 0, err
+			}
+		}
+		return fmt.Sprintf("Login to [iface: default, target: %s, portal: %s] successful.", target, portal), 0, nil
+	case flags["-m"] == "node" && options["--logout"]:
+		key := target + "," + portal
+		s, ok := a.sessions[key]
+		if !ok {
+			return a.fail(ExitNoObjectsFound, "iscsiadm: No matching sessions found")
+		}
+		delete(a.sessions, key)
+		if err := a.removeSysfs(s); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("Logout of [sid: %d, target: %s, portal: %s] successful.", s.id, target, portal), 0, nil
+	case flags["-m"] == "node" && options["-R"]:
+		found := false
+		for _, s := range a.sessions {
+			if s.target == target {
+				found = true
+			}
+		}
+		if !found {
+			return a.fail(ExitNoObjectsFound, "iscsiadm: No session found.")
+		}
+		a.rescans[target]++
+		return "", 0, nil
+	default:
+		return a.fail(ExitInvalid, "iscsiadm: unsupported arguments %s", strings.Join(args, " "))
+	}
+}
+
+func (a *ISCSIAdm) known(portal string, target string) bool {
+	if !a.discovered[portal] {
+		return false
+	}
+	targets, _ := a.targets(portal)
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ISCSIAdm) targets(portal string) ([]string, bool) {
+	if a.Discover != nil {
+		return a.Discover(portal)
+	}
+	targets, ok := a.portals[portal]
+	return targets, ok
+}
+
+func (a *ISCSIAdm) fail(exitCode int, format string, args ...interface{}) (string, int, error) {
+	return fmt.Sprintf(format, args...), exitCode, exitError(exitCode)
+}
+
+func (a *ISCSIAdm) hostDir(s *session) string {
+	return filepath.Join(a.SysfsRoot, "class", "iscsi_host", fmt.Sprintf("host%d", s.host))
+}
+
+// writeSysfs creates the entries the kernel exposes for a session, see
+// drivers/scsi/scsi_transport_iscsi.c in Linux.
+func (a *ISCSIAdm) writeSysfs(s *session) error {
+	sessionName := fmt.Sprintf("session%d", s.id)
+	connectionName := fmt.Sprintf("connection%d:0", s.id)
+	sessionDir := filepath.Join(a.hostDir(s), "device", sessionName)
+	connectionDir := filepath.Join(sessionDir, connectionName, "iscsi_connection", connectionName)
+	i := strings.LastIndex(s.portal, ":")
+	address, port := s.portal[:i], s.portal[i+1:]
+
+	files := map[string]string{
+		filepath.Join(sessionDir, "iscsi_session", sessionName, "targetname"):           s.target + "\n",
+		filepath.Join(connectionDir, "address"):                                         address + "\n",
+		filepath.Join(connectionDir, "port"):                                            port + "\n",
+		filepath.Join(connectionDir, "persistent_address"):                              address + "\n",
+		filepath.Join(connectionDir, "persistent_port"):                                 port + "\n",
+		filepath.Join(a.SysfsRoot, "class", "iscsi_session", sessionName, "targetname"): s.target + "\n",
+		a.ScanFile(s.host): "",
+	}
+	for file, content := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *ISCSIAdm) removeSysfs(s *session) error {
+	dirs := []string{
+		a.hostDir(s),
+		filepath.Join(a.SysfsRoot, "class", "iscsi_session", fmt.Sprintf("session%d", s.id)),
+		filepath.Dir(a.ScanFile(s.host)),
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// parseArgs splits the arguments into flags with values and options without.
+func parseArgs(args []string) (map[string]string, map[string]bool) {
+	flags := map[string]string{}
+	options := map[string]bool{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-m", "-t", "-p", "-T", "--targetname", "-o":
+			if i+1 < len(args) {
+				flags[args[i]] = args[i+1]
+				i++
+			}
+		default:
+			options[args[i]] = true
+		}
+	}
+	return flags, options
+}
+
+func matchesArgs(args []string, expected []string) bool {
+	for _, e := range expected {
+		found := false
+		for _, arg := range args {
+			if arg == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"k8s.io/mount-utils"
+)
+
+// Mounter keeps a mount table in memory instead of mounting devices. Target
+// directories are created on the real file system like the real mounter does.
+type Mounter struct {
+	// FilesystemSize is the size reported for mounted file systems
+	FilesystemSize int64
+
+	mutex     sync.Mutex
+	mounts    map[string]mount.MountPoint
+	formatted map[string]string
+	resizes   map[string]int
+}
+
+func NewMounter() *Mounter {
+	return &Mounter{
+		FilesystemSize: 1024 * 1024 * 1024,
+		mounts:         map[string]mount.MountPoint{},
+		formatted:      map[string]string{},
+		resizes:        map[string]int{},
+	}
+}
+
+// Mounts returns the mount table.
+func (m *Mounter) Mounts() []mount.MountPoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := []mount.MountPoint{}
+	for _, mountPoint := range m.mounts {
+		result = append(result, mountPoint)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// SetReadOnly remounts the target read-only, like the kernel does after file
+// system errors.
+func (m *Mounter) SetReadOnly(target string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mountPoint := m.mounts[target]
+	mountPoint.Opts = []string{"ro"}
+	m.mounts[target] = mountPoint
+}
+
+// Resizes returns how often the file system on the device has been resized.
+func (m *Mounter) Resizes(device string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.resizes[device]
+}
+
+func (m *Mounter) FormatAndMountDevice(ctx context.Context, device string, target string, fstype string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if existing, ok := m.formatted[device]; ok && existing != fstype {
+		return fmt.Errorf("device %s is formatted with %s instead of %s", device, existing, fstype)
+	}
+	if mountPoint, ok := m.mounts[target]; ok {
+		return fmt.Errorf("%s is already mounted from %s", target, mountPoint.Device)
+	}
+	if err := os.MkdirAll(target, 0o775); err != nil {
+		return fmt.Errorf("unable to create mount target path: %w", err)
+	}
+	m.formatted[device] = fstype
+	m.mounts[target] = mount.MountPoint{Device: device, Path: target, Type: fstype, Opts: []string{"rw"}}
+	return nil
+}
+
+func (m *Mounter) UnmountDevice(target string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.mounts[target]; !ok {
+		return fmt.Errorf("umount: %s: not mounted", target)
+	}
+	delete(m.mounts, target)
+	return nil
+}
+
+func (m *Mounter) ResizeDevice(ctx context.Context, device string, target string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if mountPoint, ok := m.mounts[target]; !ok || mountPoint.Device != device {
+		return fmt.Errorf("device %s is not mounted at %s", device, target)
+	}
+	m.resizes[device]++
+	return nil
+}
+
+func (m *Mounter) GetDeviceNameFromMount(path string) (string, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mountPoint, ok := m.mounts[path]
+	if !ok {
+		return "", 0, nil
+	}
+	refCount := 0
+	for _, other := range m.mounts {
+		if other.Device == mountPoint.Device {
+			refCount++
+		}
+	}
+	return mountPoint.Device, refCount, nil
+}
+
+func (m *Mounter) GetMountPoint(path string) (*mount.MountPoint, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mountPoint, ok := m.mounts[path]
+	if !ok {
+		return nil, nil
+	}
+	return &mountPoint, nil
+}
+
+func (m *Mounter) ByteFilesystemStats(volumePath string) (int64, int64, int64, error) {
+	if _, err := os.Stat(volumePath); err != nil {
+		return 0, 0, 0, err
+	}
+	return m.FilesystemSize, 0, m.FilesystemSize, nil
+}
+
+func (m *Mounter) INodeFilesystemStats(volumePath string) (int64, int64, int64, error) {
+	if _, err := os.Stat(volumePath); err != nil {
+		return 0, 0, 0, err
+	}
+	inodes := m.FilesystemSize / (16 * 1024)
+	return inodes, 0, inodes, nil
+}
@@ -4,10 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/metrics"
+	"github.com/choffmeister/csi-driver-truenas/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type JsonHttpClient struct {
@@ -19,8 +28,11 @@ type JsonHttpClientOption = func(*JsonHttpClient)
 type JsonHttpClientHttpClientConfigurationFn = func(*http.Client)
 type JsonHttpClientRequestTransformerFn = func(*http.Request) error
 
+// nolint: gochecknoglobals
+var DefaultHttpTimeout = 30 * time.Second
+
 func NewJsonHttpClient(opts ...JsonHttpClientOption) *JsonHttpClient {
-	http := &http.Client{Transport: http.DefaultTransport}
+	http := &http.Client{Transport: http.DefaultTransport, Timeout: DefaultHttpTimeout}
 	client := &JsonHttpClient{
 		http: http,
 	}
@@ -49,7 +61,7 @@ func (c *JsonHttpClient) Get(ctx context.Context, path string, input interface{}
 	if err != nil {
 		return err
 	}
-	return c.do(req, output)
+	return c.do(req, endpointFromPath(path), output)
 }
 
 func (c *JsonHttpClient) Post(ctx context.Context, path string, input interface{}, output interface{}) error {
@@ -57,7 +69,7 @@ func (c *JsonHttpClient) Post(ctx context.Context, path string, input interface{
 	if err != nil {
 		return err
 	}
-	return c.do(req, output)
+	return c.do(req, endpointFromPath(path), output)
 }
 
 func (c *JsonHttpClient) Put(ctx context.Context, path string, input interface{}, output interface{}) error {
@@ -65,7 +77,7 @@ func (c *JsonHttpClient) Put(ctx context.Context, path string, input interface{}
 	if err != nil {
 		return err
 	}
-	return c.do(req, output)
+	return c.do(req, endpointFromPath(path), output)
 }
 
 func (c *JsonHttpClient) Patch(ctx context.Context, path string, input interface{}, output interface{}) error {
@@ -73,7 +85,7 @@ func (c *JsonHttpClient) Patch(ctx context.Context, path string, input interface
 	if err != nil {
 		return err
 	}
-	return c.do(req, output)
+	return c.do(req, endpointFromPath(path), output)
 }
 
 func (c *JsonHttpClient) Delete(ctx context.Context, path string, input interface{}, output interface{}) error {
@@ -81,7 +93,7 @@ func (c *JsonHttpClient) Delete(ctx context.Context, path string, input interfac
 	if err != nil {
 		return err
 	}
-	return c.do(req, output)
+	return c.do(req, endpointFromPath(path), output)
 }
 
 func (c *JsonHttpClient) newRequest(ctx context.Context, method, path string, input interface{}) (*http.Request, error) {
@@ -109,28 +121,68 @@ func (c *JsonHttpClient) newRequest(ctx context.Context, method, path string, in
 	return req, nil
 }
 
-func (c *JsonHttpClient) do(req *http.Request, output interface{}) error {
+func (c *JsonHttpClient) do(req *http.Request, endpoint string, output interface{}) (err error) {
+	ctx, span := tracing.Start(req.Context(), fmt.Sprintf("HTTP %s %s", req.Method, endpoint),
+		attribute.String("http.method", req.Method),
+		attribute.String("http.route", endpoint),
+	)
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	errorClass := metrics.ErrorClassNone
+	defer func() {
+		metrics.ObserveTruenasRequest(req.Method, endpoint, errorClass, time.Since(start))
+		span.SetAttributes(attribute.String("error_class", errorClass))
+		tracing.End(span, err)
+	}()
+
 	resp, err := c.http.Do(req)
 	if err != nil {
+		errorClass = metrics.ErrorClassNetwork
 		return err
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 	bs, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		errorClass = metrics.ErrorClassNetwork
 		return err
 	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errorClass = metrics.ErrorClassClient
+		if resp.StatusCode >= 500 {
+			errorClass = metrics.ErrorClassServer
+		}
 		responseBody := string(bs)
 		return NewJsonHttpClientRequestError(resp.StatusCode, responseBody, "request failed with status code %d: %s", resp.StatusCode, responseBody)
 	}
 	err = json.Unmarshal(bs, output)
 	if err != nil {
+		errorClass = metrics.ErrorClassUnmarshal
 		responseBody := string(bs)
 		return NewJsonHttpClientRequestError(resp.StatusCode, responseBody, "request could not be unmarshalled: %v", err)
 	}
 	return nil
 }
 
+// endpointFromPath strips the query and ids from a request path, so that it
+// can be used as metric label without exploding the cardinality.
+func endpointFromPath(path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = ":id"
+		} else if segment == "id" && i+1 < len(segments) {
+			segments[i+1] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 var _ error = (*JsonHttpClientError)(nil)
 
 type JsonHttpClientError struct {
@@ -164,6 +216,11 @@ func IsJsonHttpClientError(err error) bool {
 	return ok
 }
 
+func IsJsonHttpClientErrorWithStatusCode(err error, statusCode int) bool {
+	var e JsonHttpClientError
+	return errors.As(err, &e) && e.StatusCode == statusCode
+}
+
 func IsJsonHttpClientErrorWithResponseText(err error, containsText string) bool {
 	e, ok := err.(JsonHttpClientError)
 	return ok && strings.Contains(e.ResponseBody, containsText)
@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_endpointFromPath(t *testing.T) {
+	assert.Equal(t, "/pool/dataset", endpointFromPath("/pool/dataset?limit=10&offset=0"))
+	assert.Equal(t, "/pool/dataset/id/:id", endpointFromPath("/pool/dataset/id/tank%2Fk8s%2Fpvc-1"))
+	assert.Equal(t, "/iscsi/target/id/:id", endpointFromPath("/iscsi/target/id/12"))
+	assert.Equal(t, "/iscsi/extent/:id", endpointFromPath("/iscsi/extent/12"))
+}
@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -11,12 +14,46 @@ import (
 	"time"
 )
 
+// ErrISCSITargetNotFound is wrapped by Login when the portal does not offer the
+// target.
+var ErrISCSITargetNotFound = errors.New("iscsi target not found")
+
 type ISCSIUtils struct {
 	mutex sync.Mutex
+	// executor runs iscsiadm, nil means the default executor
+	executor Executor
+	// sysfsRoot is where the sysfs of the node is mounted
+	sysfsRoot string
+	// hostSysfsRoot is where the writable sysfs of the host is mounted
+	hostSysfsRoot string
+	// procRoot is where the processes of the host are visible, which includes
+	// iscsid as the node runs with hostPID
+	procRoot   string
+	retryDelay time.Duration
 }
 
 func NewISCSIUtils() *ISCSIUtils {
-	return &ISCSIUtils{}
+	return NewISCSIUtilsWithExecutor(nil, "/sys", "/host/sys", "/proc")
+}
+
+// NewISCSIUtilsWithExecutor runs iscsiadm with the given executor and looks up the
+// sessions below the given sysfs roots, which allows to test against a fake iscsiadm.
+// The iscsi config is read from the root of the iscsid process within procRoot.
+func NewISCSIUtilsWithExecutor(executor Executor, sysfsRoot string, hostSysfsRoot string, procRoot string) *ISCSIUtils {
+	return &ISCSIUtils{
+		executor:      executor,
+		sysfsRoot:     sysfsRoot,
+		hostSysfsRoot: hostSysfsRoot,
+		procRoot:      procRoot,
+		retryDelay:    time.Second,
+	}
+}
+
+func (u *ISCSIUtils) iscsiadm(ctx context.Context, args ...string) (string, int, error) {
+	if u.executor == nil {
+		return CommandContext(ctx, "iscsiadm", args...)
+	}
+	return ExecuteContext(ctx, u.executor, "iscsiadm", args...)
 }
 
 func (u *ISCSIUtils) GenerateDeviceName(portalIP string, portalPort int, target string) (string, error) {
@@ -44,20 +81,22 @@ func (u *ISCSIUtils) ParseDeviceName(deviceName string) (string, int, string, er
 	return portalIP, portalPort, portalTarget, nil
 }
 
-func (u *ISCSIUtils) Login(portalIP string, portalPort int, target string) error {
+func (u *ISCSIUtils) Login(ctx context.Context, portalIP string, portalPort int, target string) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 	portalAddress := fmt.Sprintf("%s:%d", portalIP, portalPort)
-	Info.Printf("Starting iscsi session for %s@%s\n", target, portalAddress)
+	Log.Info("Starting iscsi session", "target", target, "portal", portalAddress)
 
-	if _, _, err := Command("iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portalAddress); err != nil {
-		Command("iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portalAddress, "-o", "delete")
+	if _, _, err := u.iscsiadm(ctx, "-m", "discovery", "-t", "sendtargets", "-p", portalAddress); err != nil {
+		u.iscsiadm(ctx, "-m", "discovery", "-t", "sendtargets", "-p", portalAddress, "-o", "delete")
 		return fmt.Errorf("executing iscsiadm failed: %w", err)
 	}
-	if _, code, err := Command("iscsiadm", "-m", "node", "-T", target, "-p", portalAddress, "--login"); code == 15 {
-		Warn.Printf("There already exists an iscsi session for %s@%s already exists\n", target, portalAddress)
+	if _, code, err := u.iscsiadm(ctx, "-m", "node", "-T", target, "-p", portalAddress, "--login"); code == 15 {
+		Log.Info("There already exists an iscsi session", "target", target, "portal", portalAddress)
+	} else if code == 21 {
+		return fmt.Errorf("target %s is not offered by portal %s: %w", target, portalAddress, ErrISCSITargetNotFound)
 	} else if err != nil {
-		Command("iscsiadm", "-m", "node", "-T", target, "-p", portalAddress, "-o", "delete")
+		u.iscsiadm(ctx, "-m", "node", "-T", target, "-p", portalAddress, "-o", "delete")
 		return fmt.Errorf("executing iscsiadm failed: %w", err)
 	}
 
@@ -68,20 +107,20 @@ func (u *ISCSIUtils) Login(portalIP string, portalPort int, target string) error
 
 	// Scan the iSCSI bus for the LUN
 	if err := u.ScanLUN(hostNumber, 0); err != nil {
-		return fmt.Errorf("unable to scan lun %d on scsi host %d", 0, hostNumber)
+		return fmt.Errorf("unable to scan lun %d on scsi host %d: %w", 0, hostNumber, err)
 	}
 
 	return nil
 }
 
-func (u *ISCSIUtils) Logout(portalIP string, portalPort int, target string) error {
+func (u *ISCSIUtils) Logout(ctx context.Context, portalIP string, portalPort int, target string) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
 	portalAddress := fmt.Sprintf("%s:%d", portalIP, portalPort)
-	Info.Printf("Stopping session for %s@%s\n", target, portalAddress)
+	Log.Info("Stopping iscsi session", "target", target, "portal", portalAddress)
 
-	if _, code, err := Command("iscsiadm", "-m", "node", "-T", target, "-p", portalAddress, "--logout"); code == 21 {
-		Warn.Printf("No iscsi session for %s@%s exists\n", target, portalAddress)
+	if _, code, err := u.iscsiadm(ctx, "-m", "node", "-T", target, "-p", portalAddress, "--logout"); code == 21 {
+		Log.Info("No iscsi session exists", "target", target, "portal", portalAddress)
 	} else if err != nil {
 		return fmt.Errorf("executing iscsiadm failed: %w", err)
 	}
@@ -89,18 +128,36 @@ func (u *ISCSIUtils) Logout(portalIP string, portalPort int, target string) erro
 	return nil
 }
 
-func (u *ISCSIUtils) Rescan(target string) error {
+func (u *ISCSIUtils) Rescan(ctx context.Context, target string) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
-	Info.Printf("Rescanning session for %s\n", target)
+	Log.Info("Rescanning iscsi session", "target", target)
 
-	if _, _, err := Command("iscsiadm", "-m", "node", "--targetname", target, "-R"); err != nil {
+	if _, _, err := u.iscsiadm(ctx, "-m", "node", "--targetname", target, "-R"); err != nil {
 		return fmt.Errorf("executing iscsiadm failed: %w", err)
 	}
 
 	return nil
 }
 
+// CountSessions returns the number of iSCSI sessions known to the kernel.
+func (u *ISCSIUtils) CountSessions() (int, error) {
+	sessionDirs, err := ioutil.ReadDir(filepath.Join(u.sysfsRoot, "class/iscsi_session"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	count := 0
+	for _, sessionDir := range sessionDirs {
+		if strings.HasPrefix(sessionDir.Name(), "session") {
+			count++
+		}
+	}
+	return count, nil
+}
+
 func (u *ISCSIUtils) GetHostNumber(target string, portalAddress string) (int, error) {
 	maxAttempts := 3
 	attempt := 0
@@ -108,7 +165,7 @@ func (u *ISCSIUtils) GetHostNumber(target string, portalAddress string) (int, er
 		portalHostMap, err := u.GetISCSIPortalHostMapForTarget(target)
 		if err != nil {
 			if attempt < maxAttempts {
-				time.Sleep(time.Second)
+				time.Sleep(u.retryDelay)
 				attempt++
 				continue
 			} else {
@@ -119,7 +176,7 @@ func (u *ISCSIUtils) GetHostNumber(target string, portalAddress string) (int, er
 		if !loggedIn {
 			if attempt < maxAttempts {
 				attempt++
-				time.Sleep(time.Second)
+				time.Sleep(u.retryDelay)
 				continue
 			} else {
 				return 0, fmt.Errorf("could not get scsi host number for portal %s after logging in: %w", portalAddress, err)
@@ -132,7 +189,7 @@ func (u *ISCSIUtils) GetHostNumber(target string, portalAddress string) (int, er
 
 // https://github.com/kubernetes/kubernetes
 func (u *ISCSIUtils) ScanLUN(hostNumber int, lunNumber int) error {
-	filename := fmt.Sprintf("/host/sys/class/scsi_host/host%d/scan", hostNumber)
+	filename := filepath.Join(u.hostSysfsRoot, fmt.Sprintf("class/scsi_host/host%d/scan", hostNumber))
 	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
 	if err != nil {
 		return err
@@ -147,7 +204,7 @@ func (u *ISCSIUtils) ScanLUN(hostNumber int, lunNumber int) error {
 		return fmt.Errorf("no data written to file: %s", filename)
 	}
 
-	Info.Printf("Scanned SCSI host %d LUN %d\n", hostNumber, lunNumber)
+	Log.Info("Scanned SCSI host", "host", hostNumber, "lun", lunNumber)
 	return nil
 }
 
@@ -162,7 +219,7 @@ func (u *ISCSIUtils) GetISCSIPortalHostMapForTarget(targetIqn string) (map[strin
 	portalHostMap := make(map[string]int)
 
 	// Iterate over all the iSCSI hosts in sysfs
-	sysPath := "/sys/class/iscsi_host"
+	sysPath := filepath.Join(u.sysfsRoot, "class/iscsi_host")
 	hostDirs, err := ioutil.ReadDir(sysPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -179,7 +236,7 @@ func (u *ISCSIUtils) GetISCSIPortalHostMapForTarget(targetIqn string) (map[strin
 		}
 		hostNumber, err := strconv.Atoi(strings.TrimPrefix(hostName, "host"))
 		if err != nil {
-			Error.Printf("Could not get number from iSCSI host: %s\n", hostName)
+			Log.Error(err, "Could not get number from iSCSI host", "host", hostName)
 			continue
 		}
 
@@ -205,7 +262,7 @@ func (u *ISCSIUtils) GetISCSIPortalHostMapForTarget(targetIqn string) (map[strin
 			targetNamePath := sessionPath + "/iscsi_session/" + sessionName + "/targetname"
 			targetName, err := ioutil.ReadFile(targetNamePath)
 			if err != nil {
-				Info.Printf("Failed to process session %s, assuming this session is unavailable: %s\n", sessionName, err)
+				Log.Info("Failed to process session, assuming this session is unavailable", "session", sessionName, "error", err)
 				continue
 			}
 
@@ -218,7 +275,7 @@ func (u *ISCSIUtils) GetISCSIPortalHostMapForTarget(targetIqn string) (map[strin
 			// for the iSCSI connection.
 			dirs2, err := ioutil.ReadDir(sessionPath)
 			if err != nil {
-				Info.Printf("Failed to process session %s, assuming this session is unavailable: %s\n", sessionName, err)
+				Log.Info("Failed to process session, assuming this session is unavailable", "session", sessionName, "error", err)
 				continue
 			}
 			for _, dir2 := range dirs2 {
@@ -236,28 +293,28 @@ func (u *ISCSIUtils) GetISCSIPortalHostMapForTarget(targetIqn string) (map[strin
 				addrPath := connectionPath + "/address"
 				addr, err := ioutil.ReadFile(addrPath)
 				if err != nil {
-					Info.Printf("Failed to process connection %s, assuming this connection is unavailable: %s\n", dirName, err)
+					Log.Info("Failed to process connection, assuming this connection is unavailable", "connection", dirName, "error", err)
 					continue
 				}
 
 				portPath := connectionPath + "/port"
 				port, err := ioutil.ReadFile(portPath)
 				if err != nil {
-					Info.Printf("Failed to process connection %s, assuming this connection is unavailable: %s\n", dirName, err)
+					Log.Info("Failed to process connection, assuming this connection is unavailable", "connection", dirName, "error", err)
 					continue
 				}
 
 				persistentAddrPath := connectionPath + "/persistent_address"
 				persistentAddr, err := ioutil.ReadFile(persistentAddrPath)
 				if err != nil {
-					Info.Printf("Failed to process connection %s, assuming this connection is unavailable: %s\n", dirName, err)
+					Log.Info("Failed to process connection, assuming this connection is unavailable", "connection", dirName, "error", err)
 					continue
 				}
 
 				persistentPortPath := connectionPath + "/persistent_port"
 				persistentPort, err := ioutil.ReadFile(persistentPortPath)
 				if err != nil {
-					Info.Printf("Failed to process connection %s, assuming this connection is unavailable: %s\n", dirName, err)
+					Log.Info("Failed to process connection, assuming this connection is unavailable", "connection", dirName, "error", err)
 					continue
 				}
 
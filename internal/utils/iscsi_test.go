@@ -1,8 +1,12 @@
 package utils
 
 import (
+	"context"
+	"io/ioutil"
 	"testing"
+	"time"
 
+	"github.com/choffmeister/csi-driver-truenas/internal/utils/fake"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,3 +29,97 @@ func Test_ISCSIUtils_ParseDeviceName(t *testing.T) {
 	_, _, _, err = iscsiUtils.ParseDeviceName("/unknown")
 	assert.Error(t, err)
 }
+
+const (
+	testPortal = "10.0.0.1:3260"
+	testTarget = "iqn.2005-10.org.freenas.ctl:pvc-1"
+)
+
+func newTestISCSIUtils(t *testing.T) (*fake.ISCSIAdm, *ISCSIUtils) {
+	iscsiadm := fake.NewISCSIAdm(t.TempDir())
+	iscsiadm.AddTarget(testPortal, testTarget)
+	iscsiUtils := NewISCSIUtilsWithExecutor(iscsiadm, iscsiadm.SysfsRoot, iscsiadm.HostSysfsRoot, iscsiadm.ProcRoot)
+	iscsiUtils.retryDelay = time.Millisecond
+	return iscsiadm, iscsiUtils
+}
+
+func Test_ISCSIUtils_Login(t *testing.T) {
+	ctx := context.Background()
+	iscsiadm, iscsiUtils := newTestISCSIUtils(t)
+
+	assert.NoError(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget))
+	assert.Equal(t, []string{
+		"iscsiadm -m discovery -t sendtargets -p 10.0.0.1:3260",
+		"iscsiadm -m node -T iqn.2005-10.org.freenas.ctl:pvc-1 -p 10.0.0.1:3260 --login",
+	}, iscsiadm.Invocations())
+	assert.Equal(t, []string{testTarget + "," + testPortal}, iscsiadm.Sessions())
+	scan, err := ioutil.ReadFile(iscsiadm.ScanFile(2))
+	assert.NoError(t, err)
+	assert.Equal(t, "0 0 0", string(scan))
+	count, err := iscsiUtils.CountSessions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	portalHostMap, err := iscsiUtils.GetISCSIPortalHostMapForTarget(testTarget)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{testPortal: 2}, portalHostMap)
+
+	// an existing session is reused
+	assert.NoError(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget))
+	assert.Len(t, iscsiadm.Sessions(), 1)
+}
+
+func Test_ISCSIUtils_LoginFailures(t *testing.T) {
+	ctx := context.Background()
+	iscsiadm, iscsiUtils := newTestISCSIUtils(t)
+
+	// an unreachable portal removes the discovery record
+	assert.Error(t, iscsiUtils.Login(ctx, "10.0.0.2", 3260, testTarget))
+	assert.Contains(t, iscsiadm.Invocations(), "iscsiadm -m discovery -t sendtargets -p 10.0.0.2:3260 -o delete")
+
+	// a failed login removes the node record
+	iscsiadm.InjectFault(fake.Fault{Args: []string{"--login"}, ExitCode: fake.ExitLoginAuthFailure, Output: "iscsiadm: Login failed", Times: 1})
+	err := iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget)
+	assert.ErrorContains(t, err, "Login failed")
+	assert.Contains(t, iscsiadm.Invocations(), "iscsiadm -m node -T iqn.2005-10.org.freenas.ctl:pvc-1 -p 10.0.0.1:3260 -o delete")
+	assert.Empty(t, iscsiadm.Sessions())
+
+	// a session that does not show up in sysfs
+	iscsiadm.SetSysfsHidden(true)
+	assert.ErrorContains(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget), "unable to get scsi host number")
+	assert.NoError(t, iscsiUtils.Logout(ctx, "10.0.0.1", 3260, testTarget))
+	iscsiadm.SetSysfsHidden(false)
+
+	// a scsi host that cannot be scanned
+	assert.NoError(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget))
+	assert.NoError(t, iscsiUtils.Logout(ctx, "10.0.0.1", 3260, testTarget))
+	iscsiUtils.hostSysfsRoot = t.TempDir()
+	assert.ErrorContains(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget), "unable to scan lun 0")
+}
+
+func Test_ISCSIUtils_Logout(t *testing.T) {
+	ctx := context.Background()
+	iscsiadm, iscsiUtils := newTestISCSIUtils(t)
+
+	assert.NoError(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget))
+	assert.NoError(t, iscsiUtils.Logout(ctx, "10.0.0.1", 3260, testTarget))
+	assert.Empty(t, iscsiadm.Sessions())
+	count, err := iscsiUtils.CountSessions()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// logging out without session succeeds
+	assert.NoError(t, iscsiUtils.Logout(ctx, "10.0.0.1", 3260, testTarget))
+
+	iscsiadm.InjectFault(fake.Fault{Args: []string{"--logout"}, ExitCode: fake.ExitInvalid})
+	assert.Error(t, iscsiUtils.Logout(ctx, "10.0.0.1", 3260, testTarget))
+}
+
+func Test_ISCSIUtils_Rescan(t *testing.T) {
+	ctx := context.Background()
+	iscsiadm, iscsiUtils := newTestISCSIUtils(t)
+
+	assert.Error(t, iscsiUtils.Rescan(ctx, testTarget))
+	assert.NoError(t, iscsiUtils.Login(ctx, "10.0.0.1", 3260, testTarget))
+	assert.NoError(t, iscsiUtils.Rescan(ctx, testTarget))
+	assert.Equal(t, 1, iscsiadm.Rescans(testTarget))
+}
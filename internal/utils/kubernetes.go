@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// GetKubernetesNodeLabels fetches the labels of the given node from the
+// kubernetes api, using the service account of the pod.
+func GetKubernetesNodeLabels(ctx context.Context, name string) (map[string]string, error) {
+	node := struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}{}
+	if err := getKubernetesObject(ctx, "/api/v1/nodes/"+url.PathEscape(name), &node); err != nil {
+		return nil, fmt.Errorf("unable to get node %s: %w", name, err)
+	}
+	return node.Metadata.Labels, nil
+}
+
+// GetKubernetesSecret fetches the decoded data of the given secret from the
+// kubernetes api, using the service account of the pod.
+func GetKubernetesSecret(ctx context.Context, namespace string, name string) (map[string]string, error) {
+	secret := struct {
+		Data map[string]string `json:"data"`
+	}{}
+	if err := getKubernetesObject(ctx, fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(namespace), url.PathEscape(name)), &secret); err != nil {
+		return nil, fmt.Errorf("unable to get secret %s/%s: %w", namespace, name, err)
+	}
+	data := map[string]string{}
+	for key, value := range secret.Data {
+		bs, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key %s of secret %s/%s: %w", key, namespace, name, err)
+		}
+		data[key] = string(bs)
+	}
+	return data, nil
+}
+
+func getKubernetesObject(ctx context.Context, apiPath string, obj interface{}) error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("unable to find kubernetes api: not running inside a cluster")
+	}
+	token, err := ioutil.ReadFile(path.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return fmt.Errorf("unable to read service account token: %w", err)
+	}
+	ca, err := ioutil.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return fmt.Errorf("unable to read service account ca: %w", err)
+	}
+	server := fmt.Sprintf("https://%s", net.JoinHostPort(host, port))
+	transport, err := SharedTransport(server, TLSOptions{CA: string(ca)})
+	if err != nil {
+		return fmt.Errorf("unable to configure tls: %w", err)
+	}
+
+	url := server + apiPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	client := &http.Client{Transport: transport, Timeout: DefaultHttpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status code %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return fmt.Errorf("unable to decode response: %w", err)
+	}
+	return nil
+}
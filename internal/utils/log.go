@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	protov1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// nolint: gochecknoglobals
+var (
+	logVerbosity int32
+	logOutput    io.Writer = os.Stderr
+	logMutex     sync.Mutex
+
+	// Log is the process wide structured logger. Debug messages are logged with
+	// Log.V(1) and only written if the verbosity is at least 1.
+	Log = logr.New(newLogSink())
+)
+
+// SetLogVerbosity changes the verbosity of all loggers, including the ones that
+// already have been handed out.
+func SetLogVerbosity(verbosity int) {
+	atomic.StoreInt32(&logVerbosity, int32(verbosity))
+}
+
+func LogVerbosity() int {
+	return int(atomic.LoadInt32(&logVerbosity))
+}
+
+// SetLogOutput redirects all log output to the given writer.
+func SetLogOutput(w io.Writer) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput = w
+}
+
+// LoggerFromContext returns the request scoped logger or the global one.
+func LoggerFromContext(ctx context.Context) logr.Logger {
+	if log, err := logr.FromContext(ctx); err == nil {
+		return log
+	}
+	return Log
+}
+
+// LogVerbosityHandler allows to read (GET) and change (PUT with the verbosity as
+// plain text body) the log verbosity at runtime.
+func LogVerbosityHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 16))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			verbosity, err := strconv.Atoi(strings.TrimSpace(string(body)))
+			if err != nil || verbosity < 0 {
+				http.Error(w, "verbosity must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			SetLogVerbosity(verbosity)
+			Log.Info("Changed log verbosity", "verbosity", verbosity)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", LogVerbosity())
+	})
+}
+
+// ServeLogVerbosity starts a listener for the LogVerbosityHandler in the
+// background. The handler is unauthenticated, so the address should be a
+// loopback one.
+func ServeLogVerbosity(address string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for log level changes on %s: %w", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/loglevel", LogVerbosityHandler())
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener) // nolint: errcheck
+	return server, nil
+}
+
+var _ logr.LogSink = (*logSink)(nil)
+var _ logr.CallDepthLogSink = (*logSink)(nil)
+
+// logSink writes one JSON object per line with funcr. It checks the verbosity
+// on every call, as funcr fixes it when the logger is created.
+type logSink struct {
+	sink logr.LogSink
+}
+
+func newLogSink() logr.LogSink {
+	log := funcr.NewJSON(writeLog, funcr.Options{
+		LogCaller:        funcr.All,
+		LogTimestamp:     true,
+		TimestampFormat:  time.RFC3339Nano,
+		Verbosity:        math.MaxInt32,
+		RenderValuesHook: redactLogValues,
+		RenderArgsHook:   redactLogValues,
+	})
+	// the caller is one frame further up because of the wrapper
+	return &logSink{sink: log.WithCallDepth(1).GetSink()}
+}
+
+func writeLog(obj string) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	io.WriteString(logOutput, obj+"\n") // nolint: errcheck
+}
+
+func (s *logSink) Init(info logr.RuntimeInfo) {
+}
+
+func (s *logSink) Enabled(level int) bool {
+	return level <= LogVerbosity()
+}
+
+func (s *logSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.sink.Info(level, msg, keysAndValues...)
+}
+
+func (s *logSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.sink.Error(err, msg, keysAndValues...)
+}
+
+func (s *logSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &logSink{sink: s.sink.WithValues(keysAndValues...)}
+}
+
+func (s *logSink) WithName(name string) logr.LogSink {
+	return &logSink{sink: s.sink.WithName(name)}
+}
+
+func (s *logSink) WithCallDepth(depth int) logr.LogSink {
+	return &logSink{sink: s.sink.(logr.CallDepthLogSink).WithCallDepth(depth)}
+}
+
+// redactLogValues hides the values of keys that look like credentials and the
+// secret fields of CSI requests.
+func redactLogValues(keysAndValues []interface{}) []interface{} {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key, _ := keysAndValues[i].(string)
+		keysAndValues[i+1] = redactLogValue(key, keysAndValues[i+1])
+	}
+	return keysAndValues
+}
+
+func redactLogValue(key string, value interface{}) interface{} {
+	if isSecretKey(key) {
+		return "***"
+	}
+	if msg, ok := value.(protov1.Message); ok {
+		bs, err := protojson.Marshal(RedactSecrets(protov1.MessageV2(msg)))
+		if err != nil {
+			return "(unable to render message)"
+		}
+		var rendered interface{}
+		if err := json.Unmarshal(bs, &rendered); err != nil {
+			return "(unable to render message)"
+		}
+		return rendered
+	}
+	return value
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"password", "secret", "apikey", "api-key", "api_key", "token"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Log(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetLogOutput(buf)
+	defer SetLogOutput(os.Stderr)
+	defer SetLogVerbosity(LogVerbosity())
+	SetLogVerbosity(0)
+
+	log := Log.WithValues("requestId", "abc")
+	log.Info("Created volume", "volumeId", "tank/pvc-1", "api-key", "1-super-secret")
+	log.V(1).Info("Hidden")
+	log.Error(fmt.Errorf("boom"), "Failed", "request", &proto.CreateVolumeRequest{
+		Name:    "pvc-1",
+		Secrets: map[string]string{"truenas-api-key": "1-super-secret"},
+	})
+	SetLogVerbosity(1)
+	log.V(1).Info("Shown")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.NotContains(t, buf.String(), "1-super-secret")
+
+	entries := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		assert.NoError(t, json.Unmarshal([]byte(line), &entries[i]))
+	}
+	assert.Equal(t, float64(0), entries[0]["level"])
+	assert.Equal(t, "Created volume", entries[0]["msg"])
+	assert.Equal(t, "abc", entries[0]["requestId"])
+	assert.Equal(t, "tank/pvc-1", entries[0]["volumeId"])
+	assert.Equal(t, map[string]interface{}{"file": "log_test.go", "line": float64(23)}, entries[0]["caller"])
+	assert.NotContains(t, entries[1], "level")
+	assert.Equal(t, "boom", entries[1]["error"])
+	assert.Equal(t, map[string]interface{}{
+		"name":    "pvc-1",
+		"secrets": map[string]interface{}{"truenas-api-key": "***"},
+	}, entries[1]["request"])
+	assert.Equal(t, float64(1), entries[2]["level"])
+}
+
+func Test_RedactCommandArgs(t *testing.T) {
+	args := RedactCommandArgs([]string{"-t", "cifs", "-o", "username=user,password=pass,uid=1000"})
+	assert.Equal(t, []string{"-t", "cifs", "-o", "username=user,password=***,uid=1000"}, args)
+}
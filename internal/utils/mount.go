@@ -1,45 +1,34 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"os"
 
-	"github.com/go-logr/logr"
+	"github.com/choffmeister/csi-driver-truenas/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 )
 
-var _ logr.LogSink = (*logSink)(nil)
-
-type logSink struct{}
-
-func (s logSink) Init(info logr.RuntimeInfo) {}
-
-func (s logSink) Enabled(level int) bool {
-	return true
-}
-
-func (s logSink) Info(level int, msg string, keysAndValues ...interface{}) {
-	Info.Printf(msg, keysAndValues...)
-}
-
-func (s logSink) Error(err error, msg string, keysAndValues ...interface{}) {
-	Error.Printf(msg, keysAndValues...)
-}
-
-func (s logSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
-	return s
+func init() {
+	klog.SetLogger(Log.WithName("klog"))
 }
 
-func (s logSink) WithName(name string) logr.LogSink {
-	return s
+// Mounter mounts the devices of published volumes and inspects their file systems.
+type Mounter interface {
+	FormatAndMountDevice(ctx context.Context, device string, target string, fstype string) error
+	UnmountDevice(target string) error
+	ResizeDevice(ctx context.Context, device string, target string) error
+	GetDeviceNameFromMount(path string) (string, int, error)
+	GetMountPoint(path string) (*mount.MountPoint, error)
+	ByteFilesystemStats(volumePath string) (totalBytes int64, usedBytes int64, availableBytes int64, err error)
+	INodeFilesystemStats(volumePath string) (total int64, used int64, free int64, err error)
 }
 
-func init() {
-	klog.SetLogger(logr.New(logSink{}))
-}
+var _ Mounter = (*MountUtils)(nil)
 
 type MountUtils struct {
 	exec               *exec.Interface
@@ -62,8 +51,11 @@ func NewMountUtils() *MountUtils {
 	}
 }
 
-func (u *MountUtils) FormatAndMountDevice(device string, target string, fstype string) error {
-	Info.Printf("Mounting device %s to %s\n", device, target)
+func (u *MountUtils) FormatAndMountDevice(ctx context.Context, device string, target string, fstype string) (err error) {
+	_, span := tracing.Start(ctx, "FormatAndMountDevice", attribute.String("device", device), attribute.String("fstype", fstype))
+	defer func() { tracing.End(span, err) }()
+
+	Log.Info("Mounting device", "device", device, "target", target)
 	if err := os.MkdirAll(target, 0o775); err != nil {
 		return fmt.Errorf("unable to create mount target path: %w", err)
 	}
@@ -71,12 +63,15 @@ func (u *MountUtils) FormatAndMountDevice(device string, target string, fstype s
 }
 
 func (u *MountUtils) UnmountDevice(target string) error {
-	Info.Printf("Unmounting device at %s\n", target)
+	Log.Info("Unmounting device", "target", target)
 	return u.safeFormatAndMount.Unmount(target)
 }
 
-func (u *MountUtils) ResizeDevice(device string, target string) error {
-	_, err := u.resizeFs.Resize(device, target)
+func (u *MountUtils) ResizeDevice(ctx context.Context, device string, target string) (err error) {
+	_, span := tracing.Start(ctx, "ResizeDevice", attribute.String("device", device))
+	defer func() { tracing.End(span, err) }()
+
+	_, err = u.resizeFs.Resize(device, target)
 	return err
 }
 
@@ -85,6 +80,22 @@ func (u *MountUtils) GetDeviceNameFromMount(path string) (string, int, error) {
 	return mount.GetDeviceNameFromMount(mounter, path)
 }
 
+// GetMountPoint returns the device and mount options of the mount at the given
+// path. The returned mount point is nil if nothing is mounted there.
+func (u *MountUtils) GetMountPoint(path string) (*mount.MountPoint, error) {
+	mounter := mount.New("")
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range mountPoints {
+		if mountPoints[i].Path == path {
+			return &mountPoints[i], nil
+		}
+	}
+	return nil, nil
+}
+
 func (u *MountUtils) ByteFilesystemStats(volumePath string) (totalBytes int64, usedBytes int64, availableBytes int64, err error) {
 	statfs := &unix.Statfs_t{}
 	err = unix.Statfs(volumePath, statfs)
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"strings"
+
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// RedactSecrets returns a copy of the message with all fields that the CSI spec
+// marks as secret (like the secrets map of most requests) replaced by a
+// placeholder.
+func RedactSecrets(msg protov2.Message) protov2.Message {
+	if msg == nil {
+		return nil
+	}
+	clone := protov2.Clone(msg)
+	redactMessage(clone.ProtoReflect())
+	return clone
+}
+
+func redactMessage(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if isSecretField(fd) {
+			switch {
+			case fd.IsMap():
+				secrets := v.Map()
+				secrets.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+					secrets.Set(k, protoreflect.ValueOfString("***"))
+					return true
+				})
+			case fd.Kind() == protoreflect.StringKind && !fd.IsList():
+				m.Set(fd, protoreflect.ValueOfString("***"))
+			default:
+				m.Clear(fd)
+			}
+			return true
+		}
+		switch {
+		case fd.IsMap() && fd.MapValue().Kind() == protoreflect.MessageKind:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				redactMessage(mv.Message())
+				return true
+			})
+		case fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				redactMessage(list.Get(i).Message())
+			}
+		case !fd.IsMap() && !fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			redactMessage(v.Message())
+		}
+		return true
+	})
+}
+
+func isSecretField(fd protoreflect.FieldDescriptor) bool {
+	opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+	if !ok || opts == nil {
+		return false
+	}
+	secret, ok := protov2.GetExtension(opts, proto.E_CsiSecret).(bool)
+	return ok && secret
+}
+
+// RedactCommandArgs hides credentials that are passed on the command line, like
+// the password option of cifs mounts.
+func RedactCommandArgs(args []string) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		options := strings.Split(arg, ",")
+		for j, option := range options {
+			if kv := strings.SplitN(option, "=", 2); len(kv) == 2 && isSecretKey(kv[0]) {
+				options[j] = kv[0] + "=***"
+			}
+		}
+		result[i] = strings.Join(options, ",")
+	}
+	return result
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// LoadSecretsDir reads a kubernetes secret that has been mounted as directory,
+// where every key is a file containing the value.
+func LoadSecretsDir(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secrets directory %s: %w", dir, err)
+	}
+	secrets := map[string]string{}
+	for _, entry := range entries {
+		// kubernetes keeps the actual files in hidden ..data directories
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secret %s: %w", entry.Name(), err)
+		}
+		secrets[entry.Name()] = strings.TrimRight(string(bs), "\r\n")
+	}
+	return secrets, nil
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type TLSOptions struct {
+	SkipVerify bool
+	// PEM encoded CA bundle used instead of the system roots
+	CA string
+	// hex encoded SHA-256 fingerprint the server leaf certificate must match
+	Fingerprint string
+	// PEM encoded client certificate and key for mutual TLS
+	ClientCert string
+	ClientKey  string
+}
+
+// hash identifies the options without keeping the client key around.
+func (opts TLSOptions) hash() [sha256.Size]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%t\x00%s\x00%s\x00%s\x00%s", opts.SkipVerify, opts.CA, opts.Fingerprint, opts.ClientCert, opts.ClientKey)))
+}
+
+type sharedTransport struct {
+	hash      [sha256.Size]byte
+	transport *http.Transport
+}
+
+var (
+	sharedTransportsMutex sync.Mutex
+	sharedTransports      = map[string]sharedTransport{}
+)
+
+// SharedTransport returns the transport for the given key, e.g. the url of the
+// server. Transports are reused across callers, so that keep-alive connections
+// and TLS sessions survive. When the TLS options of a key change, e.g. after a
+// certificate rotation, the previous transport is closed and replaced.
+func SharedTransport(key string, opts TLSOptions) (*http.Transport, error) {
+	sharedTransportsMutex.Lock()
+	defer sharedTransportsMutex.Unlock()
+
+	hash := opts.hash()
+	previous, ok := sharedTransports[key]
+	if ok && previous.hash == hash {
+		return previous.transport, nil
+	}
+	tlsConfig, err := NewTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if ok {
+		previous.transport.CloseIdleConnections()
+	}
+	sharedTransports[key] = sharedTransport{hash: hash, transport: transport}
+	return transport, nil
+}
+
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: opts.SkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if opts.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(opts.CA)) {
+			return nil, fmt.Errorf("unable to parse ca bundle: no pem encoded certificates found")
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		if opts.ClientCert == "" || opts.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and client key must be given together")
+		}
+		cert, err := tls.X509KeyPair([]byte(opts.ClientCert), []byte(opts.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.Fingerprint != "" {
+		fingerprint, err := ParseFingerprint(opts.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// a pinned certificate is trusted on its own, so the chain only has to be
+		// verified when a ca bundle has been given explicitly
+		if opts.CA == "" {
+			config.InsecureSkipVerify = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server did not present a certificate")
+			}
+			actual := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if hex.EncodeToString(actual[:]) != fingerprint {
+				return fmt.Errorf("server certificate fingerprint %s does not match pinned fingerprint %s", hex.EncodeToString(actual[:]), fingerprint)
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// ParseFingerprint normalizes a SHA-256 fingerprint given either as plain hex or
+// in the colon separated notation printed by openssl.
+func ParseFingerprint(fingerprint string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	bs, err := hex.DecodeString(normalized)
+	if err != nil || len(bs) != sha256.Size {
+		return "", fmt.Errorf("fingerprint %q is not a hex encoded sha256 hash", fingerprint)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseFingerprint(t *testing.T) {
+	fingerprint, err := ParseFingerprint(strings.Repeat("AB:", 31) + "AB")
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("ab", 32), fingerprint)
+
+	_, err = ParseFingerprint("abcd")
+	assert.Error(t, err)
+}
+
+func Test_NewTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	get := func(opts TLSOptions) error {
+		config, err := NewTLSConfig(opts)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	assert.Error(t, get(TLSOptions{}))
+	assert.NoError(t, get(TLSOptions{SkipVerify: true}))
+	assert.NoError(t, get(TLSOptions{CA: caPEM}))
+	assert.NoError(t, get(TLSOptions{Fingerprint: fingerprint}))
+	assert.NoError(t, get(TLSOptions{CA: caPEM, Fingerprint: fingerprint}))
+	assert.Error(t, get(TLSOptions{Fingerprint: strings.Repeat("00", 32)}))
+	assert.Error(t, get(TLSOptions{CA: "garbage"}))
+	assert.Error(t, get(TLSOptions{ClientCert: caPEM}))
+}
+
+func Test_SharedTransport(t *testing.T) {
+	t1, err := SharedTransport("https://nas-a", TLSOptions{SkipVerify: true})
+	assert.NoError(t, err)
+	t2, err := SharedTransport("https://nas-a", TLSOptions{SkipVerify: true})
+	assert.NoError(t, err)
+	t3, err := SharedTransport("https://nas-b", TLSOptions{SkipVerify: true})
+	assert.NoError(t, err)
+	assert.Same(t, t1, t2)
+	assert.NotSame(t, t1, t3)
+
+	// changed options replace the transport of the key
+	t4, err := SharedTransport("https://nas-a", TLSOptions{})
+	assert.NoError(t, err)
+	assert.NotSame(t, t1, t4)
+	assert.Len(t, sharedTransports, 2)
+	assert.Equal(t, TLSOptions{}.hash(), sharedTransports["https://nas-a"].hash)
+}
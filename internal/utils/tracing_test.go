@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`)) // nolint: errcheck
+	}))
+	defer server.Close()
+	client := NewJsonHttpClient(WithRequestTransformer(func(r *http.Request) error {
+		r.URL.Scheme = "http"
+		r.URL.Host = server.Listener.Addr().String()
+		return nil
+	}))
+
+	ctx, parent := tracing.Start(context.Background(), "parent")
+	var output interface{}
+	assert.NoError(t, client.Get(ctx, "/pool/dataset/id/tank%2Fpvc-1", nil, &output))
+	_, _, err := CommandContext(ctx, "false")
+	assert.Error(t, err)
+	parent.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 3)
+	assert.Equal(t, "HTTP GET /pool/dataset/id/:id", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Equal(t, "exec false", spans[1].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[1].Parent.SpanID())
+	assert.Equal(t, "Error", spans[1].Status.Code.String())
+	assert.Equal(t, "parent", spans[2].Name)
+}
@@ -18,7 +18,7 @@ var (
 func main() {
 	cmd.Version = cmd.FullVersion{Version: version, Commit: commit, Date: date, BuiltBy: builtBy}
 	if err := cmd.Execute(); err != nil {
-		utils.Error.Printf("Error: %v\n", err)
+		utils.Log.Error(err, "Error")
 		os.Exit(1)
 	}
 }
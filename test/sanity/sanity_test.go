@@ -0,0 +1,463 @@
+// Package sanity runs the identity, controller and node services in-process
+// against a fake TrueNAS, a fake iscsiadm and a fake mounter and checks them for
+// conformance with the CSI spec, following the cases of csi-sanity from
+// kubernetes-csi/csi-test. Unlike the official test suite in test/e2e it does not
+// need a cluster and runs with every go test.
+package sanity
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/choffmeister/csi-driver-truenas/internal/backends"
+	truenasfake "github.com/choffmeister/csi-driver-truenas/internal/backends/truenas/fake"
+	"github.com/choffmeister/csi-driver-truenas/internal/config"
+	"github.com/choffmeister/csi-driver-truenas/internal/services"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils"
+	"github.com/choffmeister/csi-driver-truenas/internal/utils/fake"
+	proto "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	testBaseIQN = "iqn.2005-10.org.freenas.ctl"
+	testNodeId  = "node-1"
+)
+
+type driver struct {
+	truenas    *truenasfake.Server
+	iscsiadm   *fake.ISCSIAdm
+	mounter    *fake.Mounter
+	secrets    map[string]string
+	dir        string
+	address    string
+	controller proto.ControllerClient
+	node       proto.NodeClient
+}
+
+// startDriver serves all services on a temporary unix socket.
+func startDriver(t *testing.T) *driver {
+	truenas := truenasfake.NewServer("1-api-key")
+	t.Cleanup(truenas.Close)
+	truenas.AddPool("tank", 10*1024*1024*1024)
+	truenas.AddDataset("tank/k8s", 0)
+	secrets := map[string]string{
+		"truenas-url":            truenas.URL,
+		"truenas-api-key":        "1-api-key",
+		"truenas-parent-dataset": "tank/k8s",
+		"iscsi-base-iqn":         testBaseIQN,
+		"iscsi-portal-ip":        "127.0.0.1",
+		"iscsi-portal-id":        "1",
+		"iscsi-initiator-id":     "1",
+	}
+
+	dir := t.TempDir()
+	iscsiadm := fake.NewISCSIAdm(dir)
+	iscsiadm.Discover = func(portal string) ([]string, bool) {
+		if portal != "127.0.0.1:3260" {
+			return nil, false
+		}
+		targets := []string{}
+		for _, target := range truenas.Targets() {
+			targets = append(targets, testBaseIQN+":"+target.Name)
+		}
+		return targets, true
+	}
+	mounter := fake.NewMounter()
+
+	cfg := config.Default()
+	cfg.NodeId = testNodeId
+	socketFile := path.Join(dir, "csi.sock")
+	listener, err := net.Listen("unix", socketFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := services.CreateGRPCServer()
+	identityService := services.NewIdentityService(cfg)
+	proto.RegisterIdentityServer(server, identityService)
+	proto.RegisterControllerServer(server, services.NewControllerService(cfg, secrets))
+	iscsiUtils := utils.NewISCSIUtilsWithExecutor(iscsiadm, iscsiadm.SysfsRoot, iscsiadm.HostSysfsRoot, iscsiadm.ProcRoot)
+	proto.RegisterNodeServer(server, services.NewNodeServiceWithUtils(cfg, mounter, iscsiUtils))
+	identityService.SetReady(true)
+
+	stop := make(chan os.Signal, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- services.Serve(server, listener, identityService, stop, 5*time.Second)
+	}()
+	conn, err := grpc.Dial("unix://"+socketFile, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		stop <- syscall.SIGTERM
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+
+	return &driver{
+		truenas:    truenas,
+		iscsiadm:   iscsiadm,
+		mounter:    mounter,
+		secrets:    secrets,
+		dir:        dir,
+		address:    "unix://" + socketFile,
+		controller: proto.NewControllerClient(conn),
+		node:       proto.NewNodeClient(conn),
+	}
+}
+
+func mountCapability() *proto.VolumeCapability {
+	return &proto.VolumeCapability{
+		AccessType: &proto.VolumeCapability_Mount{Mount: &proto.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &proto.VolumeCapability_AccessMode{Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func (d *driver) createVolume(t *testing.T, name string, size int64) *proto.Volume {
+	resp, err := d.controller.CreateVolume(context.Background(), &proto.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &proto.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+		Secrets:            d.secrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Volume
+}
+
+func assertCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	assert.Equal(t, code, status.Code(err), "%v", err)
+}
+
+// Test_Sanity runs the csi-test sanity suite, which covers the behaviour the
+// spec demands of every driver.
+func Test_Sanity(t *testing.T) {
+	d := startDriver(t)
+	secrets, err := yaml.Marshal(map[string]map[string]string{
+		"CreateVolumeSecret":                         d.secrets,
+		"DeleteVolumeSecret":                         d.secrets,
+		"ControllerValidateVolumeCapabilitiesSecret": d.secrets,
+		"ControllerExpandVolumeSecret":               d.secrets,
+		"NodePublishVolumeSecret":                    d.secrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsFile := path.Join(d.dir, "secrets.yaml")
+	if err := os.WriteFile(secretsFile, secrets, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := sanity.NewTestConfig()
+	cfg.Address = d.address
+	cfg.SecretsFile = secretsFile
+	cfg.TargetPath = path.Join(d.dir, "sanity-target")
+	cfg.StagingPath = path.Join(d.dir, "sanity-staging")
+	cfg.TestVolumeSize = 128 * 1024 * 1024
+	cfg.TestVolumeExpandSize = 256 * 1024 * 1024
+	sanity.Test(t, cfg)
+}
+
+func Test_Controller(t *testing.T) {
+	ctx := context.Background()
+	d := startDriver(t)
+
+	t.Run("CreateVolume rejects block volumes", func(t *testing.T) {
+		_, err := d.controller.CreateVolume(ctx, &proto.CreateVolumeRequest{
+			Name: "pvc-invalid",
+			VolumeCapabilities: []*proto.VolumeCapability{{
+				AccessType: &proto.VolumeCapability_Block{Block: &proto.VolumeCapability_BlockVolume{}},
+				AccessMode: &proto.VolumeCapability_AccessMode{Mode: proto.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Secrets: d.secrets,
+		})
+		assertCode(t, codes.InvalidArgument, err)
+		assert.Nil(t, d.truenas.Dataset("tank/k8s/pvc-invalid"))
+	})
+
+	t.Run("CreateVolume is idempotent", func(t *testing.T) {
+		volume := d.createVolume(t, "pvc-idempotent", 128*1024*1024)
+		assert.Equal(t, int64(128*1024*1024), volume.CapacityBytes)
+		again := d.createVolume(t, "pvc-idempotent", 128*1024*1024)
+		assert.Equal(t, volume.VolumeId, again.VolumeId)
+		assert.Equal(t, volume.VolumeContext, again.VolumeContext)
+		assert.Len(t, d.truenas.Targets(), 1)
+	})
+
+	t.Run("CreateVolume retries stay on the backend of the first attempt", func(t *testing.T) {
+		other := truenasfake.NewServer("1-api-key")
+		t.Cleanup(other.Close)
+		other.AddPool("tank", 10*1024*1024*1024)
+		other.AddDataset("tank/k8s", 0)
+		secrets := map[string]string{
+			"truenas-url.nas-a": d.secrets["truenas-url"],
+			"truenas-url.nas-b": other.URL,
+		}
+		for key, value := range d.secrets {
+			if key != "truenas-url" {
+				secrets[key] = value
+			}
+		}
+		req := &proto.CreateVolumeRequest{
+			Name:               "pvc-retry",
+			CapacityRange:      &proto.CapacityRange{RequiredBytes: 128 * 1024 * 1024},
+			VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+			Parameters:         map[string]string{"placement-policy": "round-robin"},
+			Secrets:            secrets,
+		}
+		resp, err := d.controller.CreateVolume(ctx, req)
+		assert.NoError(t, err)
+		// round-robin would pick the other backend for the retry
+		again, err := d.controller.CreateVolume(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, resp.Volume.VolumeId, again.Volume.VolumeId)
+		created := 0
+		for _, server := range []*truenasfake.Server{d.truenas, other} {
+			if server.Dataset("tank/k8s/pvc-retry") != nil {
+				created++
+			}
+		}
+		assert.Equal(t, 1, created)
+		_, err = d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId, Secrets: secrets})
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateVolume returns volume ids within the length limit of the spec", func(t *testing.T) {
+		name := "pvc-3f0c9a52-8d5e-4b5f-9a0e-6c1d2b7e4f81"
+		volume := d.createVolume(t, name, 128*1024*1024)
+		assert.LessOrEqual(t, len(volume.VolumeId), 128)
+		assert.Equal(t, testBaseIQN+":"+name, volume.VolumeContext["iscsi-iqn"])
+		_, err := d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: volume.VolumeId, Secrets: d.secrets})
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateVolume fails for an invalid capacity range", func(t *testing.T) {
+		_, err := d.controller.CreateVolume(ctx, &proto.CreateVolumeRequest{
+			Name:               "pvc-range",
+			CapacityRange:      &proto.CapacityRange{RequiredBytes: 256 * 1024 * 1024, LimitBytes: 128 * 1024 * 1024},
+			VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+			Secrets:            d.secrets,
+		})
+		assertCode(t, codes.OutOfRange, err)
+	})
+
+	t.Run("CreateVolume rounds the size up to the volblocksize", func(t *testing.T) {
+		req := &proto.CreateVolumeRequest{
+			Name:               "pvc-rounded",
+			CapacityRange:      &proto.CapacityRange{RequiredBytes: 100*1024*1024 + 1},
+			VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+			Parameters:         map[string]string{"truenas-volblocksize": "16K"},
+			Secrets:            d.secrets,
+		}
+		resp, err := d.controller.CreateVolume(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100*1024*1024+16*1024), resp.Volume.CapacityBytes)
+		_, err = d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId, Secrets: d.secrets})
+		assert.NoError(t, err)
+
+		req.Name = "pvc-rounded-limit"
+		req.CapacityRange.LimitBytes = 100*1024*1024 + 1
+		_, err = d.controller.CreateVolume(ctx, req)
+		assertCode(t, codes.OutOfRange, err)
+	})
+
+	t.Run("CreateVolume fails for insufficient capacity", func(t *testing.T) {
+		_, err := d.controller.CreateVolume(ctx, &proto.CreateVolumeRequest{
+			Name:               "pvc-huge",
+			CapacityRange:      &proto.CapacityRange{RequiredBytes: 100 * 1024 * 1024 * 1024},
+			VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+			Secrets:            d.secrets,
+		})
+		assertCode(t, codes.ResourceExhausted, err)
+		assert.Contains(t, err.Error(), "107374182400 bytes are required")
+	})
+
+	t.Run("CreateVolume expands secret templates", func(t *testing.T) {
+		secrets := map[string]string{}
+		for key, value := range d.secrets {
+			secrets[key] = value
+		}
+		secrets["truenas-parent-dataset"] = "tank/k8s/${pvc.namespace}"
+		req := &proto.CreateVolumeRequest{
+			Name:               "pvc-template",
+			CapacityRange:      &proto.CapacityRange{RequiredBytes: 128 * 1024 * 1024},
+			VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+			Secrets:            secrets,
+		}
+		_, err := d.controller.CreateVolume(ctx, req)
+		assertCode(t, codes.InvalidArgument, err)
+		assert.Contains(t, err.Error(), "--extra-create-metadata")
+
+		req.Parameters = map[string]string{"csi.storage.k8s.io/pvc/namespace": "team-a", "csi.storage.k8s.io/pvc/name": "data"}
+		resp, err := d.controller.CreateVolume(ctx, req)
+		assert.NoError(t, err)
+		id, err := backends.ParseVolumeId(resp.Volume.VolumeId)
+		assert.NoError(t, err)
+		assert.Equal(t, "tank/k8s/team-a/pvc-template", id.Dataset)
+		// the parent dataset of the namespace is created on demand
+		assert.Equal(t, "FILESYSTEM", d.truenas.Dataset("tank/k8s/team-a").Type)
+		_, err = d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId, Secrets: secrets})
+		assert.NoError(t, err)
+		assert.Nil(t, d.truenas.Dataset("tank/k8s/team-a/pvc-template"))
+	})
+
+	t.Run("CreateVolume creates a parent dataset per namespace", func(t *testing.T) {
+		req := &proto.CreateVolumeRequest{
+			Name:               "pvc-namespace",
+			CapacityRange:      &proto.CapacityRange{RequiredBytes: 128 * 1024 * 1024},
+			VolumeCapabilities: []*proto.VolumeCapability{mountCapability()},
+			Parameters: map[string]string{
+				"truenas-parent-dataset":           "tank/k8s/${namespace}",
+				"truenas-parent-dataset-quota":     "1Gi",
+				"csi.storage.k8s.io/pvc/namespace": "team-b",
+			},
+			Secrets: d.secrets,
+		}
+		resp, err := d.controller.CreateVolume(ctx, req)
+		assert.NoError(t, err)
+		id, err := backends.ParseVolumeId(resp.Volume.VolumeId)
+		assert.NoError(t, err)
+		assert.Equal(t, "tank/k8s/team-b/pvc-namespace", id.Dataset)
+		assert.Equal(t, int64(1024*1024*1024), d.truenas.Dataset("tank/k8s/team-b").Quota)
+		_, err = d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId, Secrets: d.secrets})
+		assert.NoError(t, err)
+	})
+
+	t.Run("ControllerGetVolume reports the volume condition", func(t *testing.T) {
+		volume := d.createVolume(t, "pvc-get", 128*1024*1024)
+		resp, err := d.controller.ControllerGetVolume(ctx, &proto.ControllerGetVolumeRequest{VolumeId: volume.VolumeId})
+		assert.NoError(t, err)
+		assert.Equal(t, volume.CapacityBytes, resp.Volume.CapacityBytes)
+		assert.False(t, resp.Status.VolumeCondition.Abnormal)
+	})
+
+	t.Run("ControllerExpandVolume", func(t *testing.T) {
+		volume := d.createVolume(t, "pvc-expand", 128*1024*1024)
+		capacity := &proto.CapacityRange{RequiredBytes: 256 * 1024 * 1024}
+		for i := 0; i < 2; i++ {
+			resp, err := d.controller.ControllerExpandVolume(ctx, &proto.ControllerExpandVolumeRequest{VolumeId: volume.VolumeId, CapacityRange: capacity, Secrets: d.secrets})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(256*1024*1024), resp.CapacityBytes)
+			assert.True(t, resp.NodeExpansionRequired)
+		}
+		smaller := &proto.CapacityRange{RequiredBytes: 128 * 1024 * 1024}
+		resp, err := d.controller.ControllerExpandVolume(ctx, &proto.ControllerExpandVolumeRequest{VolumeId: volume.VolumeId, CapacityRange: smaller, Secrets: d.secrets})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(256*1024*1024), resp.CapacityBytes)
+		smaller.LimitBytes = 128 * 1024 * 1024
+		_, err = d.controller.ControllerExpandVolume(ctx, &proto.ControllerExpandVolumeRequest{VolumeId: volume.VolumeId, CapacityRange: smaller, Secrets: d.secrets})
+		assertCode(t, codes.OutOfRange, err)
+		huge := &proto.CapacityRange{RequiredBytes: 100 * 1024 * 1024 * 1024}
+		_, err = d.controller.ControllerExpandVolume(ctx, &proto.ControllerExpandVolumeRequest{VolumeId: volume.VolumeId, CapacityRange: huge, Secrets: d.secrets})
+		assertCode(t, codes.ResourceExhausted, err)
+	})
+
+	t.Run("DeleteVolume removes the zvol and its iscsi target", func(t *testing.T) {
+		volume := d.createVolume(t, "pvc-delete", 128*1024*1024)
+		_, err := d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: volume.VolumeId, Secrets: d.secrets})
+		assert.NoError(t, err)
+		assert.Nil(t, d.truenas.Dataset("tank/k8s/pvc-delete"))
+		for _, target := range d.truenas.Targets() {
+			assert.NotEqual(t, "pvc-delete", target.Name)
+		}
+	})
+}
+
+func Test_Node(t *testing.T) {
+	ctx := context.Background()
+	d := startDriver(t)
+
+	t.Run("volume lifecycle", func(t *testing.T) {
+		volume := d.createVolume(t, "pvc-lifecycle", 128*1024*1024)
+		targetPath := path.Join(d.dir, "target")
+		publish := &proto.NodePublishVolumeRequest{
+			VolumeId:         volume.VolumeId,
+			VolumeContext:    volume.VolumeContext,
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(),
+			Secrets:          d.secrets,
+		}
+		for i := 0; i < 2; i++ {
+			_, err := d.node.NodePublishVolume(ctx, publish)
+			assert.NoError(t, err)
+		}
+		assert.Len(t, d.iscsiadm.Sessions(), 1)
+		assert.Len(t, d.mounter.Mounts(), 1)
+
+		stats, err := d.node.NodeGetVolumeStats(ctx, &proto.NodeGetVolumeStatsRequest{VolumeId: volume.VolumeId, VolumePath: targetPath})
+		assert.NoError(t, err)
+		assert.Len(t, stats.Usage, 2)
+
+		capacity := &proto.CapacityRange{RequiredBytes: 256 * 1024 * 1024}
+		_, err = d.controller.ControllerExpandVolume(ctx, &proto.ControllerExpandVolumeRequest{VolumeId: volume.VolumeId, CapacityRange: capacity, Secrets: d.secrets})
+		assert.NoError(t, err)
+		expanded, err := d.node.NodeExpandVolume(ctx, &proto.NodeExpandVolumeRequest{VolumeId: volume.VolumeId, VolumePath: targetPath, CapacityRange: capacity})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(256*1024*1024), expanded.CapacityBytes)
+		assert.Equal(t, 1, d.iscsiadm.Rescans(volume.VolumeContext["iscsi-iqn"]))
+
+		for i := 0; i < 2; i++ {
+			_, err = d.node.NodeUnpublishVolume(ctx, &proto.NodeUnpublishVolumeRequest{VolumeId: volume.VolumeId, TargetPath: targetPath})
+			assert.NoError(t, err)
+		}
+		assert.Empty(t, d.iscsiadm.Sessions())
+		assert.Empty(t, d.mounter.Mounts())
+
+		_, err = d.controller.DeleteVolume(ctx, &proto.DeleteVolumeRequest{VolumeId: volume.VolumeId, Secrets: d.secrets})
+		assert.NoError(t, err)
+	})
+
+	t.Run("static volumes are imported once", func(t *testing.T) {
+		d.truenas.AddDataset("tank/static", 0)
+		d.truenas.AddDataset("tank/static/data", 128*1024*1024)
+		targetPath := path.Join(d.dir, "static")
+		publish := &proto.NodePublishVolumeRequest{
+			VolumeId:         "tank/static/data",
+			TargetPath:       targetPath,
+			VolumeCapability: mountCapability(),
+			Secrets:          d.secrets,
+		}
+		_, err := d.node.NodePublishVolume(ctx, publish)
+		assert.NoError(t, err)
+		_, err = d.node.NodeUnpublishVolume(ctx, &proto.NodeUnpublishVolumeRequest{VolumeId: publish.VolumeId, TargetPath: targetPath})
+		assert.NoError(t, err)
+		imports := countRequests(d.truenas.Requests(), "POST /iscsi/")
+
+		_, err = d.node.NodePublishVolume(ctx, publish)
+		assert.NoError(t, err)
+		assert.Equal(t, imports, countRequests(d.truenas.Requests(), "POST /iscsi/"))
+		if assert.Len(t, d.iscsiadm.Sessions(), 1) {
+			assert.True(t, strings.HasPrefix(d.iscsiadm.Sessions()[0], testBaseIQN+":tank-static-data,"))
+		}
+
+		_, err = d.node.NodeUnpublishVolume(ctx, &proto.NodeUnpublishVolumeRequest{VolumeId: publish.VolumeId, TargetPath: targetPath})
+		assert.NoError(t, err)
+		assert.Empty(t, d.iscsiadm.Sessions())
+	})
+}
+
+func countRequests(requests []string, prefix string) int {
+	count := 0
+	for _, request := range requests {
+		if strings.HasPrefix(request, prefix) {
+			count++
+		}
+	}
+	return count
+}